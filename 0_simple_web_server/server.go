@@ -1,15 +1,34 @@
-package main
+// Package simple is the plain HTTP server the talk starts from, run by
+// 1mws simple.
+package simple
 
 import (
+	"github.com/eranyanay/1m-go-websockets/config"
 	"io"
 	"net/http"
 )
 
+var (
+	flags = config.NewFlagSet("simple")
+	cfg   = config.New()
+)
+
 func hello(w http.ResponseWriter, r *http.Request) {
 	io.WriteString(w, "Hello GopherCon Israel 2019!")
 }
 
-func main() {
+// Main runs the server with the command line arguments args.
+func Main(args []string) error {
+	cfg.Pprof = ""
+	cfg.Register(flags)
+	if err := config.Parse(flags, args); err != nil {
+		return err
+	}
+	if err := cfg.Setup(); err != nil {
+		return err
+	}
+	cfg.ServePprof()
+
 	http.HandleFunc("/", hello)
-	http.ListenAndServe(":8000", nil)
+	return http.ListenAndServe(cfg.Listen, nil)
 }
@@ -1,11 +1,24 @@
-package main
+// Package example is the first websocket server of the talk, reading every
+// connection from a goroutine of its own with no limit on their number,
+// run by 1mws example.
+package example
 
 import (
+	"context"
+	"github.com/eranyanay/1m-go-websockets/config"
+	"github.com/eranyanay/1m-go-websockets/shutdown"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
 )
 
+var (
+	flags = config.NewFlagSet("example")
+	cfg   = config.New()
+)
+
+var registry = shutdown.NewRegistry()
+
 func ws(w http.ResponseWriter, r *http.Request) {
 	// Upgrade connection
 	upgrader := websocket.Upgrader{}
@@ -13,20 +26,51 @@ func ws(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		return
 	}
+	registry.Add(conn)
 	// Read messages from socket
 	for {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
+			registry.Remove(conn)
 			conn.Close()
 			return
 		}
-		log.Printf("msg: %s", string(msg))
+		cfg.Messagef("msg: %s", string(msg))
 	}
 }
 
-func main() {
+// Main runs the server with the command line arguments args.
+func Main(args []string) error {
+	cfg.Pprof = ""
+	cfg.Register(flags)
+	if err := config.Parse(flags, args); err != nil {
+		return err
+	}
+	if err := cfg.Setup(); err != nil {
+		return err
+	}
+	cfg.ServePprof()
+
+	// Serve until a signal asks to stop
 	http.HandleFunc("/", ws)
-	if err := http.ListenAndServe(":8000", nil); err != nil {
-		log.Fatal(err)
+	web := &http.Server{Addr: cfg.Listen}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- web.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-shutdown.Notify():
+		log.Printf("Received %v, draining %v connections", sig, registry.Len())
+	}
+
+	// Stop accepting and close every connection with 1001 Going Away
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown.DefaultTimeout)
+	defer cancel()
+	web.Shutdown(ctx)
+	if err := registry.Drain(ctx, shutdown.DefaultRate); err != nil {
+		log.Printf("Failed to drain connections: %v", err)
 	}
+	return nil
 }
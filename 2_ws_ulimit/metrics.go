@@ -0,0 +1,55 @@
+package goroutine
+
+import (
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+)
+
+// The metrics served on localhost:6060/metrics, registered by
+// registerMetrics.
+var (
+	upgrades    *metrics.Counter
+	closes      map[string]*metrics.Counter
+	messagesIn  *metrics.Counter
+	bytesIn     *metrics.Counter
+	messagesOut *metrics.Counter
+	bytesOut    *metrics.Counter
+)
+
+// closeReasons are the reasons the read loop of a connection ends for: a
+// close frame, the peer hanging up without one, or any other error.
+var closeReasons = []string{"peer_close", "peer_gone", "error"}
+
+// closeReason classifies the error the read loop of a connection ended
+// with. gorilla reports a peer hanging up as 1006 Abnormal Closure.
+func closeReason(err error) string {
+	ce, ok := err.(*websocket.CloseError)
+	switch {
+	case !ok:
+		return "error"
+	case ce.Code == websocket.CloseAbnormalClosure:
+		return "peer_gone"
+	}
+	return "peer_close"
+}
+
+// registerMetrics adds the metrics of the server to metrics.Default.
+func registerMetrics() {
+	set := metrics.Default
+	set.NewGaugeFunc("ws_connections", "Connections currently open.", func() float64 {
+		return float64(atomic.LoadInt64(&count))
+	})
+	upgrades = set.NewCounter("ws_upgrades_total", "Connections upgraded since the server started.")
+	closes = make(map[string]*metrics.Counter, len(closeReasons))
+	for _, r := range closeReasons {
+		closes[r] = set.NewCounter(`ws_closes_total{reason="`+r+`"}`, "Connections closed, by reason.")
+	}
+	set.NewCounterFunc("ws_rejected_total", "Upgrades rejected by the connection limit or the client quotas.", func() float64 {
+		return float64(admit.Rejected())
+	})
+	messagesIn = set.NewCounter("ws_messages_received_total", "Data messages received.")
+	bytesIn = set.NewCounter("ws_received_bytes_total", "Payload bytes of the data messages received.")
+	messagesOut = set.NewCounter("ws_messages_sent_total", "Data messages written.")
+	bytesOut = set.NewCounter("ws_sent_bytes_total", "Payload bytes of the data messages written.")
+}
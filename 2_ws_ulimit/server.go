@@ -1,20 +1,41 @@
-package main
+// Package goroutine is the server reading every connection from a
+// goroutine of its own, within the file descriptor limit, run by 1mws
+// goroutine.
+package goroutine
 
 import (
+	"context"
+	"github.com/eranyanay/1m-go-websockets/admission"
+	"github.com/eranyanay/1m-go-websockets/config"
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"github.com/eranyanay/1m-go-websockets/shutdown"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
-	"runtime"
-	"runtime/debug"
 	"sync/atomic"
-	"syscall"
 	"time"
 )
 
+var (
+	flags  = config.NewFlagSet("goroutine")
+	cfg    = config.New()
+	limits = config.NewLimits()
+)
+
 var count int64
 
+var registry = shutdown.NewRegistry()
+
+// admit counts the connections, each held by the handler reading it.
+var admit *admission.Controller
+
 func ws(w http.ResponseWriter, r *http.Request) {
+	if err := admit.Acquire(r.RemoteAddr); err != nil {
+		admit.Reject(w, err)
+		return
+	}
+	defer admit.Release(r.RemoteAddr)
+
 	upgrader := websocket.Upgrader{}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -22,15 +43,12 @@ func ws(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	n := atomic.AddInt64(&count, 1)
-	if n%100 == 0 {
-		log.Printf("Total number of connections: %v", n)
-	}
+	atomic.AddInt64(&count, 1)
+	upgrades.Inc()
+	registry.Add(conn)
 	defer func() {
-		n := atomic.AddInt64(&count, -1)
-		if n%100 == 0 {
-			log.Printf("Total number of connections: %v", n)
-		}
+		registry.Remove(conn)
+		atomic.AddInt64(&count, -1)
 		conn.Close()
 	}()
 
@@ -38,65 +56,81 @@ func ws(w http.ResponseWriter, r *http.Request) {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("Read error: %v", err)
+			closes[closeReason(err)].Inc()
 			return
 		}
+		messagesIn.Inc()
+		bytesIn.Add(len(msg))
 
 		receivedTime := time.Now()
 		_ = msg
 		//log.Printf("msg: %s received at: %s", string(msg), receivedTime.Format(time.RFC3339Nano))
 
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(receivedTime.Format(time.RFC3339Nano))); err != nil {
+		reply := []byte(receivedTime.Format(time.RFC3339Nano))
+		err = conn.WriteMessage(websocket.TextMessage, reply)
+		if err == nil {
+			messagesOut.Inc()
+			bytesOut.Add(len(reply))
+		}
+		if err == websocket.ErrCloseSent {
+			// Shutting down, keep reading until the peer answers the close
+			continue
+		}
+		if err != nil {
 			log.Printf("Write error: %v", err)
 			return
 		}
 	}
 }
 
-func main() {
-	previousLimit := SetMemoryLimit(11 * 1024 * 1024 * 1024) // 11 GB
-	println("Previous memory limit:", previousLimit)
-
-        // Increase resources limitations
-	var rLimit syscall.Rlimit
-	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+// Main runs the server with the command line arguments args.
+func Main(args []string) error {
+	cfg.MemoryLimit = 11 * 1024 * 1024 * 1024 // 11 GB
+	cfg.Register(flags)
+	limits.Register(flags)
+	if err := config.Parse(flags, args); err != nil {
+		return err
 	}
-	log.Printf("NOFILE limit: %v", rLimit.Max)
-	rLimit.Cur = rLimit.Max
-	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+	if err := cfg.Setup(); err != nil {
+		return err
 	}
 
-        // Enable pprof hooks
-	go func() {
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
-			log.Fatalf("Pprof failed: %v", err)
-		}
-	}()
+	// Increase resources limitations, and admit as many connections as
+	// they allow, except for the load generators
+	var quota *admission.Quota
+	var err error
+	admit, quota, err = limits.Admission()
+	if err != nil {
+		return err
+	}
+	http.Handle("/debug/clients", quota)
+	registerMetrics()
+	http.Handle("/metrics", metrics.Default)
 
+	// Enable pprof hooks
+	cfg.ServePprof()
+
+	// Serve until a signal asks to stop
 	http.HandleFunc("/", ws)
-	if err := http.ListenAndServe(":8000", nil); err != nil {
-		log.Fatal(err)
+	web := &http.Server{Addr: cfg.Listen}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- web.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-shutdown.Notify():
+		log.Printf("Received %v, draining %v connections", sig, registry.Len())
 	}
-}
 
-// SetMemoryLimit sets a limit on the maximum memory usage of the Go program.
-// The limit is specified in bytes. Returns the previous limit.
-func SetMemoryLimit(limit int64) int64 {
-	// Estimate the current limit based on total memory and the current GC target percentage.
-	memStats := &runtime.MemStats{}
-	runtime.ReadMemStats(memStats)
-	previousLimit := int64(memStats.HeapAlloc) * 100 / int64(debug.SetGCPercent(-1))
-
-	// Calculate the new GC target percentage based on the desired memory limit.
-	// If the limit is zero, reset to default GC behavior.
-	if limit > 0 {
-		newGCTarget := int(int64(100*memStats.HeapAlloc) / limit)
-		debug.SetGCPercent(newGCTarget)
-	} else {
-		debug.SetGCPercent(100) // Reset to default
+	// Stop accepting and close every connection with 1001 Going Away
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown.DefaultTimeout)
+	defer cancel()
+	web.Shutdown(ctx)
+	if err := registry.Drain(ctx, shutdown.DefaultRate); err != nil {
+		log.Printf("Failed to drain connections: %v", err)
 	}
-
-	// Return the previous limit for reference.
-	return previousLimit
+	log.Printf("Shut down, rejected: %v", admit.Rejected())
+	return nil
 }
@@ -0,0 +1,77 @@
+package epollgorilla
+
+import (
+	"github.com/eranyanay/1m-go-websockets/admin"
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"time"
+)
+
+// adminSource exposes the connections table to the admin API, served on
+// localhost:6060/debug/conns/.
+type adminSource struct{}
+
+func (adminSource) Conns(after uint64, limit int) []admin.Conn {
+	entries := connections.after(after, limit)
+	infos := make([]admin.Conn, len(entries))
+	for i, entry := range entries {
+		infos[i] = info(entry)
+	}
+	return infos
+}
+
+func (adminSource) Conn(id uint64) (admin.Conn, bool) {
+	entry := lookupID(id)
+	if entry == nil {
+		return admin.Conn{}, false
+	}
+	in := info(entry)
+	q := entry.out
+	q.mu.Lock()
+	in.Details = map[string]interface{}{
+		"queued_frames": len(q.frames),
+		"closing":       q.closing,
+		"delayed":       q.delayed != 0,
+	}
+	q.mu.Unlock()
+	return in, true
+}
+
+func (adminSource) Close(id uint64, code int, reason string) error {
+	entry := lookupID(id)
+	if entry == nil {
+		return admin.ErrNotFound
+	}
+	return entry.e.Kick(entry, code, reason)
+}
+
+func (adminSource) Send(id uint64, binary bool, msg []byte) error {
+	entry := lookupID(id)
+	if entry == nil {
+		return admin.ErrNotFound
+	}
+	messageType := websocket.TextMessage
+	if binary {
+		messageType = websocket.BinaryMessage
+	}
+	return entry.e.Send(entry, encodeFrame(messageType, msg))
+}
+
+// lookupID returns the entry identified by id in the admin API, or nil.
+func lookupID(id uint64) *connEntry {
+	return connections.get(int(id>>32), uint32(id))
+}
+
+// info returns the counters of entry.
+func info(entry *connEntry) admin.Conn {
+	return admin.Conn{
+		ID:          entry.id(),
+		Remote:      entry.conn.RemoteAddr().String(),
+		Connected:   entry.since,
+		LastActive:  time.Unix(0, atomic.LoadInt64(&entry.stats.active)),
+		MessagesIn:  atomic.LoadInt64(&entry.stats.messagesIn),
+		BytesIn:     atomic.LoadInt64(&entry.stats.bytesIn),
+		MessagesOut: atomic.LoadInt64(&entry.stats.messagesOut),
+		BytesOut:    atomic.LoadInt64(&entry.stats.bytesOut),
+	}
+}
@@ -1,82 +1,569 @@
-package main
+package epollgorilla
 
 import (
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/eranyanay/1m-go-websockets/poller"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/eranyanay/1m-go-websockets/wheel"
 	"github.com/gorilla/websocket"
-	"golang.org/x/sys/unix"
 	"log"
-	"reflect"
-	"sync"
-	"syscall"
+	"sync/atomic"
+	"time"
 )
 
+// defaultQueueLimit is the number of frames that may be queued for a
+// connection whose socket is not writable.
+const defaultQueueLimit = 64
+
+// lingerRetry is how long closing a lingering connection is put off while
+// a worker is reading it.
+const lingerRetry = 10 * time.Millisecond
+
+// total is the number of connections registered across all epoll instances.
+var total int64
+
+// rateLimited is the number of messages that exceeded the rate limit.
+var rateLimited int64
+
+var (
+	rateLimitedFrame = encodeFrame(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "rate limit exceeded"))
+	pingFrame        = encodeFrame(websocket.PingMessage, nil)
+)
+
+// epoll is a single event loop. Readiness is reported by a poller.Poller,
+// epoll(7) unless another backend is chosen. Connections are looked up in
+// the connections table shared by all instances, and then passed around as
+// their entry.
 type epoll struct {
-	fd          int
-	connections map[int]*websocket.Conn
-	lock        *sync.RWMutex
+	poller     poller.Poller
+	events     uint32
+	waitEvents []poller.Event
+	queueLimit int
+	wheel      *wheel.Wheel
+	size       int64
+	// rate is the rate limit, nil if connections are not limited, and
+	// delayed holds the connections not read until they are due.
+	rate    *ratelimit.Limiter
+	delayed ratelimit.Queue
 }
 
-func MkEpoll() (*epoll, error) {
-	fd, err := unix.EpollCreate1(0)
+// MkEpoll creates an event loop polling with the named backend. In
+// oneshot mode descriptors are edge-triggered and one-shot: a connection
+// is reported by Wait at most once until it is re-armed with Resume, so it
+// can be handed to a worker without another worker picking it up
+// concurrently.
+func MkEpoll(backend string, oneshot bool) (*epoll, error) {
+	events := uint32(poller.In | poller.RdHup)
+	if oneshot {
+		events |= poller.Edge | poller.OneShot
+	}
+	p, err := poller.New(backend)
 	if err != nil {
 		return nil, err
 	}
 	return &epoll{
-		fd:          fd,
-		lock:        &sync.RWMutex{},
-		connections: make(map[int]*websocket.Conn),
+		poller:     p,
+		events:     events,
+		waitEvents: make([]poller.Event, 100),
+		queueLimit: defaultQueueLimit,
 	}, nil
 }
 
-func (e *epoll) Add(conn *websocket.Conn) error {
-	fd := websocketFD(conn)
-	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.POLLIN | unix.POLLHUP, Fd: int32(fd)})
+// Add registers conn and returns its entry, through which it is served
+// from then on.
+func (e *epoll) Add(conn *websocket.Conn) (*connEntry, error) {
+	// Extract file descriptor associated with the connection
+	fd, err := websocketFD(conn)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	e.lock.Lock()
-	defer e.lock.Unlock()
-	e.connections[fd] = conn
-	if len(e.connections)%100 == 0 {
-		log.Printf("Total number of connections: %v", len(e.connections))
+	// Set up the connection and store it before polling it, so that its
+	// first event finds it ready to be read.
+	entry := connections.put(fd, conn, e)
+	if peer, ok := conn.UnderlyingConn().(*peerConn); ok {
+		peer.frame(fd)
+		entry.peer = peer
 	}
-	return nil
+	// Answer close frames and pings through the outbound queue rather
+	// than with a blocking write, and not at all once a close frame was
+	// sent. A pong answers the ping of an idle connection.
+	conn.SetCloseHandler(func(code int, text string) error {
+		e.Send(entry, encodeFrame(websocket.CloseMessage, websocket.FormatCloseMessage(code, "")))
+		return nil
+	})
+	conn.SetPingHandler(func(data string) error {
+		e.Send(entry, encodeFrame(websocket.PongMessage, []byte(data)))
+		return nil
+	})
+	conn.SetPongHandler(func(string) error {
+		e.Touch(entry)
+		return nil
+	})
+	if e.wheel != nil {
+		e.wheel.Add(fd)
+	}
+	atomic.AddInt64(&e.size, 1)
+	atomic.AddInt64(&total, 1)
+	if err := e.poller.Add(fd, entry.gen, e.events); err != nil {
+		connections.remove(entry)
+		if e.wheel != nil {
+			e.wheel.Remove(fd)
+		}
+		atomic.AddInt64(&e.size, -1)
+		atomic.AddInt64(&total, -1)
+		return nil, err
+	}
+	upgrades.Inc()
+	return entry, nil
 }
 
-func (e *epoll) Remove(conn *websocket.Conn) error {
-	fd := websocketFD(conn)
-	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_DEL, fd, nil)
-	if err != nil {
+// Remove unregisters entry. Only the first call succeeds, the others
+// return errNotRegistered.
+func (e *epoll) Remove(entry *connEntry) error {
+	if !connections.remove(entry) {
+		return errNotRegistered
+	}
+	q := entry.out
+	q.mu.Lock()
+	q.removed = true
+	q.frames = nil
+	q.mu.Unlock()
+	if e.wheel != nil {
+		e.wheel.Remove(entry.fd)
+	}
+	atomic.AddInt64(&e.size, -1)
+	atomic.AddInt64(&total, -1)
+	return e.poller.Remove(entry.fd)
+}
+
+// Touch records activity on entry.
+func (e *epoll) Touch(entry *connEntry) {
+	if e.wheel != nil {
+		e.wheel.Touch(entry.fd)
+	}
+}
+
+// Expire advances the timing wheel to now. It returns the connections
+// that have been idle long enough to be pinged, and the ones that did not
+// answer a ping in time and have to be closed. A one-shot connection held
+// by a worker is being read, so it is tracked again instead of closed.
+func (e *epoll) Expire(now time.Time) (ping, expired []*connEntry) {
+	if e.wheel == nil {
+		return nil, nil
+	}
+	pingFDs, fds := e.wheel.Advance(now)
+	for _, fd := range pingFDs {
+		if entry := connections.lookup(fd); entry != nil && entry.e == e {
+			ping = append(ping, entry)
+		}
+	}
+	for _, fd := range fds {
+		entry := connections.lookup(fd)
+		if entry == nil {
+			continue
+		}
+		q := entry.out
+		q.mu.Lock()
+		switch {
+		case q.removed:
+		case e.oneshot() && q.busy:
+			// Remove takes q.mu before forgetting fd, so it cannot
+			// miss the entry added back.
+			e.wheel.Add(fd)
+		default:
+			expired = append(expired, entry)
+		}
+		q.mu.Unlock()
+	}
+	return ping, expired
+}
+
+// Admit applies the rate limit to a message of size bytes read from entry.
+// It returns false if the message is dropped, which with the close policy
+// sends entry a close frame, after which its messages are dropped until it
+// is closed. With the delay policy, a connection exceeding the limit is not
+// read until its bucket refills.
+func (e *epoll) Admit(entry *connEntry, size int) (bool, error) {
+	if e.rate == nil {
+		return true, nil
+	}
+	now := time.Now()
+	ok, limited := e.rate.Admit(&entry.rate, now, size)
+	if limited {
+		atomic.AddInt64(&rateLimited, 1)
+	}
+	switch {
+	case e.rate.Policy == ratelimit.Delay:
+		if d := e.rate.Wait(&entry.rate, now); d > 0 {
+			return true, e.delay(entry, now.Add(d))
+		}
+	case !ok && e.rate.Policy == ratelimit.Close:
+		return false, e.linger(entry, rateLimitedFrame, errRateLimited, now)
+	}
+	return ok, nil
+}
+
+// lingering is an entry of the delayed queue closing a connection that
+// was sent a close frame by the server.
+type lingering struct {
+	entry *connEntry
+}
+
+// Kick sends entry a close frame with code and reason, and closes it once
+// the peer answers or closes.Linger has passed.
+func (e *epoll) Kick(entry *connEntry, code int, reason string) error {
+	frame := encodeFrame(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason))
+	return e.linger(entry, frame, errKicked, time.Now())
+}
+
+// linger queues the close frame of a connection the server closes with
+// err, and has it closed once closes.Linger has passed after now.
+func (e *epoll) linger(entry *connEntry, frame []byte, err error, now time.Time) error {
+	q := entry.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.removed {
+		return errNotRegistered
+	}
+	if q.closing {
+		return nil
+	}
+	q.closing = true
+	q.failed = err
+	e.delayed.Push(lingering{entry}, now.Add(closes.Linger))
+	return e.send(entry, frame)
+}
+
+// expire closes the connection of l, unless it was closed already. A
+// one-shot connection held by a worker is closed once it is back, so that
+// it is not closed while being read.
+func (e *epoll) expire(l lingering, now time.Time) {
+	entry := l.entry
+	if !connections.registered(entry) {
+		return
+	}
+	entry.out.mu.Lock()
+	busy := e.oneshot() && entry.out.busy
+	failed := entry.out.failed
+	entry.out.mu.Unlock()
+	if busy {
+		e.delayed.Push(l, now.Add(lingerRetry))
+		return
+	}
+	closeConn(entry, reasonOf(failed), failed)
+}
+
+// Failure returns the error entry lingers with since the server sent it a
+// close frame, or nil.
+func (e *epoll) Failure(entry *connEntry) error {
+	entry.out.mu.Lock()
+	defer entry.out.mu.Unlock()
+	return entry.out.failed
+}
+
+// Received records a message of size bytes read from entry, and reports
+// whether it is to be handled: the messages of a lingering connection are
+// dropped.
+func (e *epoll) Received(entry *connEntry, size int) bool {
+	atomic.AddInt64(&entry.stats.messagesIn, 1)
+	atomic.AddInt64(&entry.stats.bytesIn, int64(size))
+	atomic.StoreInt64(&entry.stats.active, time.Now().UnixNano())
+	entry.out.mu.Lock()
+	defer entry.out.mu.Unlock()
+	return entry.out.failed == nil
+}
+
+// delay drops the EPOLLIN interest of entry until due.
+func (e *epoll) delay(entry *connEntry, due time.Time) error {
+	q := entry.out
+	q.mu.Lock()
+	q.delayed = due.UnixNano()
+	var err error
+	if !e.oneshot() {
+		err = e.arm(entry)
+	}
+	q.mu.Unlock()
+	e.delayed.Push(entry, due)
+	return err
+}
+
+// Undelay restores the EPOLLIN interest of the delayed connections that
+// are due at now, and closes the lingering ones.
+func (e *epoll) Undelay(now time.Time) {
+	for _, v := range e.delayed.Pop(now) {
+		if l, ok := v.(lingering); ok {
+			e.expire(l, now)
+			continue
+		}
+		entry := v.(*connEntry)
+		if !connections.registered(entry) {
+			continue
+		}
+		q := entry.out
+		q.mu.Lock()
+		// A connection delayed again since is left to its later entry.
+		if q.delayed == 0 || q.delayed > now.UnixNano() {
+			q.mu.Unlock()
+			continue
+		}
+		q.delayed = 0
+		var err error
+		if !e.oneshot() || !q.busy {
+			err = e.arm(entry)
+		}
+		q.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to re-arm %v", err)
+		}
+	}
+}
+
+// Resume re-arms a connection reported by a one-shot epoll instance.
+func (e *epoll) Resume(entry *connEntry) error {
+	q := entry.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.removed {
+		return errNotRegistered
+	}
+	q.busy = false
+	return e.arm(entry)
+}
+
+// Send queues an encoded frame for entry and writes as much as the socket
+// accepts right away. The rest is written by Wait once EPOLLOUT fires.
+// Send never blocks; errQueueFull is returned when the peer is too slow to
+// keep up.
+func (e *epoll) Send(entry *connEntry, frame []byte) error {
+	q := entry.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.removed {
+		return errNotRegistered
+	}
+	if q.closing {
+		return errCloseSent
+	}
+	return e.send(entry, frame)
+}
+
+// GoAway queues a 1001 Going Away close frame for entry, after which Send
+// rejects frames. The connection is removed once the peer answers.
+func (e *epoll) GoAway(entry *connEntry) error {
+	q := entry.out
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.removed {
+		return errNotRegistered
+	}
+	if q.closing {
+		return nil
+	}
+	q.closing = true
+	return e.send(entry, goingAwayFrame)
+}
+
+// send queues frame for entry and flushes the queue. entry.out.mu must be
+// held.
+func (e *epoll) send(entry *connEntry, frame []byte) error {
+	q := entry.out
+	if len(q.frames) >= e.queueLimit {
+		return errQueueFull
+	}
+	q.frames = append(q.frames, frame)
+	messagesOut.Inc()
+	bytesOut.Add(len(frame))
+	atomic.AddInt64(&entry.stats.messagesOut, 1)
+	atomic.AddInt64(&entry.stats.bytesOut, int64(len(frame)))
+	if q.polling {
+		return nil
+	}
+	if err := q.flush(); err != nil {
 		return err
 	}
-	e.lock.Lock()
-	defer e.lock.Unlock()
-	delete(e.connections, fd)
-	if len(e.connections)%100 == 0 {
-		log.Printf("Total number of connections: %v", len(e.connections))
+	if len(q.frames) > 0 {
+		q.polling = true
+		if !q.busy {
+			return e.arm(entry)
+		}
 	}
 	return nil
 }
 
-func (e *epoll) Wait() ([]*websocket.Conn, error) {
-	events := make([]unix.EpollEvent, 100)
-	n, err := unix.EpollWait(e.fd, events, 100)
+// arm sets the interest of entry's fd, adding EPOLLOUT while frames are
+// queued and dropping EPOLLIN while it is delayed. entry.out.mu must be
+// held. The fd of a removed entry may belong to another connection already,
+// so it is left alone.
+func (e *epoll) arm(entry *connEntry) error {
+	q := entry.out
+	if q.removed {
+		return errNotRegistered
+	}
+	events := e.events
+	if q.polling {
+		events |= poller.Out
+	}
+	if q.delayed != 0 {
+		events &^= poller.In
+	}
+	return e.poller.Modify(entry.fd, entry.gen, events)
+}
+
+func (e *epoll) oneshot() bool {
+	return e.events&poller.OneShot != 0
+}
+
+// readyConn is a connection reported by Wait, with the poller events it
+// was reported for.
+type readyConn struct {
+	entry  *connEntry
+	events uint32
+}
+
+// Wait returns the connections that are readable, were shut down by the
+// peer or failed. Queued frames of writable connections are flushed on
+// the way and a connection failing to write is reported as well, with
+// poller.Err set, so that it gets removed.
+func (e *epoll) Wait() ([]readyConn, error) {
+	events := e.waitEvents
+	timeout := 100 * time.Millisecond
+	if due, ok := e.delayed.Next(); ok {
+		if d := time.Until(due); d < timeout {
+			timeout = d
+		}
+		if timeout < 0 {
+			timeout = 0
+		}
+	}
+	n, err := e.poller.Wait(events, timeout)
 	if err != nil {
 		return nil, err
 	}
-	e.lock.RLock()
-	defer e.lock.RUnlock()
-	var connections []*websocket.Conn
+	var ready []readyConn
+	for i := 0; i < n; i++ {
+		entry := connections.get(events[i].Fd, events[i].Gen)
+		if entry == nil {
+			// The connection was removed after the event was reported.
+			continue
+		}
+		flags := events[i].Events
+		isReady := flags&(poller.In|poller.RdHup|poller.Hup|poller.Err) != 0
+		writable := flags&poller.Out != 0
+		q := entry.out
+		if writable || e.oneshot() {
+			q.mu.Lock()
+			if writable {
+				if err := q.flush(); err != nil {
+					flags |= poller.Err
+					isReady = true
+				} else if len(q.frames) == 0 {
+					q.polling = false
+				}
+			}
+			var err error
+			switch {
+			case !e.oneshot():
+				if !q.polling {
+					err = e.arm(entry)
+				}
+			case q.busy:
+				// Send re-armed the connection while a worker still holds
+				// it. Leave it disarmed, the worker resumes it.
+				isReady = false
+			case isReady:
+				// The connection stays disarmed until its worker resumes it.
+				q.busy = true
+			default:
+				err = e.arm(entry)
+			}
+			if err != nil {
+				log.Printf("Failed to re-arm %v", err)
+			}
+			q.mu.Unlock()
+		}
+		if isReady {
+			ready = append(ready, readyConn{entry, flags})
+		}
+	}
+	return ready, nil
+}
+
+// epollGroup shards connections over several epoll instances, each meant
+// to be served by its own event loop. They share the connections table,
+// whose lookups take no lock.
+type epollGroup struct {
+	loops []*epoll
+}
+
+// epollOptions configures the epoll instances of a group.
+type epollOptions struct {
+	// Backend is the name of the poller.Poller backend, epoll if empty.
+	Backend string
+	// OneShot selects edge-triggered, one-shot instances.
+	OneShot bool
+	// QueueLimit is the number of outbound frames that may be queued per
+	// connection, defaultQueueLimit if zero.
+	QueueLimit int
+	// Idle is the inactivity after which a connection is pinged, and
+	// PongWait how long it has to answer before it is closed. A zero Idle
+	// disables heartbeats, a zero PongWait closes idle connections without
+	// pinging them.
+	Idle     time.Duration
+	PongWait time.Duration
+	// RateLimit limits the messages and bytes each connection may send.
+	RateLimit ratelimit.Limiter
+}
+
+// MkEpollGroup creates n epoll instances configured by opts.
+func MkEpollGroup(n int, opts epollOptions) (*epollGroup, error) {
+	if n < 1 {
+		n = 1
+	}
+	g := &epollGroup{}
 	for i := 0; i < n; i++ {
-		conn := e.connections[int(events[i].Fd)]
-		connections = append(connections, conn)
+		backend := opts.Backend
+		if backend == "" {
+			backend = "epoll"
+		}
+		e, err := MkEpoll(backend, opts.OneShot)
+		if err != nil {
+			g.Close()
+			return nil, err
+		}
+		if opts.QueueLimit > 0 {
+			e.queueLimit = opts.QueueLimit
+		}
+		if opts.Idle > 0 {
+			e.wheel = wheel.New(opts.Idle, opts.PongWait)
+		}
+		if opts.RateLimit.Enabled() {
+			e.rate = &opts.RateLimit
+		}
+		g.loops = append(g.loops, e)
+	}
+	return g, nil
+}
+
+// Add registers conn with the least loaded epoll instance, which its entry
+// refers to.
+func (g *epollGroup) Add(conn *websocket.Conn) (*connEntry, error) {
+	least := g.loops[0]
+	for _, e := range g.loops[1:] {
+		if atomic.LoadInt64(&e.size) < atomic.LoadInt64(&least.size) {
+			least = e
+		}
+	}
+	return least.Add(conn)
+}
+
+func (g *epollGroup) Close() {
+	for _, e := range g.loops {
+		e.poller.Close()
 	}
-	return connections, nil
 }
 
-func websocketFD(conn *websocket.Conn) int {
-	connVal := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn").Elem()
-	tcpConn := reflect.Indirect(connVal).FieldByName("conn")
-	fdVal := tcpConn.FieldByName("fd")
-	pfdVal := reflect.Indirect(fdVal).FieldByName("pfd")
-	return int(pfdVal.FieldByName("Sysfd").Int())
+// websocketFD extracts the file descriptor of the socket underlying a
+// gorilla websocket connection.
+func websocketFD(conn *websocket.Conn) (int, error) {
+	return poller.SocketFD(conn.UnderlyingConn())
 }
@@ -0,0 +1,42 @@
+package epollgorilla
+
+import (
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"sync/atomic"
+)
+
+// The metrics served on localhost:6060/metrics, registered by
+// registerMetrics.
+var (
+	upgrades    *metrics.Counter
+	messagesIn  *metrics.Counter
+	bytesIn     *metrics.Counter
+	messagesOut *metrics.Counter
+	bytesOut    *metrics.Counter
+	pollEvents  *metrics.Histogram
+	loopSeconds *metrics.Histogram
+)
+
+// registerMetrics adds the metrics of the server to metrics.Default. The
+// counters kept for logging are read when scraped.
+func registerMetrics() {
+	set := metrics.Default
+	load := func(v *int64) func() float64 {
+		return func() float64 {
+			return float64(atomic.LoadInt64(v))
+		}
+	}
+	set.NewGaugeFunc("ws_connections", "Connections currently registered.", load(&total))
+	upgrades = set.NewCounter("ws_upgrades_total", "Connections registered since the server started.")
+	counts.Register(set)
+	set.NewCounterFunc("ws_rate_limited_total", "Messages that exceeded the rate limit.", load(&rateLimited))
+	set.NewCounterFunc("ws_rejected_total", "Upgrades rejected by the connection limit or the client quotas.", func() float64 {
+		return float64(admit.Rejected())
+	})
+	messagesIn = set.NewCounter("ws_messages_received_total", "Data messages received.")
+	bytesIn = set.NewCounter("ws_received_bytes_total", "Payload bytes of the data messages received.")
+	messagesOut = set.NewCounter("ws_messages_sent_total", "Frames queued, control frames included.")
+	bytesOut = set.NewCounter("ws_sent_bytes_total", "Bytes of frames queued.")
+	pollEvents = set.NewHistogram("ws_poll_events", "Connections reported ready by a wait of an event loop.", []float64{0, 1, 2, 5, 10, 20, 50, 100})
+	loopSeconds = set.NewHistogram("ws_loop_seconds", "Time an event loop takes to handle the connections reported by a wait.", metrics.ExponentialBuckets(1e-5, 4, 9))
+}
@@ -0,0 +1,53 @@
+package epollgorilla
+
+import (
+	"errors"
+	"github.com/eranyanay/1m-go-websockets/poller"
+	"sync"
+)
+
+var (
+	errQueueFull     = errors.New("epoll: outbound queue is full")
+	errNotRegistered = errors.New("epoll: connection is not registered")
+	errCloseSent     = errors.New("epoll: close frame already sent")
+	errRateLimited   = errors.New("epoll: rate limit exceeded")
+	errKicked        = errors.New("epoll: connection kicked")
+)
+
+// outbound is the queue of encoded frames waiting to be written to a
+// connection. Frames are written straight to the non-blocking socket and
+// whatever does not fit stays queued until EPOLLOUT reports the socket as
+// writable again.
+type outbound struct {
+	mu     sync.Mutex
+	fd     int
+	frames [][]byte
+	// polling is set while EPOLLOUT interest is registered for fd.
+	polling bool
+	// removed is set once the connection is unregistered, after which fd
+	// may be closed and reused and must not be written to.
+	removed bool
+	// busy is set while a one-shot connection is handed to a worker and
+	// disarmed, so its interest set must not be modified until Resume.
+	busy bool
+	// closing is set once a close frame was queued, after which no other
+	// frame may be sent.
+	closing bool
+	// failed is set once the server queued a close frame, with
+	// errRateLimited or errKicked. The connection lingers until the peer
+	// answers it or closes.Linger has passed, and its messages are dropped
+	// meanwhile.
+	failed error
+	// delayed is the time, in Unix nanoseconds, until which EPOLLIN
+	// interest is dropped because the connection exceeded the rate limit,
+	// or zero.
+	delayed int64
+}
+
+// flush writes queued frames until the queue is empty or the socket buffer
+// is full.
+func (q *outbound) flush() error {
+	var err error
+	q.frames, err = poller.Flush(q.fd, q.frames)
+	return err
+}
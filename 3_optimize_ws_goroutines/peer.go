@@ -0,0 +1,171 @@
+package epollgorilla
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+)
+
+// errWouldBlock reports that a connection has nothing left to read but
+// control frames, which have been handled. It is raised as a panic by
+// peerConn, since gorilla keeps any read error for good, and recovered by
+// readMessage.
+var errWouldBlock = errors.New("read would block")
+
+// maxHeaderLen is the length of the largest frame header: two bytes, an
+// extended payload length of eight and a mask of four.
+const maxHeaderLen = 14
+
+// listener wraps the connections it accepts in a peerConn, which the
+// upgrader hands to gorilla.
+type listener struct {
+	net.Listener
+}
+
+func (l listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &peerConn{Conn: c}, nil
+}
+
+// peerConn is the connection gorilla reads frames from. Once framed, it
+// follows the frames going through and never returns bytes past the end of
+// the current one, so that gorilla only reads past a frame once it is done
+// with it. A read at a frame boundary outside a message that would block
+// panics with errWouldBlock instead: gorilla reads control frames inside
+// NextReader, which would otherwise wait for the next data frame of a peer
+// that only answered a ping.
+//
+// peerConn is only used by the goroutine reading the connection.
+type peerConn struct {
+	net.Conn
+	fd     int
+	framed bool
+	// message is set while the fragments of a message are read, which
+	// may be interleaved with control frames.
+	message bool
+	// left is the number of bytes of the current frame not read yet, and
+	// head the bytes of its header read so far while its length is not
+	// known.
+	left  int64
+	head  [maxHeaderLen]byte
+	headN int
+}
+
+// NetConn returns the wrapped connection, for poller.SocketFD.
+func (c *peerConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// frame starts following the frames read from c, whose fd is fd. Nothing
+// must have been read past the handshake.
+func (c *peerConn) frame(fd int) {
+	c.fd = fd
+	c.framed = true
+}
+
+func (c *peerConn) Read(p []byte) (int, error) {
+	if !c.framed {
+		return c.Conn.Read(p)
+	}
+	if c.left == 0 && c.headN == 0 {
+		// Between frames: look at the header of the next one, to read
+		// it along with its payload.
+		var b [maxHeaderLen]byte
+		n, _, err := unix.Recvfrom(c.fd, b[:], unix.MSG_PEEK|unix.MSG_DONTWAIT)
+		if err == unix.EAGAIN && !c.message {
+			panic(errWouldBlock)
+		}
+		if n >= 2 && n >= headerLen(b[:n]) {
+			c.left = frameLen(b[:n])
+		}
+	}
+	if c.left == 0 {
+		// The header did not arrive whole, read what is missing of it
+		// only.
+		h := c.head[:c.headN]
+		if need := headerLen(h) - len(h); len(p) > need {
+			p = p[:need]
+		}
+		n, err := c.Conn.Read(p)
+		c.headN += copy(c.head[c.headN:], p[:n])
+		if h = c.head[:c.headN]; len(h) == headerLen(h) {
+			c.left = frameLen(h) - int64(len(h))
+			c.headN = 0
+		}
+		return n, err
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.Conn.Read(p)
+	c.left -= int64(n)
+	return n, err
+}
+
+// headerLen returns the length of the frame header starting with h, which
+// is known once h holds its first two bytes.
+func headerLen(h []byte) int {
+	if len(h) < 2 {
+		return 2
+	}
+	n := 2
+	switch h[1] & 0x7f {
+	case 126:
+		n += 2
+	case 127:
+		n += 8
+	}
+	if h[1]&0x80 != 0 {
+		n += 4
+	}
+	return n
+}
+
+// frameLen returns the length of the frame whose whole header is h. A
+// length gorilla refuses anyway is capped, so that it does not overflow.
+func frameLen(h []byte) int64 {
+	var n uint64
+	switch l := h[1] & 0x7f; l {
+	case 126:
+		n = uint64(binary.BigEndian.Uint16(h[2:]))
+	case 127:
+		n = binary.BigEndian.Uint64(h[2:])
+	default:
+		n = uint64(l)
+	}
+	if n > 1<<62 {
+		n = 1 << 62
+	}
+	return int64(headerLen(h)) + int64(n)
+}
+
+// readMessage reads the next message of entry like ReadMessage, except
+// that it returns errWouldBlock once the control frames of entry are read
+// if no message follows them yet.
+func readMessage(entry *connEntry) (messageType int, p []byte, err error) {
+	peer := entry.peer
+	if peer == nil {
+		return entry.conn.ReadMessage()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			if v != errWouldBlock {
+				panic(v)
+			}
+			err = errWouldBlock
+		}
+	}()
+	messageType, r, err := entry.conn.NextReader()
+	if err != nil {
+		return messageType, nil, err
+	}
+	peer.message = true
+	p, err = ioutil.ReadAll(r)
+	peer.message = false
+	return messageType, p, err
+}
@@ -0,0 +1,74 @@
+package epollgorilla
+
+import (
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/gorilla/websocket"
+	"golang.org/x/sys/unix"
+	"io"
+	"log"
+	"net"
+	"strings"
+)
+
+// counts is the number of closed connections by reason and violation.
+var counts closes.Counts
+
+// reasonOf classifies the error a connection failed with. Gorilla reports
+// a peer that went away without a close frame as an abnormal closure, and
+// protocol violations as plain errors prefixed with "websocket:".
+func reasonOf(err error) closes.Reason {
+	switch err {
+	case errRateLimited:
+		return closes.RateLimit
+	case errKicked:
+		return closes.Kick
+	}
+	if ce, ok := err.(*websocket.CloseError); ok {
+		if ce.Code == websocket.CloseAbnormalClosure {
+			return closes.PeerGone
+		}
+		return closes.Peer
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return closes.PeerGone
+	}
+	if oe, ok := err.(*net.OpError); ok {
+		err = oe.Err
+	}
+	if se, ok := err.(interface{ Unwrap() error }); ok {
+		err = se.Unwrap()
+	}
+	if err == unix.ECONNRESET || err == unix.EPIPE {
+		return closes.Reset
+	}
+	if err != nil && strings.HasPrefix(err.Error(), "websocket:") {
+		return closes.ProtocolError
+	}
+	return closes.Error
+}
+
+// closeConn unregisters entry, closes it and accounts for reason.
+// err is the error the connection failed with, if any. Only the call that
+// unregisters entry accounts for it, so a connection closed concurrently
+// by a loop and a worker is counted once.
+func closeConn(entry *connEntry, reason closes.Reason, err error) {
+	conn := entry.conn
+	// The entry is out of the table even if the poller failed to forget it
+	if rerr := entry.e.Remove(entry); rerr != errNotRegistered {
+		if rerr != nil {
+			log.Printf("Failed to remove %v", rerr)
+		}
+		admit.Release(conn.RemoteAddr().String())
+		counts.Add(reason)
+		if v, ok := violationOf(err); ok {
+			counts.AddViolation(v)
+		}
+		switch reason {
+		case closes.Peer:
+			log.Printf("Closed %v: %v %v", conn.RemoteAddr(), reason, err.(*websocket.CloseError).Code)
+		case closes.ProtocolError, closes.Reset, closes.Error:
+			log.Printf("Closed %v: %v %v", conn.RemoteAddr(), reason, err)
+		}
+	}
+	conn.Close()
+}
@@ -1,81 +1,329 @@
-package main
+// Package epollgorilla is the server reading gorilla websocket connections
+// from epoll event loops instead of a goroutine each, run by 1mws
+// epoll-gorilla.
+package epollgorilla
 
 import (
+	"context"
+	"encoding/binary"
+	"github.com/eranyanay/1m-go-websockets/admin"
+	"github.com/eranyanay/1m-go-websockets/admission"
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/eranyanay/1m-go-websockets/config"
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"github.com/eranyanay/1m-go-websockets/poller"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/eranyanay/1m-go-websockets/shutdown"
 	"github.com/gorilla/websocket"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
-	"syscall"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
 )
 
-var epoller *epoll
+var (
+	flags  = config.NewFlagSet("epoll-gorilla")
+	cfg    = config.New()
+	limits = config.NewLimits()
+
+	oneshot = flags.Bool("oneshot", false, "use edge-triggered one-shot epoll and read ready connections on a worker pool")
+	workers = flags.Int("workers", runtime.NumCPU(), "number of workers reading connections in oneshot mode")
+	loops   = flags.Int("loops", runtime.GOMAXPROCS(0), "number of epoll event loops")
+	backend = flags.String("poller", "epoll", "readiness backend, one of "+strings.Join(poller.Backends, ", "))
+	queue   = flags.Int("queue", defaultQueueLimit, "maximum number of outbound frames queued per connection")
+	idle    = flags.Duration("idle", 2*time.Minute, "inactivity after which a connection is pinged, 0 disables heartbeats")
+	pong    = flags.Duration("pong", 10*time.Second, "time an idle connection has to answer a ping before it is closed")
+	maxSize = flags.Int64("max-message", 16<<20, "largest message accepted from clients, larger ones are answered with 1009 Message Too Big")
+
+	rateMessages = flags.Float64("rate-messages", 0, "messages per second each client may send, 0 disables the limit")
+	messageBurst = flags.Int("rate-message-burst", 0, "messages a client may send at once, a second worth if 0")
+	rateBytes    = flags.Float64("rate-bytes", 0, "payload bytes per second each client may send, 0 disables the limit")
+	byteBurst    = flags.Int("rate-byte-burst", 0, "payload bytes a client may send at once, a second worth if 0")
+	ratePolicy   = flags.String("rate-policy", "delay", "what exceeding the rate does: drop the message, delay reading the client, or close it with 1008")
+
+	drainRate    = flags.Int("drain-rate", shutdown.DefaultRate, "close frames sent per second on shutdown")
+	drainTimeout = flags.Duration("drain-timeout", shutdown.DefaultTimeout, "time given to peers to complete the closing handshake on shutdown")
+)
+
+var epoller *epollGroup
+
+// admit counts the registered connections, which closeConn releases.
+var admit *admission.Controller
 
 func wsHandler(w http.ResponseWriter, r *http.Request) {
-	// Upgrade connection
-	upgrader := websocket.Upgrader{}
+	if err := admit.Acquire(r.RemoteAddr); err != nil {
+		admit.Reject(w, err)
+		return
+	}
+
+	// Upgrade connection, reading it through a buffer of gorilla's rather
+	// than the one of the http server, so that peerConn can stop a read
+	upgrader := websocket.Upgrader{ReadBufferSize: 4096}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
+		admit.Release(r.RemoteAddr)
 		return
 	}
-	if err := epoller.Add(conn); err != nil {
+	conn.SetReadLimit(*maxSize)
+	if _, err := epoller.Add(conn); err != nil {
 		log.Printf("Failed to add connection")
+		admit.Release(r.RemoteAddr)
 		conn.Close()
 	}
 }
 
-func main() {
-	// Increase resources limitations
-	var rLimit syscall.Rlimit
-	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+// Main runs the server with the command line arguments args.
+func Main(args []string) error {
+	cfg.Register(flags)
+	limits.Register(flags)
+	if err := config.Parse(flags, args); err != nil {
+		return err
 	}
-	rLimit.Cur = rLimit.Max
-	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+	if err := cfg.Setup(); err != nil {
+		return err
 	}
 
+	// Increase resources limitations, and admit as many connections as
+	// they allow, except for the load generators
+	var quota *admission.Quota
+	var err error
+	admit, quota, err = limits.Admission()
+	if err != nil {
+		return err
+	}
+	http.Handle("/debug/clients", quota)
+	registerMetrics()
+	http.Handle("/metrics", metrics.Default)
+	http.Handle("/debug/conns/", http.StripPrefix("/debug/conns", admin.Handler(adminSource{})))
+
 	// Enable pprof hooks
-	go func() {
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
-			log.Fatalf("pprof failed: %v", err)
-		}
-	}()
+	cfg.ServePprof()
+
+	// Check the rate limit policy
+	policy, err := ratelimit.ParsePolicy(*ratePolicy)
+	if err != nil {
+		return err
+	}
 
 	// Start epoll
-	var err error
-	epoller, err = MkEpoll()
+	epoller, err = MkEpollGroup(*loops, epollOptions{
+		Backend:    *backend,
+		OneShot:    *oneshot,
+		QueueLimit: *queue,
+		Idle:       *idle,
+		PongWait:   *pong,
+		RateLimit: ratelimit.Limiter{
+			Messages:     *rateMessages,
+			MessageBurst: *messageBurst,
+			Bytes:        *rateBytes,
+			ByteBurst:    *byteBurst,
+			Policy:       policy,
+		},
+	})
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	go Start()
+	var jobs chan job
+	if *oneshot {
+		// The pool is bounded by the channel: when every worker is busy the
+		// loops stop waiting on epoll instead of queueing without limit.
+		jobs = make(chan job, *workers)
+		for i := 0; i < *workers; i++ {
+			go worker(jobs)
+		}
+	}
+	for _, e := range epoller.loops {
+		go Start(e, jobs)
+	}
 
+	// Serve until a signal asks to stop
 	http.HandleFunc("/", wsHandler)
-	if err := http.ListenAndServe(":8000", nil); err != nil {
-		log.Fatal(err)
+	ln, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	web := &http.Server{}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- web.Serve(listener{ln})
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-shutdown.Notify():
+		log.Printf("Received %v, draining %v connections", sig, atomic.LoadInt64(&total))
+	}
+
+	// Stop accepting and close every connection with 1001 Going Away
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	web.Shutdown(ctx)
+	if err := drain(ctx, *drainRate); err != nil {
+		log.Printf("Failed to drain connections: %v", err)
 	}
+	log.Printf("Shut down, closed by reason: %v, violations: %v, rate limited: %v, rejected: %v", counts.CloseSummary(), counts.ViolationSummary(), atomic.LoadInt64(&rateLimited), admit.Rejected())
+	return nil
 }
 
-func Start() {
+// job is a ready connection handed to a worker along with the epoll
+// instance it has to be resumed on.
+type job struct {
+	e *epoll
+	r readyConn
+}
+
+// Start runs the event loop of a single epoll instance. Ready connections
+// are read inline, or sent to jobs when running in oneshot mode. Idle
+// connections are pinged, and closed if they do not answer, between waits.
+func Start(e *epoll, jobs chan<- job) {
 	for {
-		connections, err := epoller.Wait()
+		connections, err := e.Wait()
+		now := time.Now()
+		pollEvents.Observe(float64(len(connections)))
+		ping, expired := e.Expire(now)
+		for _, entry := range ping {
+			e.Send(entry, pingFrame)
+		}
+		for _, entry := range expired {
+			closeConn(entry, closes.Timeout, nil)
+		}
+		e.Undelay(now)
 		if err != nil {
 			log.Printf("Failed to epoll wait %v", err)
 			continue
 		}
-		for _, conn := range connections {
-			if conn == nil {
-				break
-			}
-			_, msg, err := conn.ReadMessage()
-			if err != nil {
-				if err := epoller.Remove(conn); err != nil {
-					log.Printf("Failed to remove %v", err)
-				}
-				conn.Close()
-			} else {
-				log.Printf("msg: %s", string(msg))
+		for _, r := range connections {
+			if jobs != nil {
+				jobs <- job{e, r}
+				continue
 			}
+			handle(e, r)
 		}
+		loopSeconds.Observe(time.Since(now).Seconds())
+	}
+}
+
+// worker handles connections reported by a one-shot epoll. A connection is
+// not reported again until it is resumed, so messages of a single
+// connection are still read in order.
+func worker(jobs <-chan job) {
+	for j := range jobs {
+		if !handle(j.e, j.r) {
+			continue
+		}
+		if err := j.e.Resume(j.r.entry); err != nil {
+			log.Printf("Failed to resume %v", err)
+			closeConn(j.r.entry, closes.Error, err)
+		}
+	}
+}
+
+// handle reads a message from a ready connection. It returns false if the
+// connection was closed. A failed socket is closed with its pending error
+// instead of being read, and a connection that only sent control frames is
+// left to be read again once it is ready.
+func handle(e *epoll, r readyConn) bool {
+	entry := r.entry
+	// Whatever the peer sent counts as activity, control frames and
+	// dropped messages included.
+	e.Touch(entry)
+	if r.events&poller.Err != 0 {
+		err := poller.SocketError(entry.fd)
+		closeConn(entry, reasonOf(err), err)
+		return false
+	}
+	mt, msg, err := readMessage(entry)
+	if err == errWouldBlock {
+		return true
+	}
+	if err != nil {
+		reason := reasonOf(err)
+		if ferr := e.Failure(entry); ferr != nil {
+			reason, err = reasonOf(ferr), ferr
+		}
+		closeConn(entry, reason, err)
+		return false
+	}
+	if mt == websocket.TextMessage && !utf8.Valid(msg) {
+		e.Send(entry, invalidUTF8Frame)
+		closeConn(entry, closes.ProtocolError, errInvalidUTF8)
+		return false
+	}
+	messagesIn.Inc()
+	bytesIn.Add(len(msg))
+	if !e.Received(entry, len(msg)) {
+		return true
+	}
+	ok, err := e.Admit(entry, len(msg))
+	if err != nil {
+		log.Printf("Failed to rate limit %v", err)
+	}
+	if !ok {
+		return true
+	}
+	cfg.Messagef("msg: %s", string(msg))
+
+	receivedTime := time.Now()
+	err = e.Send(entry, textFrame([]byte(receivedTime.Format(time.RFC3339Nano))))
+	if err != nil && err != errCloseSent {
+		log.Printf("Failed to send %v", err)
+	}
+	return true
+}
+
+var (
+	goingAwayFrame   = encodeFrame(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down"))
+	invalidUTF8Frame = encodeFrame(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseInvalidFramePayloadData, errInvalidUTF8.Error()))
+)
+
+// textFrame encodes p as a single unmasked server-to-client text frame, so
+// it can be queued on the epoll instead of written through the blocking
+// websocket.Conn.
+func textFrame(p []byte) []byte {
+	return encodeFrame(websocket.TextMessage, p)
+}
+
+// encodeFrame encodes p as a single unmasked server-to-client frame of
+// type messageType.
+func encodeFrame(messageType int, p []byte) []byte {
+	b0 := 0x80 | byte(messageType)
+	var header []byte
+	switch {
+	case len(p) < 126:
+		header = []byte{b0, byte(len(p))}
+	case len(p) <= 0xffff:
+		header = []byte{b0, 126, 0, 0}
+		binary.BigEndian.PutUint16(header[2:], uint16(len(p)))
+	default:
+		header = []byte{b0, 127, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(header[2:], uint64(len(p)))
+	}
+	return append(header, p...)
+}
+
+// drain sends a 1001 Going Away close frame to every connection, rate per
+// second, and waits for the peers to answer until ctx is done. The
+// connections left are then closed.
+func drain(ctx context.Context, rate int) error {
+	entries := connections.all()
+	err := shutdown.Pace(ctx, len(entries), rate, func(i int) {
+		entry := entries[i]
+		if err := entry.e.GoAway(entry); err != nil && err != errNotRegistered {
+			closeConn(entry, closes.Error, err)
+		}
+	})
+	if err == nil {
+		err = shutdown.Wait(ctx, func() int {
+			return int(atomic.LoadInt64(&total))
+		})
+	}
+	for _, entry := range connections.all() {
+		closeConn(entry, closes.Kick, nil)
 	}
+	return err
 }
@@ -0,0 +1,118 @@
+package epollgorilla
+
+import (
+	"github.com/eranyanay/1m-go-websockets/fdtable"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/gorilla/websocket"
+	"time"
+)
+
+// connections is the table of connections registered with any of the
+// epoll instances.
+var connections connTable
+
+// connEntry is a registered connection along with its fd, outbound queue,
+// the epoll instance it is registered with and its rate limit bucket, which
+// is only used by the goroutine reading the connection. The fd is resolved
+// once when the connection is added, and the entry is passed around instead
+// of the connection so that it is not looked up again.
+type connEntry struct {
+	// stats is first in the struct to be 64-bit aligned for atomic
+	// access.
+	stats connStats
+	since time.Time
+
+	conn *websocket.Conn
+	// peer is the connection gorilla reads from, nil if it was not
+	// accepted by a listener, in which case reading blocks until a
+	// message arrives.
+	peer *peerConn
+	fd   int
+	gen  uint32
+	out  *outbound
+	e    *epoll
+	rate ratelimit.Bucket
+}
+
+// connStats counts the messages and bytes of a connection, and holds when
+// it was last heard from in Unix nanoseconds, as reported by the admin
+// API.
+type connStats struct {
+	messagesIn  int64
+	bytesIn     int64
+	messagesOut int64
+	bytesOut    int64
+	active      int64
+}
+
+// id returns the identifier of entry in the admin API: its fd in the upper
+// 32 bits and its generation in the lower ones, so that it is unique among
+// the registered connections and increases with the fd.
+func (entry *connEntry) id() uint64 {
+	return uint64(entry.fd)<<32 | uint64(entry.gen)
+}
+
+// connTable maps file descriptors to entries, which carry the generation
+// they were stored with. Lookups take no lock, so the epoll instances do
+// not contend on it.
+type connTable struct {
+	t fdtable.Table
+}
+
+// put stores conn, registered with e, under fd with the next generation.
+func (t *connTable) put(fd int, conn *websocket.Conn, e *epoll) *connEntry {
+	now := time.Now()
+	entry := &connEntry{since: now, conn: conn, fd: fd, gen: t.t.Next(), out: &outbound{fd: fd}, e: e}
+	entry.stats.active = now.UnixNano()
+	t.t.Put(fd, entry.gen, entry)
+	return entry
+}
+
+// get returns the entry registered as fd with generation gen, or nil if
+// the event it was reported for is stale.
+func (t *connTable) get(fd int, gen uint32) *connEntry {
+	entry, _ := t.t.Get(fd, gen).(*connEntry)
+	return entry
+}
+
+// lookup returns the entry registered as fd, whatever its generation.
+func (t *connTable) lookup(fd int) *connEntry {
+	v, _ := t.t.Lookup(fd)
+	entry, _ := v.(*connEntry)
+	return entry
+}
+
+// registered reports whether entry was not removed.
+func (t *connTable) registered(entry *connEntry) bool {
+	return t.get(entry.fd, entry.gen) == entry
+}
+
+// remove clears the slot of entry unless it was already taken by another
+// connection, and reports whether it did.
+func (t *connTable) remove(entry *connEntry) bool {
+	return t.t.Remove(entry.fd, entry.gen)
+}
+
+// all returns the registered entries.
+func (t *connTable) all() []*connEntry {
+	var entries []*connEntry
+	t.t.Range(0, func(fd int, gen uint32, v interface{}) bool {
+		entries = append(entries, v.(*connEntry))
+		return true
+	})
+	return entries
+}
+
+// after returns up to limit entries, by increasing ID, whose ID is greater
+// than id. Since IDs start with the fd, this only visits the slots from
+// the fd of id on.
+func (t *connTable) after(id uint64, limit int) []*connEntry {
+	var entries []*connEntry
+	t.t.Range(int(id>>32), func(fd int, gen uint32, v interface{}) bool {
+		if entry := v.(*connEntry); entry.id() > id {
+			entries = append(entries, entry)
+		}
+		return len(entries) < limit
+	})
+	return entries
+}
@@ -0,0 +1,46 @@
+package epollgorilla
+
+import (
+	"errors"
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/gorilla/websocket"
+	"strings"
+)
+
+var errInvalidUTF8 = errors.New("websocket: invalid UTF-8 in text message")
+
+// gorillaViolations maps the messages of the protocol errors gorilla
+// returns, which already sent the peer a close frame, to violations.
+var gorillaViolations = []struct {
+	prefix string
+	v      closes.Violation
+}{
+	{"websocket: incorrect mask flag", closes.Unmasked},
+	{"websocket: unexpected reserved bits", closes.ReservedBits},
+	{"websocket: unknown opcode", closes.ReservedOpCode},
+	{"websocket: control frame", closes.ControlFrame},
+	{"websocket: message start before final message frame", closes.UnexpectedFrame},
+	{"websocket: continuation after final message frame", closes.UnexpectedFrame},
+	{"websocket: invalid close code", closes.CloseFrame},
+	{"websocket: invalid utf8 payload in close frame", closes.InvalidUTF8},
+}
+
+// violationOf classifies the error a connection failed with. It returns
+// false if the connection did not violate the protocol.
+func violationOf(err error) (closes.Violation, bool) {
+	switch err {
+	case nil:
+		return 0, false
+	case errInvalidUTF8:
+		return closes.InvalidUTF8, true
+	case websocket.ErrReadLimit:
+		return closes.MessageTooBig, true
+	}
+	msg := err.Error()
+	for _, gv := range gorillaViolations {
+		if strings.HasPrefix(msg, gv.prefix) {
+			return gv.v, true
+		}
+	}
+	return 0, false
+}
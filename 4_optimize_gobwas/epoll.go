@@ -1,83 +0,0 @@
-package main
-
-import (
-	"golang.org/x/sys/unix"
-	"log"
-	"net"
-	"reflect"
-	"sync"
-	"syscall"
-)
-
-type epoll struct {
-	fd          int
-	connections map[int]net.Conn
-	lock        *sync.RWMutex
-}
-
-func MkEpoll() (*epoll, error) {
-	fd, err := unix.EpollCreate1(0)
-	if err != nil {
-		return nil, err
-	}
-	return &epoll{
-		fd:          fd,
-		lock:        &sync.RWMutex{},
-		connections: make(map[int]net.Conn),
-	}, nil
-}
-
-func (e *epoll) Add(conn net.Conn) error {
-	// Extract file descriptor associated with the connection
-	fd := websocketFD(conn)
-	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: unix.POLLIN | unix.POLLHUP, Fd: int32(fd)})
-	if err != nil {
-		return err
-	}
-	e.lock.Lock()
-	defer e.lock.Unlock()
-	e.connections[fd] = conn
-	if len(e.connections)%100 == 0 {
-		log.Printf("Total number of connections: %v", len(e.connections))
-	}
-	return nil
-}
-
-func (e *epoll) Remove(conn net.Conn) error {
-	fd := websocketFD(conn)
-	err := unix.EpollCtl(e.fd, syscall.EPOLL_CTL_DEL, fd, nil)
-	if err != nil {
-		return err
-	}
-	e.lock.Lock()
-	defer e.lock.Unlock()
-	delete(e.connections, fd)
-	if len(e.connections)%100 == 0 {
-		log.Printf("Total number of connections: %v", len(e.connections))
-	}
-	return nil
-}
-
-func (e *epoll) Wait() ([]net.Conn, error) {
-	events := make([]unix.EpollEvent, 100)
-	n, err := unix.EpollWait(e.fd, events, 100)
-	if err != nil {
-		return nil, err
-	}
-	e.lock.RLock()
-	defer e.lock.RUnlock()
-	var connections []net.Conn
-	for i := 0; i < n; i++ {
-		conn := e.connections[int(events[i].Fd)]
-		connections = append(connections, conn)
-	}
-	return connections, nil
-}
-
-func websocketFD(conn net.Conn) int {
-	tcpConn := reflect.Indirect(reflect.ValueOf(conn)).FieldByName("conn")
-	fdVal := tcpConn.FieldByName("fd")
-	pfdVal := reflect.Indirect(fdVal).FieldByName("pfd")
-
-	return int(pfdVal.FieldByName("Sysfd").Int())
-}
@@ -1,81 +1,388 @@
-package main
+// Package epollgobwas is the server upgrading and reading connections with
+// gobwas/ws from epoll event loops, run by 1mws epoll-gobwas.
+package epollgobwas
 
 import (
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/eranyanay/1m-go-websockets/admin"
+	"github.com/eranyanay/1m-go-websockets/config"
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"github.com/eranyanay/1m-go-websockets/poller"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/eranyanay/1m-go-websockets/shutdown"
+	"github.com/eranyanay/1m-go-websockets/wsserver"
 	"github.com/gobwas/ws"
-	"github.com/gobwas/ws/wsutil"
 	"log"
+	"net"
 	"net/http"
-	_ "net/http/pprof"
-	"syscall"
+	"runtime"
+	"strings"
+	"time"
 )
 
-var epoller *epoll
+var (
+	flags  = config.NewFlagSet("epoll-gobwas")
+	cfg    = config.New()
+	limits = config.NewLimits()
 
-func wsHandler(w http.ResponseWriter, r *http.Request) {
-	// Upgrade connection
-	conn, _, _, err := ws.UpgradeHTTP(r, w)
-	if err != nil {
+	oneshot      = flags.Bool("oneshot", false, "use edge-triggered one-shot epoll and read ready connections on a worker pool")
+	workers      = flags.Int("workers", runtime.NumCPU(), "number of workers reading connections in oneshot mode")
+	loops        = flags.Int("loops", runtime.GOMAXPROCS(0), "number of epoll event loops")
+	backend      = flags.String("poller", "epoll", "readiness backend, one of "+strings.Join(poller.Backends, ", "))
+	queue        = flags.Int("queue", 64, "maximum number of outbound frames queued per connection")
+	idle         = flags.Duration("idle", time.Minute, "inactivity after which a connection is pinged, 0 disables heartbeats")
+	pong         = flags.Duration("pong", 10*time.Second, "time an idle connection has to answer a ping before it is closed")
+	raw          = flags.Bool("raw", false, "accept raw TCP connections and upgrade them without net/http")
+	listeners    = flags.Int("listeners", 1, "number of SO_REUSEPORT listeners in raw mode")
+	drainRate    = flags.Int("drain-rate", shutdown.DefaultRate, "close frames sent per second on shutdown")
+	drainTimeout = flags.Duration("drain-timeout", shutdown.DefaultTimeout, "time given to peers to complete the closing handshake on shutdown")
+	handoff      = flags.String("handoff", "", "unix socket a new process started with -takeover connects to, to take the listeners and connections over; TLS connections are closed, and lingering or rate limited ones passed without their timeout or delay")
+	takeover     = flags.Bool("takeover", false, "take the listeners and connections over from the server listening on -handoff")
+	broadcast    = flags.Duration("broadcast", 0, "interval at which the server time is broadcast to every connection, 0 disables broadcasts")
+	topic        = flags.String("topic", "", "publish the broadcast server time on this topic only")
+	maxSubs      = flags.Int("max-subscriptions", 16, "topics a client may subscribe to, further subscribes are answered with an error")
+	maxTopics    = flags.Int("max-topics", 1<<16, "topics the server keeps, subscribes creating more are answered with an error")
+	deflate      = flags.Bool("deflate", true, "negotiate permessage-deflate compression with clients that offer it")
+	deflateLevel = flags.Int("deflate-level", flate.BestSpeed, "compress/flate level of outbound messages")
+	noContext    = flags.Bool("deflate-client-no-context", false, "ask clients to compress every message on its own, so that no history is kept per connection")
+	windowBits   = flags.Int("deflate-client-window", 15, "window bits clients are asked to compress with, 8 to 15, bounding the history kept per connection")
+	maxFrame     = flags.Int64("max-frame", 0, "largest frame payload accepted from clients, -max-message if 0")
+	maxMessage   = flags.Int64("max-message", 16<<20, "largest message accepted from clients, after decompression")
+	rateMessages = flags.Float64("rate-messages", 0, "messages per second each client may send, 0 disables the limit")
+	messageBurst = flags.Int("rate-message-burst", 0, "messages a client may send at once, a second worth if 0")
+	rateBytes    = flags.Float64("rate-bytes", 0, "payload bytes per second each client may send, 0 disables the limit")
+	byteBurst    = flags.Int("rate-byte-burst", 0, "payload bytes a client may send at once, a second worth if 0")
+	ratePolicy   = flags.String("rate-policy", "delay", "what exceeding the rate does: drop the message, delay reading the client, or close it with 1008")
+	tlsCert      = flags.String("tls-cert", "", "comma separated certificate files to serve wss:// with in raw mode, picked by the server name clients ask for")
+	tlsKey       = flags.String("tls-key", "", "comma separated key files of the -tls-cert certificates")
+)
+
+// handler replies to every message with the time it was received at,
+// except for pub/sub commands.
+type handler struct {
+	server *wsserver.Server
+}
+
+// command is a pub/sub control message. Clients send subscribe,
+// unsubscribe and publish commands; messages published on a topic are
+// delivered to its subscribers with the message type, and invalid commands
+// are answered with the error type.
+type command struct {
+	Type    string `json:"type"`
+	Topic   string `json:"topic,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func (h *handler) OnOpen(c *wsserver.Conn) {}
+
+func (h *handler) OnMessage(c *wsserver.Conn, op ws.OpCode, msg []byte) {
+	cfg.Messagef("msg: %s", string(msg))
+
+	var cmd command
+	if len(msg) > 0 && msg[0] == '{' && json.Unmarshal(msg, &cmd) == nil {
+		h.command(c, cmd)
 		return
 	}
-	if err := epoller.Add(conn); err != nil {
-		log.Printf("Failed to add connection %v", err)
-		conn.Close()
+
+	receivedTime := time.Now()
+	err := c.WriteMessage(ws.OpText, []byte(receivedTime.Format(time.RFC3339Nano)))
+	if err != nil && err != wsserver.ErrClosed {
+		log.Printf("Failed to send %v", err)
 	}
 }
 
-func main() {
-	// Increase resources limitations
-	var rLimit syscall.Rlimit
-	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+// command runs a pub/sub command sent by c.
+func (h *handler) command(c *wsserver.Conn, cmd command) {
+	var err error
+	switch {
+	case cmd.Topic == "":
+		err = errors.New("missing topic")
+	case cmd.Type == "subscribe":
+		err = h.server.Subscribe(c, cmd.Topic)
+	case cmd.Type == "unsubscribe":
+		h.server.Unsubscribe(c, cmd.Topic)
+	case cmd.Type == "publish":
+		_, err = publish(h.server, cmd.Topic, cmd.Message)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd.Type)
+	}
+	if err == nil || err == wsserver.ErrClosed {
+		return
 	}
-	rLimit.Cur = rLimit.Max
-	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+	reply, _ := json.Marshal(command{Type: "error", Topic: cmd.Topic, Message: err.Error()})
+	if err := c.WriteMessage(ws.OpText, reply); err != nil && err != wsserver.ErrClosed {
+		log.Printf("Failed to send %v", err)
 	}
+}
 
-	// Enable pprof hooks
-	go func() {
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
-			log.Fatalf("pprof failed: %v", err)
+// publish delivers message to the subscribers of topic.
+func publish(server *wsserver.Server, topic, message string) (wsserver.BroadcastStats, error) {
+	p, err := json.Marshal(command{Type: "message", Topic: topic, Message: message})
+	if err != nil {
+		return wsserver.BroadcastStats{}, err
+	}
+	return server.Publish(topic, ws.OpText, p)
+}
+
+func (h *handler) OnClose(c *wsserver.Conn, err error) {}
+
+// Main runs the server with the command line arguments args.
+func Main(args []string) error {
+	// Messages are not logged by default, since in demo usage stdout would
+	// show messages sent from > 1M connections at very high rate
+	cfg.LogMessages = false
+	cfg.Register(flags)
+	limits.Register(flags)
+	if err := config.Parse(flags, args); err != nil {
+		return err
+	}
+	if err := cfg.Setup(); err != nil {
+		return err
+	}
+
+	// Increase resources limitations, and admit as many connections as
+	// they allow, except for the load generators
+	admit, quota, err := limits.Admission()
+	if err != nil {
+		return err
+	}
+	http.Handle("/debug/clients", quota)
+
+	// Enable pprof hooks. A server taking over waits for the previous one
+	// to exit and release the port.
+	if cfg.Pprof != "" {
+		go func() {
+			err := http.ListenAndServe(cfg.Pprof, nil)
+			for deadline := time.Now().Add(5 * time.Second); *takeover && time.Now().Before(deadline); {
+				time.Sleep(100 * time.Millisecond)
+				err = http.ListenAndServe(cfg.Pprof, nil)
+			}
+			log.Fatalf("Pprof failed: %v", err)
+		}()
+	}
+
+	// Load the TLS certificates
+	var tlsConfig *tls.Config
+	if *tlsCert != "" {
+		if !*raw {
+			return errors.New("TLS is only served in -raw mode")
 		}
-	}()
+		if tlsConfig, err = loadTLSConfig(*tlsCert, *tlsKey); err != nil {
+			return fmt.Errorf("failed to load certificates: %v", err)
+		}
+	}
+
+	// Check the rate limit policy
+	policy, err := ratelimit.ParsePolicy(*ratePolicy)
+	if err != nil {
+		return err
+	}
 
 	// Start epoll
-	var err error
-	epoller, err = MkEpoll()
+	h := &handler{}
+	server, err := wsserver.NewServer(h, wsserver.Options{
+		Backend:    *backend,
+		Loops:      *loops,
+		OneShot:    *oneshot,
+		Workers:    *workers,
+		QueueLimit: *queue,
+		Idle:       *idle,
+		PongWait:   *pong,
+		Compression: wsserver.Compression{
+			Enabled:                 *deflate,
+			Level:                   *deflateLevel,
+			ClientNoContextTakeover: *noContext,
+			ClientMaxWindowBits:     *windowBits,
+		},
+		TLSConfig:      tlsConfig,
+		MaxFrameSize:   *maxFrame,
+		MaxMessageSize: *maxMessage,
+		RateLimit: ratelimit.Limiter{
+			Messages:     *rateMessages,
+			MessageBurst: *messageBurst,
+			Bytes:        *rateBytes,
+			ByteBurst:    *byteBurst,
+			Policy:       policy,
+		},
+		MaxSubscriptions: *maxSubs,
+		MaxTopics:        *maxTopics,
+		Admission:        admit,
+		Metrics:          metrics.Default,
+	})
 	if err != nil {
-		panic(err)
+		return err
+	}
+	h.server = server
+
+	// Report memory per connection and the metrics, and manage the
+	// connections, next to the pprof hooks
+	http.HandleFunc("/debug/memory", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(server.Memory())
+	})
+	metrics.Default.NewCounterFunc("ws_rejected_total", "Upgrades rejected by the connection limit or the client quotas.", func() float64 {
+		return float64(admit.Rejected())
+	})
+	http.Handle("/metrics", metrics.Default)
+	http.Handle("/debug/conns/", http.StripPrefix("/debug/conns", admin.Handler(server.Admin())))
+
+	// Broadcast the server time to every connection
+	if *broadcast > 0 {
+		go broadcastTime(server, *broadcast, *topic)
 	}
 
-	go Start()
+	// Listen, or take over the listeners and connections of a running server
+	var lns []net.Listener
+	switch {
+	case *takeover:
+		lns, err = takeOver(server, *handoff)
+		if err != nil {
+			return fmt.Errorf("failed to take over: %v", err)
+		}
+		log.Printf("Took over %v listeners and %v connections", len(lns), server.Len())
+	case *raw:
+		for i := 0; i < *listeners; i++ {
+			ln, err := wsserver.ListenReusePort(cfg.Listen)
+			if err != nil {
+				return err
+			}
+			lns = append(lns, ln)
+		}
+	default:
+		ln, err := net.Listen("tcp", cfg.Listen)
+		if err != nil {
+			return err
+		}
+		lns = append(lns, ln)
+	}
 
-	http.HandleFunc("/", wsHandler)
-	if err := http.ListenAndServe("0.0.0.0:8000", nil); err != nil {
-		log.Fatal(err)
+	// Serve until a signal asks to stop, or a new process to take over
+	var web *http.Server
+	errs := make(chan error, len(lns))
+	if *raw {
+		for _, ln := range lns {
+			go func(ln net.Listener) {
+				errs <- server.Serve(ln)
+			}(ln)
+		}
+	} else {
+		http.Handle("/", server)
+		web = &http.Server{}
+		for _, ln := range lns {
+			go func(ln net.Listener) {
+				errs <- web.Serve(ln)
+			}(ln)
+		}
 	}
+	hl, handoffs := listenHandoff(*handoff)
+	select {
+	case err := <-errs:
+		return err
+	case uc := <-handoffs:
+		log.Printf("Handing %v connections over", server.Len())
+		if err := server.Handoff(uc, lns); err != nil {
+			return fmt.Errorf("failed to hand off: %v", err)
+		}
+		log.Printf("Handed off")
+		return nil
+	case sig := <-shutdown.Notify():
+		if hl != nil {
+			hl.Close()
+		}
+		log.Printf("Received %v, draining %v connections", sig, server.Len())
+	}
+
+	// Stop accepting and close every connection with 1001 Going Away
+	ctx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+	defer cancel()
+	if web != nil {
+		web.Shutdown(ctx)
+	}
+	if err := server.Shutdown(ctx, *drainRate); err != nil {
+		log.Printf("Failed to drain connections: %v", err)
+	}
+	stats := server.Stats()
+	log.Printf("Shut down, closed by reason: %v, violations: %v, rate limited: %v, rejected: %v", stats.Closes, stats.Violations, stats.RateLimited, admit.Rejected())
+	return nil
 }
 
-func Start() {
-	for {
-		connections, err := epoller.Wait()
+// broadcastTime sends the current time to every connection, or to the
+// subscribers of topic if not empty, at each interval and logs how many
+// connections got it.
+func broadcastTime(server *wsserver.Server, interval time.Duration, topic string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		start := time.Now()
+		var st wsserver.BroadcastStats
+		var err error
+		if topic != "" {
+			st, err = publish(server, topic, now.Format(time.RFC3339Nano))
+		} else {
+			st, err = server.Broadcast(ws.OpText, []byte(now.Format(time.RFC3339Nano)))
+		}
 		if err != nil {
-			log.Printf("Failed to epoll wait %v", err)
+			log.Printf("Failed to broadcast %v", err)
 			continue
 		}
-		for _, conn := range connections {
-			if conn == nil {
-				break
-			}
-			if _, _, err := wsutil.ReadClientData(conn); err != nil {
-				if err := epoller.Remove(conn); err != nil {
-					log.Printf("Failed to remove %v", err)
-				}
-				conn.Close()
-			} else {
-				// This is commented out since in demo usage, stdout is showing messages sent from > 1M connections at very high rate
-				//log.Printf("msg: %s", string(msg))
-			}
+		log.Printf("Broadcast in %v: delivered %v, slow %v, dropped %v", time.Since(start), st.Delivered, st.Slow, st.Dropped)
+	}
+}
+
+// loadTLSConfig loads the certificate and key files listed in certs and
+// keys. crypto/tls serves each client the first certificate valid for the
+// server name it asks for, or the first one.
+func loadTLSConfig(certs, keys string) (*tls.Config, error) {
+	certFiles, keyFiles := strings.Split(certs, ","), strings.Split(keys, ",")
+	if len(certFiles) != len(keyFiles) {
+		return nil, fmt.Errorf("%v certificates for %v keys", len(certFiles), len(keyFiles))
+	}
+	config := &tls.Config{}
+	for i := range certFiles {
+		cert, err := tls.LoadX509KeyPair(certFiles[i], keyFiles[i])
+		if err != nil {
+			return nil, err
 		}
+		config.Certificates = append(config.Certificates, cert)
+	}
+	return config, nil
+}
+
+// takeOver receives the listeners and connections of the server waiting
+// for a handoff on path.
+func takeOver(server *wsserver.Server, path string) ([]net.Listener, error) {
+	uc, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
 	}
+	defer uc.Close()
+	return server.Takeover(uc)
+}
+
+// listenHandoff waits for a process to take over on path. The socket is
+// removed as soon as one connects, so that it can listen on path in turn,
+// or when the returned listener is closed.
+func listenHandoff(path string) (*net.UnixListener, <-chan *net.UnixConn) {
+	if path == "" {
+		return nil, nil
+	}
+	hl, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		log.Printf("Failed to listen for handoffs %v", err)
+		return nil, nil
+	}
+	handoffs := make(chan *net.UnixConn, 1)
+	go func() {
+		uc, err := hl.AcceptUnix()
+		hl.Close()
+		if err == nil {
+			handoffs <- uc
+		}
+	}()
+	return hl, handoffs
 }
@@ -0,0 +1,72 @@
+package signaling
+
+import (
+	"github.com/eranyanay/1m-go-websockets/admin"
+	"github.com/gorilla/websocket"
+	"sync/atomic"
+	"time"
+)
+
+// adminWriteWait bounds the write of a message sent through the admin API,
+// which is not queued.
+const adminWriteWait = 5 * time.Second
+
+// adminSource exposes the clients to the admin API, served on
+// localhost:6060/debug/conns/.
+type adminSource struct{}
+
+func (adminSource) Conns(after uint64, limit int) []admin.Conn {
+	found := clients.after(after, limit)
+	infos := make([]admin.Conn, len(found))
+	for i, c := range found {
+		infos[i] = info(c)
+	}
+	return infos
+}
+
+func (adminSource) Conn(id uint64) (admin.Conn, bool) {
+	c := clients.get(id)
+	if c == nil {
+		return admin.Conn{}, false
+	}
+	in := info(c)
+	in.Details = map[string]interface{}{
+		"caller": c.getCaller(),
+		"kicked": c.wasKicked(),
+	}
+	return in, true
+}
+
+func (adminSource) Close(id uint64, code int, reason string) error {
+	c := clients.get(id)
+	if c == nil {
+		return admin.ErrNotFound
+	}
+	return c.kick(code, reason)
+}
+
+func (adminSource) Send(id uint64, binary bool, msg []byte) error {
+	c := clients.get(id)
+	if c == nil {
+		return admin.ErrNotFound
+	}
+	messageType := websocket.TextMessage
+	if binary {
+		messageType = websocket.BinaryMessage
+	}
+	return c.write(messageType, msg, adminWriteWait)
+}
+
+// info returns the counters of c.
+func info(c *client) admin.Conn {
+	return admin.Conn{
+		ID:          c.id,
+		Remote:      c.conn.RemoteAddr().String(),
+		Connected:   c.since,
+		LastActive:  time.Unix(0, atomic.LoadInt64(&c.stats.active)),
+		MessagesIn:  atomic.LoadInt64(&c.stats.messagesIn),
+		BytesIn:     atomic.LoadInt64(&c.stats.bytesIn),
+		MessagesOut: atomic.LoadInt64(&c.stats.messagesOut),
+		BytesOut:    atomic.LoadInt64(&c.stats.bytesOut),
+	}
+}
@@ -0,0 +1,179 @@
+package signaling
+
+import (
+	"github.com/gorilla/websocket"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// controlWait bounds the write of a close frame.
+	controlWait = time.Second
+	// lingerTimeout is how long a kicked client is given to answer its
+	// close frame before its connection is closed.
+	lingerTimeout = 2 * time.Second
+)
+
+// clients are the connections listed by the admin API.
+var clients = clientTable{clients: make(map[uint64]*client)}
+
+// client is an upgraded connection, read by the handler that upgraded it
+// and written to by its dispatcher worker and the admin API.
+type client struct {
+	// stats is first in the struct to be 64-bit aligned for atomic
+	// access.
+	stats clientStats
+	// kicked is set once the admin API sent the client a close frame.
+	kicked int32
+
+	id    uint64
+	conn  *websocket.Conn
+	since time.Time
+
+	// writeMu serializes the writes of data messages.
+	writeMu sync.Mutex
+	// mu guards caller, the name the client registered with.
+	mu     sync.Mutex
+	caller string
+}
+
+// clientStats counts the messages and bytes of a client, and holds when it
+// was last heard from in Unix nanoseconds.
+type clientStats struct {
+	messagesIn  int64
+	bytesIn     int64
+	messagesOut int64
+	bytesOut    int64
+	active      int64
+}
+
+// received records a message of size bytes read from c.
+func (c *client) received(size int) {
+	atomic.AddInt64(&c.stats.messagesIn, 1)
+	atomic.AddInt64(&c.stats.bytesIn, int64(size))
+	atomic.StoreInt64(&c.stats.active, time.Now().UnixNano())
+	messagesIn.Inc()
+	bytesIn.Add(size)
+}
+
+// write sends c a data message, failing if it takes longer than timeout
+// unless it is zero.
+func (c *client) write(messageType int, p []byte, timeout time.Duration) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if timeout > 0 {
+		c.conn.SetWriteDeadline(time.Now().Add(timeout))
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	if err := c.conn.WriteMessage(messageType, p); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.stats.messagesOut, 1)
+	atomic.AddInt64(&c.stats.bytesOut, int64(len(p)))
+	messagesOut.Inc()
+	bytesOut.Add(len(p))
+	return nil
+}
+
+// kick sends c a close frame with code and reason. Its read loop ends once
+// the peer answers, or once lingerTimeout has passed.
+func (c *client) kick(code int, reason string) error {
+	atomic.StoreInt32(&c.kicked, 1)
+	err := c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(controlWait))
+	if err != nil {
+		return c.conn.Close()
+	}
+	return c.conn.SetReadDeadline(time.Now().Add(lingerTimeout))
+}
+
+func (c *client) wasKicked() bool {
+	return atomic.LoadInt32(&c.kicked) != 0
+}
+
+// closeHandler answers the close frame of the peer as gorilla does by
+// default, unless it is the answer to the one kick sent.
+func (c *client) closeHandler(code int, text string) error {
+	if !c.wasKicked() {
+		c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, ""), time.Now().Add(controlWait))
+	}
+	return nil
+}
+
+func (c *client) setCaller(name string) {
+	c.mu.Lock()
+	c.caller = name
+	c.mu.Unlock()
+}
+
+func (c *client) getCaller() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.caller
+}
+
+// clientTable holds the clients by ID, which increase as they connect.
+// ids lists them in that order for paging, so a page is found by binary
+// search. Removed IDs are dropped from ids lazily, once they are most of
+// it.
+type clientTable struct {
+	mu      sync.RWMutex
+	next    uint64
+	clients map[uint64]*client
+	ids     []uint64
+}
+
+// add creates the client of conn.
+func (t *clientTable) add(conn *websocket.Conn) *client {
+	now := time.Now()
+	c := &client{conn: conn, since: now}
+	c.stats.active = now.UnixNano()
+	conn.SetCloseHandler(c.closeHandler)
+	t.mu.Lock()
+	t.next++
+	c.id = t.next
+	t.clients[c.id] = c
+	t.ids = append(t.ids, c.id)
+	t.mu.Unlock()
+	return c
+}
+
+func (t *clientTable) remove(c *client) {
+	t.mu.Lock()
+	delete(t.clients, c.id)
+	if len(t.clients) < len(t.ids)/2 {
+		ids := make([]uint64, 0, 2*len(t.clients))
+		for _, id := range t.ids {
+			if _, ok := t.clients[id]; ok {
+				ids = append(ids, id)
+			}
+		}
+		t.ids = ids
+	}
+	t.mu.Unlock()
+}
+
+// get returns the client id, or nil.
+func (t *clientTable) get(id uint64) *client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.clients[id]
+}
+
+// after returns up to limit clients, by increasing ID, whose ID is greater
+// than id.
+func (t *clientTable) after(id uint64, limit int) []*client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var found []*client
+	i := sort.Search(len(t.ids), func(i int) bool {
+		return t.ids[i] > id
+	})
+	for ; i < len(t.ids) && len(found) < limit; i++ {
+		if c := t.clients[t.ids[i]]; c != nil {
+			found = append(found, c)
+		}
+	}
+	return found
+}
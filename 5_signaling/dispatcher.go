@@ -1,4 +1,4 @@
-package main
+package signaling
 
 import (
 	"encoding/json"
@@ -51,7 +51,7 @@ func (d *Dispatcher) Send(msg Message) {
 	}
 }
 
-func worker(myself string, ch chan Message, conn *websocket.Conn) {
+func worker(myself string, ch chan Message, c *client) {
 	for msg := range ch {
 		//fmt.Printf("%s received message: %s\n", name, msg.Content)
 
@@ -68,7 +68,7 @@ func worker(myself string, ch chan Message, conn *websocket.Conn) {
 			continue
 		}
 
-		if err := conn.WriteMessage(websocket.TextMessage, []byte(jsonMsg)); err != nil {
+		if err := c.write(websocket.TextMessage, []byte(jsonMsg), 0); err != nil {
 			log.Printf("Write error: %v", err)
 			return
 		}
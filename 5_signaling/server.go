@@ -1,19 +1,34 @@
-package main
+// Package signaling is the WebRTC signaling server relaying messages between
+// registered callers, run by 1mws signaling.
+package signaling
 
 import (
+	"context"
 	"encoding/json"
+	"github.com/eranyanay/1m-go-websockets/admin"
+	"github.com/eranyanay/1m-go-websockets/admission"
+	"github.com/eranyanay/1m-go-websockets/config"
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"github.com/eranyanay/1m-go-websockets/shutdown"
 	"github.com/gorilla/websocket"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
-	"runtime"
-	"runtime/debug"
 	"sync/atomic"
-	"syscall"
+)
+
+var (
+	flags  = config.NewFlagSet("signaling")
+	cfg    = config.New()
+	limits = config.NewLimits()
 )
 
 var count int64
 
+var registry = shutdown.NewRegistry()
+
+// admit counts the connections, each held by the handler reading it.
+var admit *admission.Controller
+
 type IncomingMessage struct {
 	Caller  string `json:"caller"`
 	Callee  string `json:"callee"`
@@ -22,6 +37,12 @@ type IncomingMessage struct {
 }
 
 func ws(w http.ResponseWriter, r *http.Request) {
+	if err := admit.Acquire(r.RemoteAddr); err != nil {
+		admit.Reject(w, err)
+		return
+	}
+	defer admit.Release(r.RemoteAddr)
+
 	upgrader := websocket.Upgrader{}
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -29,15 +50,14 @@ func ws(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	n := atomic.AddInt64(&count, 1)
-	if n%100 == 0 {
-		log.Printf("Total number of connections: %v", n)
-	}
+	atomic.AddInt64(&count, 1)
+	upgrades.Inc()
+	registry.Add(conn)
+	c := clients.add(conn)
 	defer func() {
-		n := atomic.AddInt64(&count, -1)
-		if n%100 == 0 {
-			log.Printf("Total number of connections: %v", n)
-		}
+		clients.remove(c)
+		registry.Remove(conn)
+		atomic.AddInt64(&count, -1)
 		conn.Close()
 	}()
 
@@ -47,10 +67,16 @@ func ws(w http.ResponseWriter, r *http.Request) {
 		_, msg, err := conn.ReadMessage()
 		if err != nil {
 			log.Printf("Read error: %v", err)
+			reason := closeReason(err)
+			if c.wasKicked() {
+				reason = "kick"
+			}
+			closes[reason].Inc()
 			return
 		}
+		c.received(len(msg))
 
-		log.Printf("msg: %s ", string(msg))
+		cfg.Messagef("msg: %s ", string(msg))
 		// deal with msg , the msg is a json string, like this:{
 		//    "to": "1001",
 		//    "message": "login",
@@ -70,6 +96,7 @@ func ws(w http.ResponseWriter, r *http.Request) {
 			ch := make(chan Message)
 
 			myself = incomingMsg.Caller
+			c.setCaller(myself)
 
 			// Get the dispatcher instance
 			dispatcher := GetDispatcher()
@@ -79,9 +106,9 @@ func ws(w http.ResponseWriter, r *http.Request) {
 
 			// Optionally, start a worker goroutine for the new recipient
 			// add the websocket connection to worker and listen the ch, if received the ch message, then use websocket send the message to client
-			go worker(myself, ch, conn)
+			go worker(myself, ch, c)
 
-			log.Printf("Registered %s with the dispatcher", incomingMsg.Caller)
+			cfg.Messagef("Registered %s with the dispatcher", incomingMsg.Caller)
 		} else if incomingMsg.Type == "sdp" {
 
 			if myself == "unknown" {
@@ -128,51 +155,55 @@ func ws(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func main() {
-	previousLimit := SetMemoryLimit(11 * 1024 * 1024 * 1024) // 11 GB
-	println("Previous memory limit:", previousLimit)
-
-	// Increase resources limitations
-	var rLimit syscall.Rlimit
-	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+// Main runs the server with the command line arguments args.
+func Main(args []string) error {
+	cfg.MemoryLimit = 11 * 1024 * 1024 * 1024 // 11 GB
+	cfg.Register(flags)
+	limits.Register(flags)
+	if err := config.Parse(flags, args); err != nil {
+		return err
 	}
-	log.Printf("NOFILE limit: %v", rLimit.Max)
-	rLimit.Cur = rLimit.Max
-	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
-		panic(err)
+	if err := cfg.Setup(); err != nil {
+		return err
 	}
 
+	// Increase resources limitations, and admit as many connections as
+	// they allow, except for the load generators
+	var quota *admission.Quota
+	var err error
+	admit, quota, err = limits.Admission()
+	if err != nil {
+		return err
+	}
+	http.Handle("/debug/clients", quota)
+	registerMetrics()
+	http.Handle("/metrics", metrics.Default)
+	http.Handle("/debug/conns/", http.StripPrefix("/debug/conns", admin.Handler(adminSource{})))
+
 	// Enable pprof hooks
-	go func() {
-		if err := http.ListenAndServe("localhost:6060", nil); err != nil {
-			log.Fatalf("Pprof failed: %v", err)
-		}
-	}()
+	cfg.ServePprof()
 
+	// Serve until a signal asks to stop
 	http.HandleFunc("/", ws)
-	if err := http.ListenAndServe(":8000", nil); err != nil {
-		log.Fatal(err)
+	web := &http.Server{Addr: cfg.Listen}
+	errs := make(chan error, 1)
+	go func() {
+		errs <- web.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-shutdown.Notify():
+		log.Printf("Received %v, draining %v connections", sig, registry.Len())
 	}
-}
 
-// SetMemoryLimit sets a limit on the maximum memory usage of the Go program.
-// The limit is specified in bytes. Returns the previous limit.
-func SetMemoryLimit(limit int64) int64 {
-	// Estimate the current limit based on total memory and the current GC target percentage.
-	memStats := &runtime.MemStats{}
-	runtime.ReadMemStats(memStats)
-	previousLimit := int64(memStats.HeapAlloc) * 100 / int64(debug.SetGCPercent(-1))
-
-	// Calculate the new GC target percentage based on the desired memory limit.
-	// If the limit is zero, reset to default GC behavior.
-	if limit > 0 {
-		newGCTarget := int(int64(100*memStats.HeapAlloc) / limit)
-		debug.SetGCPercent(newGCTarget)
-	} else {
-		debug.SetGCPercent(100) // Reset to default
+	// Stop accepting and close every connection with 1001 Going Away
+	ctx, cancel := context.WithTimeout(context.Background(), shutdown.DefaultTimeout)
+	defer cancel()
+	web.Shutdown(ctx)
+	if err := registry.Drain(ctx, shutdown.DefaultRate); err != nil {
+		log.Printf("Failed to drain connections: %v", err)
 	}
-
-	// Return the previous limit for reference.
-	return previousLimit
+	log.Printf("Shut down, rejected: %v", admit.Rejected())
+	return nil
 }
@@ -0,0 +1,263 @@
+// Package admin serves an HTTP API to inspect and manage the live
+// connections of the example servers, next to pprof on localhost:6060:
+//
+//	GET  /debug/conns/?after=ID&limit=N    list connections by increasing ID
+//	GET  /debug/conns/ID                   details of a connection
+//	POST /debug/conns/ID/close?code=&reason=  close it with a close frame
+//	POST /debug/conns/ID/send?binary=1     send it the request body
+//
+// Servers expose their connections through a Source, which identifies
+// them by IDs it picks so that pages can be listed without sorting every
+// connection.
+package admin
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// DefaultLimit and MaxLimit are the default and largest number of
+	// connections listed per page.
+	DefaultLimit = 100
+	MaxLimit     = 1000
+	// MaxMessageSize bounds the messages sent through the API.
+	MaxMessageSize = 1 << 20
+	// maxReasonSize is what is left of the 125 bytes of a control frame
+	// once the status code is set.
+	maxReasonSize = 123
+)
+
+// ErrNotFound is returned by a Source for an ID no connection has.
+var ErrNotFound = errors.New("admin: no such connection")
+
+// Conn describes a live connection.
+type Conn struct {
+	ID     uint64 `json:"id"`
+	Remote string `json:"remote"`
+	// Connected is when the connection was registered, and LastActive
+	// when a message was last read from it, or Connected if none was.
+	Connected  time.Time `json:"connected"`
+	LastActive time.Time `json:"last_active"`
+	// Age and Idle are the time elapsed since Connected and LastActive,
+	// in seconds. They are set by the handler.
+	Age  float64 `json:"age_seconds"`
+	Idle float64 `json:"idle_seconds"`
+	// MessagesIn and BytesIn count the data messages read and their
+	// payload bytes, and MessagesOut and BytesOut the frames and bytes
+	// sent, as the ws_* metrics do.
+	MessagesIn  int64 `json:"messages_in"`
+	BytesIn     int64 `json:"bytes_in"`
+	MessagesOut int64 `json:"messages_out"`
+	BytesOut    int64 `json:"bytes_out"`
+	// Details holds what else the server knows of the connection. It is
+	// only set for a single connection.
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Source gives access to the connections of a server.
+type Source interface {
+	// Conns returns up to limit connections whose ID is greater than
+	// after, by increasing ID.
+	Conns(after uint64, limit int) []Conn
+	// Conn returns the connection id, with its details, and false if
+	// there is none.
+	Conn(id uint64) (Conn, bool)
+	// Close sends connection id a close frame with code and reason, and
+	// closes it once the peer answers or after a while.
+	Close(id uint64, code int, reason string) error
+	// Send sends connection id a text or binary message.
+	Send(id uint64, binary bool, msg []byte) error
+}
+
+// Page is a page of connections. Next is the after parameter of the next
+// page, zero once the last page was returned.
+type Page struct {
+	Conns []Conn `json:"conns"`
+	Next  uint64 `json:"next,omitempty"`
+}
+
+// Handler serves the API for src. It expects the paths stripped of their
+// prefix, as in:
+//
+//	http.Handle("/debug/conns/", http.StripPrefix("/debug/conns", admin.Handler(src)))
+func Handler(src Source) http.Handler {
+	return &handler{src: src}
+}
+
+type handler struct {
+	src Source
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if parts[0] == "" {
+		if allow(w, r, http.MethodGet) {
+			h.list(w, r)
+		}
+		return
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+	if len(parts) == 1 {
+		if allow(w, r, http.MethodGet) {
+			h.get(w, r, id)
+		}
+		return
+	}
+	if !allow(w, r, http.MethodPost) {
+		return
+	}
+	switch parts[1] {
+	case "close":
+		h.close(w, r, id)
+	case "send":
+		h.send(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// allow reports whether r uses method, and answers it with 405 Method Not
+// Allowed if not.
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// list writes the page of connections after the after query parameter.
+func (h *handler) list(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var after uint64
+	if s := q.Get("after"); s != "" {
+		var err error
+		if after, err = strconv.ParseUint(s, 10, 64); err != nil {
+			http.Error(w, "invalid after", http.StatusBadRequest)
+			return
+		}
+	}
+	limit := DefaultLimit
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		if n < MaxLimit {
+			limit = n
+		} else {
+			limit = MaxLimit
+		}
+	}
+	page := Page{Conns: h.src.Conns(after, limit)}
+	if page.Conns == nil {
+		page.Conns = []Conn{}
+	}
+	now := time.Now()
+	for i := range page.Conns {
+		page.Conns[i].since(now)
+	}
+	if n := len(page.Conns); n == limit {
+		page.Next = page.Conns[n-1].ID
+	}
+	writeJSON(w, page)
+}
+
+func (h *handler) get(w http.ResponseWriter, r *http.Request, id uint64) {
+	c, ok := h.src.Conn(id)
+	if !ok {
+		http.Error(w, ErrNotFound.Error(), http.StatusNotFound)
+		return
+	}
+	c.since(time.Now())
+	writeJSON(w, c)
+}
+
+// close closes the connection with the code query parameter, 1000 Normal
+// Closure by default, and the reason one.
+func (h *handler) close(w http.ResponseWriter, r *http.Request, id uint64) {
+	q := r.URL.Query()
+	code := 1000
+	if s := q.Get("code"); s != "" {
+		var err error
+		if code, err = strconv.Atoi(s); err != nil || !validCode(code) {
+			http.Error(w, "invalid close code", http.StatusBadRequest)
+			return
+		}
+	}
+	reason := q.Get("reason")
+	if len(reason) > maxReasonSize || !utf8.ValidString(reason) {
+		http.Error(w, "invalid close reason", http.StatusBadRequest)
+		return
+	}
+	h.reply(w, h.src.Close(id, code, reason))
+}
+
+// send sends the request body as a text message, or a binary one if the
+// binary query parameter is set.
+func (h *handler) send(w http.ResponseWriter, r *http.Request, id uint64) {
+	binary, _ := strconv.ParseBool(r.URL.Query().Get("binary"))
+	msg, err := ioutil.ReadAll(io.LimitReader(r.Body, MaxMessageSize+1))
+	switch {
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case len(msg) > MaxMessageSize:
+		http.Error(w, "message too big", http.StatusRequestEntityTooLarge)
+		return
+	case !binary && !utf8.Valid(msg):
+		http.Error(w, "text message is not valid UTF-8", http.StatusBadRequest)
+		return
+	}
+	h.reply(w, h.src.Send(id, binary, msg))
+}
+
+// reply answers a close or send request that failed with err, if not nil.
+// A connection that exists but cannot take the frame, because it is
+// closing or too slow, is a conflict.
+func (h *handler) reply(w http.ResponseWriter, err error) {
+	switch {
+	case err == nil:
+		w.WriteHeader(http.StatusNoContent)
+	case err == ErrNotFound:
+		http.Error(w, err.Error(), http.StatusNotFound)
+	default:
+		http.Error(w, err.Error(), http.StatusConflict)
+	}
+}
+
+// since sets the Age and Idle of c at now.
+func (c *Conn) since(now time.Time) {
+	c.Age = now.Sub(c.Connected).Seconds()
+	c.Idle = now.Sub(c.LastActive).Seconds()
+}
+
+// validCode reports whether a server may send the close status code: the
+// ones defined by RFC 6455 and its registry for use in close frames, and
+// the ranges left to libraries and applications.
+func validCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1014:
+		return true
+	}
+	return code >= 3000 && code <= 4999
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,105 @@
+package admin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// source is a Source of connections with IDs 1 to n.
+type source struct {
+	n uint64
+}
+
+func (s *source) Conns(after uint64, limit int) []Conn {
+	var conns []Conn
+	for id := after + 1; id <= s.n && len(conns) < limit; id++ {
+		conns = append(conns, Conn{ID: id})
+	}
+	return conns
+}
+
+func (s *source) Conn(id uint64) (Conn, bool) {
+	return Conn{ID: id}, id >= 1 && id <= s.n
+}
+
+func (s *source) Close(id uint64, code int, reason string) error {
+	if _, ok := s.Conn(id); !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func (s *source) Send(id uint64, binary bool, msg []byte) error {
+	if _, ok := s.Conn(id); !ok {
+		return ErrNotFound
+	}
+	return nil
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		method, path, body string
+		code               int
+		allow              string
+	}{
+		{"GET", "/", "", http.StatusOK, ""},
+		{"GET", "/?limit=0", "", http.StatusBadRequest, ""},
+		{"GET", "/?after=x", "", http.StatusBadRequest, ""},
+		{"POST", "/", "", http.StatusMethodNotAllowed, "GET"},
+		{"DELETE", "/", "", http.StatusMethodNotAllowed, "GET"},
+		{"GET", "/2", "", http.StatusOK, ""},
+		{"GET", "/9", "", http.StatusNotFound, ""},
+		{"GET", "/x", "", http.StatusNotFound, ""},
+		{"PUT", "/2", "", http.StatusMethodNotAllowed, "GET"},
+		{"POST", "/2/close?code=4000&reason=bye", "", http.StatusNoContent, ""},
+		{"POST", "/2/close?code=1005", "", http.StatusBadRequest, ""},
+		{"POST", "/2/close?reason=" + strings.Repeat("x", 124), "", http.StatusBadRequest, ""},
+		{"GET", "/2/close", "", http.StatusMethodNotAllowed, "POST"},
+		{"POST", "/9/close", "", http.StatusNotFound, ""},
+		{"POST", "/2/send", "hello", http.StatusNoContent, ""},
+		{"POST", "/2/send", "\xff", http.StatusBadRequest, ""},
+		{"POST", "/2/send?binary=1", "\xff", http.StatusNoContent, ""},
+		{"POST", "/2/kick", "", http.StatusNotFound, ""},
+	}
+	h := Handler(&source{n: 3})
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body)))
+		if w.Code != tt.code {
+			t.Errorf("%v %v: status %v, want %v", tt.method, tt.path, w.Code, tt.code)
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("%v %v: Allow %q, want %q", tt.method, tt.path, got, tt.allow)
+		}
+	}
+}
+
+func TestHandlerPages(t *testing.T) {
+	h := Handler(&source{n: 5})
+	var ids []uint64
+	for after, pages := "0", 0; after != ""; pages++ {
+		if pages > 5 {
+			t.Fatal("too many pages")
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("GET", "/?limit=2&after="+after, nil))
+		var page Page
+		if err := json.NewDecoder(w.Body).Decode(&page); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range page.Conns {
+			ids = append(ids, c.ID)
+		}
+		after = ""
+		if page.Next != 0 {
+			after = strconv.FormatUint(page.Next, 10)
+		}
+	}
+	if len(ids) != 5 || ids[0] != 1 || ids[4] != 5 {
+		t.Errorf("listed %v, want 1 to 5", ids)
+	}
+}
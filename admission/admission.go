@@ -0,0 +1,166 @@
+// Package admission bounds the number of connections the example servers
+// accept. Each connection holds a file descriptor, so a server accepting
+// until accept fails with EMFILE has no descriptor left for anything else,
+// and net/http then spins retrying the accept. A Controller instead admits
+// connections up to what RLIMIT_NOFILE leaves once a reserve is set aside
+// for the pprof listener, log files and pollers, and the upgrades beyond
+// it are answered with 503 Service Unavailable and a Retry-After header.
+// A Quota caps the connections of each client address and subnet as well.
+package admission
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultReserved is the number of file descriptors kept for the
+	// pprof listener and its clients, log files and pollers.
+	DefaultReserved = 256
+	// DefaultRetryAfter is how long rejected clients are asked to wait
+	// before connecting again.
+	DefaultRetryAfter = 5 * time.Second
+)
+
+// Limit raises the soft RLIMIT_NOFILE to the hard limit, and returns the
+// number of connections it leaves room for once reserved descriptors and
+// the ones already open are set aside. It returns max instead if it is
+// positive and lower.
+func Limit(max, reserved int) (int, error) {
+	var rLimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
+		return 0, err
+	}
+	rLimit.Cur = rLimit.Max
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rLimit); err != nil {
+		return 0, err
+	}
+	headroom := int64(math.MaxInt32)
+	if rLimit.Cur < uint64(headroom) {
+		headroom = int64(rLimit.Cur)
+	}
+	headroom -= int64(reserved + openFiles())
+	if headroom < 1 {
+		return 0, errors.New("admission: no file descriptors left for connections")
+	}
+	if max > 0 && int64(max) < headroom {
+		return max, nil
+	}
+	return int(headroom), nil
+}
+
+// openFiles returns the number of descriptors open by the process.
+func openFiles() int {
+	f, err := os.Open("/proc/self/fd")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	names, _ := f.Readdirnames(-1)
+	return len(names)
+}
+
+var (
+	// ErrTooManyConns rejects a connection beyond the maximum of a
+	// Controller.
+	ErrTooManyConns = errors.New("too many connections")
+	// ErrQuotaExceeded rejects a connection beyond the Quota of its
+	// address or subnet.
+	ErrQuotaExceeded = errors.New("too many connections from this address")
+)
+
+// Controller counts the connections of a server against a maximum, and
+// against the Quota of their client if any.
+type Controller struct {
+	max        int64
+	active     int64
+	rejected   int64
+	retryAfter string
+	quota      *Quota
+}
+
+// New creates a controller admitting up to max connections, within quota
+// if not nil. Rejected clients are asked to retry after retryAfter,
+// DefaultRetryAfter if zero.
+func New(max int, retryAfter time.Duration, quota *Quota) *Controller {
+	if retryAfter <= 0 {
+		retryAfter = DefaultRetryAfter
+	}
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	return &Controller{max: int64(max), retryAfter: strconv.FormatInt(seconds, 10), quota: quota}
+}
+
+// Acquire counts a new connection from the remote address, and returns
+// ErrTooManyConns or ErrQuotaExceeded if there was no room for it. A
+// connection that was not admitted is counted as rejected.
+func (c *Controller) Acquire(remote string) error {
+	err := ErrTooManyConns
+	if atomic.AddInt64(&c.active, 1) <= c.max {
+		if c.quota == nil || c.quota.acquire(remote) {
+			return nil
+		}
+		err = ErrQuotaExceeded
+	}
+	atomic.AddInt64(&c.active, -1)
+	atomic.AddInt64(&c.rejected, 1)
+	return err
+}
+
+// Claim counts a connection from the remote address whether there is room
+// for it or not, as for the connections taken over from another process.
+func (c *Controller) Claim(remote string) {
+	atomic.AddInt64(&c.active, 1)
+	if c.quota != nil {
+		c.quota.claim(remote)
+	}
+}
+
+// Release uncounts a connection from the remote address that was acquired
+// or claimed.
+func (c *Controller) Release(remote string) {
+	atomic.AddInt64(&c.active, -1)
+	if c.quota != nil {
+		c.quota.release(remote)
+	}
+}
+
+// Max returns the number of connections admitted.
+func (c *Controller) Max() int {
+	return int(c.max)
+}
+
+// Active returns the number of connections counted.
+func (c *Controller) Active() int {
+	return int(atomic.LoadInt64(&c.active))
+}
+
+// Rejected returns the number of connections that were not admitted.
+func (c *Controller) Rejected() int64 {
+	return atomic.LoadInt64(&c.rejected)
+}
+
+// Status returns the HTTP status of an upgrade rejected with err: 429 Too
+// Many Requests for ErrQuotaExceeded, 503 Service Unavailable otherwise.
+func (c *Controller) Status(err error) int {
+	if err == ErrQuotaExceeded {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusServiceUnavailable
+}
+
+// Header returns the headers of a rejected upgrade.
+func (c *Controller) Header() http.Header {
+	return http.Header{"Retry-After": {c.retryAfter}}
+}
+
+// Reject answers an upgrade that Acquire rejected with err.
+func (c *Controller) Reject(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", c.retryAfter)
+	http.Error(w, err.Error(), c.Status(err))
+}
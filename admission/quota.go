@@ -0,0 +1,192 @@
+package admission
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// DefaultAllow is the network of the Docker bridge the clients started by
+// setup.sh connect from.
+const DefaultAllow = "172.17.0.0/16"
+
+// Quota caps the connections of each client address, and of each subnet
+// of addresses, so that a single host cannot take every connection of a
+// server. Clients in an Allow network, such as the load generators, are
+// counted but never capped. A Quota serves the live counts as JSON.
+type Quota struct {
+	// PerIP and PerSubnet are the number of connections allowed per
+	// address and per subnet, unlimited if zero.
+	PerIP     int
+	PerSubnet int
+	// IPv4Prefix and IPv6Prefix are the prefix lengths of the subnets,
+	// /24 and /64 if zero.
+	IPv4Prefix int
+	IPv6Prefix int
+	// Allow lists the networks whose clients are not capped.
+	Allow []*net.IPNet
+
+	// mu guards ips and subnets, which count connections by address and
+	// by subnet.
+	mu       sync.Mutex
+	ips      map[string]int
+	subnets  map[string]int
+	rejected int64
+}
+
+// ParseNetworks parses a comma separated list of CIDR networks, or of
+// addresses standing for themselves.
+func ParseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, f := range strings.Split(s, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if !strings.Contains(f, "/") {
+			ip := net.ParseIP(f)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: f}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// client is the address a connection is counted under, and its subnet.
+type client struct {
+	ip      string
+	subnet  string
+	allowed bool
+}
+
+// clientOf returns the client remote connected from, as given by
+// net.Conn.RemoteAddr or http.Request.RemoteAddr.
+func (q *Quota) clientOf(remote string) client {
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return client{ip: host, subnet: host}
+	}
+	mask := net.CIDRMask(prefix(q.IPv6Prefix, 64), 8*net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+		mask = net.CIDRMask(prefix(q.IPv4Prefix, 24), 8*net.IPv4len)
+	}
+	subnet := &net.IPNet{IP: ip.Mask(mask), Mask: mask}
+	c := client{ip: ip.String(), subnet: subnet.String()}
+	for _, n := range q.Allow {
+		if n.Contains(ip) {
+			c.allowed = true
+			break
+		}
+	}
+	return c
+}
+
+func prefix(bits, def int) int {
+	if bits <= 0 {
+		return def
+	}
+	return bits
+}
+
+// acquire counts a connection from remote, and reports whether its
+// address and subnet were under their quota.
+func (q *Quota) acquire(remote string) bool {
+	c := q.clientOf(remote)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !c.allowed && (q.PerIP > 0 && q.ips[c.ip] >= q.PerIP || q.PerSubnet > 0 && q.subnets[c.subnet] >= q.PerSubnet) {
+		atomic.AddInt64(&q.rejected, 1)
+		return false
+	}
+	q.add(c, 1)
+	return true
+}
+
+// claim counts a connection from remote whether it is under quota or not.
+func (q *Quota) claim(remote string) {
+	c := q.clientOf(remote)
+	q.mu.Lock()
+	q.add(c, 1)
+	q.mu.Unlock()
+}
+
+// release uncounts a connection from remote.
+func (q *Quota) release(remote string) {
+	c := q.clientOf(remote)
+	q.mu.Lock()
+	q.add(c, -1)
+	q.mu.Unlock()
+}
+
+// add adds n to the counts of c, forgetting the clients left without
+// connections. q.mu must be held.
+func (q *Quota) add(c client, n int) {
+	if q.ips == nil {
+		q.ips = make(map[string]int)
+		q.subnets = make(map[string]int)
+	}
+	if q.ips[c.ip] += n; q.ips[c.ip] <= 0 {
+		delete(q.ips, c.ip)
+	}
+	if q.subnets[c.subnet] += n; q.subnets[c.subnet] <= 0 {
+		delete(q.subnets, c.subnet)
+	}
+}
+
+// QuotaStats are the live counts of a Quota.
+type QuotaStats struct {
+	// IPs and Subnets count connections by address and by subnet.
+	IPs     map[string]int `json:"ips"`
+	Subnets map[string]int `json:"subnets"`
+	// Rejected is the number of connections refused for exceeding the
+	// quota.
+	Rejected int64 `json:"rejected"`
+}
+
+// Stats returns the counts of the client connected from ip, or of every
+// client if ip is empty.
+func (q *Quota) Stats(ip string) QuotaStats {
+	st := QuotaStats{IPs: make(map[string]int), Subnets: make(map[string]int), Rejected: atomic.LoadInt64(&q.rejected)}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if ip != "" {
+		c := q.clientOf(ip)
+		st.IPs[c.ip] = q.ips[c.ip]
+		st.Subnets[c.subnet] = q.subnets[c.subnet]
+		return st
+	}
+	for k, v := range q.ips {
+		st.IPs[k] = v
+	}
+	for k, v := range q.subnets {
+		st.Subnets[k] = v
+	}
+	return st
+}
+
+// ServeHTTP writes the Stats of the client given by the ip query
+// parameter, or of every client.
+func (q *Quota) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q.Stats(r.URL.Query().Get("ip")))
+}
@@ -0,0 +1,213 @@
+package admission
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestParseNetworks(t *testing.T) {
+	tests := []struct {
+		s    string
+		want []string
+		ok   bool
+	}{
+		{"", nil, true},
+		{"10.0.0.0/8", []string{"10.0.0.0/8"}, true},
+		{" 10.1.2.3/16 , 192.168.0.1", []string{"10.1.0.0/16", "192.168.0.1/32"}, true},
+		{"::1", []string{"::1/128"}, true},
+		{"fd00::/8,", []string{"fd00::/8"}, true},
+		{"10.0.0.300", nil, false},
+		{"10.0.0.0/33", nil, false},
+	}
+	for _, tt := range tests {
+		networks, err := ParseNetworks(tt.s)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseNetworks(%q): error %v", tt.s, err)
+			continue
+		}
+		if len(networks) != len(tt.want) {
+			t.Errorf("ParseNetworks(%q) = %v, want %v", tt.s, networks, tt.want)
+			continue
+		}
+		for i, n := range networks {
+			if n.String() != tt.want[i] {
+				t.Errorf("ParseNetworks(%q) = %v, want %v", tt.s, networks, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestClientOf(t *testing.T) {
+	allow, _ := ParseNetworks("172.17.0.0/16")
+	q := &Quota{Allow: allow}
+	tests := []struct {
+		remote string
+		want   client
+	}{
+		{"10.1.2.3:4000", client{ip: "10.1.2.3", subnet: "10.1.2.0/24"}},
+		{"10.1.2.3", client{ip: "10.1.2.3", subnet: "10.1.2.0/24"}},
+		{"[2001:db8::1]:4000", client{ip: "2001:db8::1", subnet: "2001:db8::/64"}},
+		{"[::ffff:10.1.2.3]:4000", client{ip: "10.1.2.3", subnet: "10.1.2.0/24"}},
+		{"172.17.0.5:4000", client{ip: "172.17.0.5", subnet: "172.17.0.0/24", allowed: true}},
+		{"@", client{ip: "@", subnet: "@"}},
+	}
+	for _, tt := range tests {
+		if got := q.clientOf(tt.remote); got != tt.want {
+			t.Errorf("clientOf(%q) = %+v, want %+v", tt.remote, got, tt.want)
+		}
+	}
+	q = &Quota{IPv4Prefix: 16, IPv6Prefix: 48}
+	if got := q.clientOf("10.1.2.3:1").subnet; got != "10.1.0.0/16" {
+		t.Errorf("/16 subnet of 10.1.2.3 is %v", got)
+	}
+	if got := q.clientOf("[2001:db8:1:2::1]:1").subnet; got != "2001:db8:1::/48" {
+		t.Errorf("/48 subnet of 2001:db8:1:2::1 is %v", got)
+	}
+}
+
+// op is a call of a Quota: acquire, claim or release of a connection from
+// remote, and whether acquire succeeds.
+type op struct {
+	call   string
+	remote string
+	ok     bool
+}
+
+func TestQuota(t *testing.T) {
+	allow, _ := ParseNetworks("172.17.0.0/16")
+	tests := []struct {
+		name     string
+		q        *Quota
+		ops      []op
+		rejected int64
+	}{
+		{
+			name: "per address",
+			q:    &Quota{PerIP: 2},
+			ops: []op{
+				{"acquire", "10.0.0.1:1", true},
+				{"acquire", "10.0.0.1:2", true},
+				{"acquire", "10.0.0.1:3", false},
+				{"acquire", "10.0.0.2:1", true},
+				{"release", "10.0.0.1:1", true},
+				{"acquire", "10.0.0.1:4", true},
+			},
+			rejected: 1,
+		},
+		{
+			name: "per subnet",
+			q:    &Quota{PerSubnet: 2},
+			ops: []op{
+				{"acquire", "10.0.0.1:1", true},
+				{"acquire", "10.0.0.2:1", true},
+				{"acquire", "10.0.0.3:1", false},
+				{"acquire", "10.0.1.1:1", true},
+			},
+			rejected: 1,
+		},
+		{
+			name: "allowed networks are not capped",
+			q:    &Quota{PerIP: 1, Allow: allow},
+			ops: []op{
+				{"acquire", "172.17.0.2:1", true},
+				{"acquire", "172.17.0.2:2", true},
+				{"acquire", "10.0.0.1:1", true},
+				{"acquire", "10.0.0.1:2", false},
+			},
+			rejected: 1,
+		},
+		{
+			name: "claims count beyond the quota",
+			q:    &Quota{PerIP: 1},
+			ops: []op{
+				{"claim", "10.0.0.1:1", true},
+				{"claim", "10.0.0.1:2", true},
+				{"acquire", "10.0.0.1:3", false},
+				{"release", "10.0.0.1:1", true},
+				{"acquire", "10.0.0.1:3", false},
+				{"release", "10.0.0.1:2", true},
+				{"acquire", "10.0.0.1:3", true},
+			},
+			rejected: 2,
+		},
+	}
+	for _, tt := range tests {
+		for i, o := range tt.ops {
+			ok := true
+			switch o.call {
+			case "acquire":
+				ok = tt.q.acquire(o.remote)
+			case "claim":
+				tt.q.claim(o.remote)
+			case "release":
+				tt.q.release(o.remote)
+			}
+			if ok != o.ok {
+				t.Errorf("%v: op %v: %v %v = %v, want %v", tt.name, i, o.call, o.remote, ok, o.ok)
+			}
+		}
+		if st := tt.q.Stats(""); st.Rejected != tt.rejected {
+			t.Errorf("%v: %v rejected, want %v", tt.name, st.Rejected, tt.rejected)
+		}
+	}
+}
+
+func TestQuotaStats(t *testing.T) {
+	q := &Quota{}
+	q.acquire("10.0.0.1:1")
+	q.acquire("10.0.0.1:2")
+	q.acquire("10.0.0.2:1")
+	q.release("10.0.0.2:1")
+
+	st := q.Stats("")
+	if len(st.IPs) != 1 || st.IPs["10.0.0.1"] != 2 {
+		t.Errorf("IPs %v, want only 10.0.0.1 with 2", st.IPs)
+	}
+	if len(st.Subnets) != 1 || st.Subnets["10.0.0.0/24"] != 2 {
+		t.Errorf("subnets %v, want only 10.0.0.0/24 with 2", st.Subnets)
+	}
+	st = q.Stats("10.0.0.2")
+	if st.IPs["10.0.0.2"] != 0 || st.Subnets["10.0.0.0/24"] != 2 {
+		t.Errorf("stats of 10.0.0.2: %+v", st)
+	}
+}
+
+func TestController(t *testing.T) {
+	c := New(2, 1500*time.Millisecond, &Quota{PerIP: 1})
+	if err := c.Acquire("10.0.0.1:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Acquire("10.0.0.1:2"); err != ErrQuotaExceeded {
+		t.Errorf("second connection of an address: %v, want %v", err, ErrQuotaExceeded)
+	}
+	if err := c.Acquire("10.0.0.2:1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Acquire("10.0.0.3:1"); err != ErrTooManyConns {
+		t.Errorf("connection beyond the maximum: %v, want %v", err, ErrTooManyConns)
+	}
+	if c.Active() != 2 || c.Rejected() != 2 {
+		t.Errorf("%v active and %v rejected, want 2 and 2", c.Active(), c.Rejected())
+	}
+	c.Claim("10.0.0.3:1")
+	if c.Active() != 3 {
+		t.Errorf("%v active after a claim, want 3", c.Active())
+	}
+	c.Release("10.0.0.3:1")
+	c.Release("10.0.0.1:1")
+	if err := c.Acquire("10.0.0.1:3"); err != nil {
+		t.Errorf("connection after a release: %v", err)
+	}
+
+	if s := c.Status(ErrQuotaExceeded); s != http.StatusTooManyRequests {
+		t.Errorf("status %v for an exceeded quota", s)
+	}
+	if s := c.Status(ErrTooManyConns); s != http.StatusServiceUnavailable {
+		t.Errorf("status %v for too many connections", s)
+	}
+	if h := c.Header().Get("Retry-After"); h != "2" {
+		t.Errorf("Retry-After %q, want 2", h)
+	}
+}
@@ -0,0 +1,141 @@
+// Package client is the load generator opening connections to a server and
+// sending each a message in turn, run by 1mws client.
+package client
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/eranyanay/1m-go-websockets/config"
+	"github.com/gorilla/websocket"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+var (
+	flags = config.NewFlagSet("client")
+	cfg   = config.New()
+
+	ip          = flags.String("ip", "127.0.0.1", "server IP")
+	connections = flags.Int("conn", 1, "number of websocket connections")
+	secure      = flags.Bool("tls", false, "connect with wss://")
+	serverName  = flags.String("server-name", "", "server name to ask for over TLS, -ip if empty")
+	insecure    = flags.Bool("insecure", false, "accept any server certificate, such as a self-signed one")
+)
+
+// Main runs the client with the command line arguments args.
+func Main(args []string) error {
+	cfg.Pprof = ""
+	cfg.Register(flags)
+	flags.Usage = func() {
+		io.WriteString(flags.Output(), `Websockets client generator
+Example usage: 1mws client -ip=172.17.0.1 -conn=10
+`)
+		flags.PrintDefaults()
+		fmt.Fprintf(flags.Output(), "Every flag may also be set as %sNAME in the environment, such as %s for -conn.\n", config.EnvPrefix, config.EnvName("conn"))
+	}
+	if err := config.Parse(flags, args); err != nil {
+		return err
+	}
+	if err := cfg.Setup(); err != nil {
+		return err
+	}
+	cfg.ServePprof()
+
+	// Connect to the port servers listen on
+	_, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return err
+	}
+	u := url.URL{Scheme: "ws", Host: net.JoinHostPort(*ip, port), Path: "/"}
+	dialer := *websocket.DefaultDialer
+	if *secure {
+		u.Scheme = "wss"
+		dialer.TLSClientConfig = &tls.Config{ServerName: *serverName, InsecureSkipVerify: *insecure}
+	}
+	log.Printf("Connecting to %s", u.String())
+
+	startTime := time.Now()
+	var conns []*websocket.Conn
+	for i := 0; i < *connections; i++ {
+		c, _, err := dialer.Dial(u.String(), nil)
+		if err != nil {
+			fmt.Println("Failed to connect", i, err)
+			break
+		}
+		conns = append(conns, c)
+	}
+	defer closeAll(conns)
+
+	// Stop sending on Ctrl-C so the connections are closed properly
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+
+	finishTimeNeeded := time.Since(startTime)
+	log.Printf("Setup %v connections time needed: %v", *connections, finishTimeNeeded)
+
+	log.Printf("Finished initializing %d connections", len(conns))
+	tts := time.Second
+	if *connections > 100 {
+		tts = time.Millisecond * 5
+	}
+	// Connections closed by the server are dropped from active; all of them
+	// are closed on return.
+	active := append([]*websocket.Conn(nil), conns...)
+	for len(active) > 0 {
+		for i := 0; i < len(active); i++ {
+			select {
+			case <-stop:
+				log.Printf("Interrupted, closing %d connections", len(active))
+				return nil
+			case <-time.After(tts):
+			}
+			conn := active[i]
+			sendTime := time.Now()
+			msg := fmt.Sprintf("Hello from client, sent at %s", sendTime.Format(time.RFC3339Nano))
+			cfg.Messagef("client msg: %s", msg)
+			if err := conn.WriteMessage(websocket.TextMessage, []byte(msg)); err != nil {
+				log.Printf("Failed to send message: %v", err)
+				active = append(active[:i], active[i+1:]...)
+				i--
+				continue
+			}
+
+			_, response, err := conn.ReadMessage()
+			if err != nil {
+				// A close frame from the server was already answered by
+				// the default close handler; the connection is done.
+				log.Printf("Failed to read message: %v", err)
+				active = append(active[:i], active[i+1:]...)
+				i--
+				continue
+			}
+
+			//serverTime, _ := time.Parse(time.RFC3339Nano, string(response))
+			cfg.Messagef("server msg: %s", string(response))
+			latency := time.Since(sendTime)
+			cfg.Messagef("Round-trip latency: %v", latency)
+		}
+	}
+	log.Printf("All connections were closed by the server")
+	return nil
+}
+
+// closeAll starts the closing handshake of every connection and gives the
+// server a second to answer before closing them.
+func closeAll(conns []*websocket.Conn) {
+	for _, c := range conns {
+		c.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	}
+	if len(conns) > 0 {
+		time.Sleep(time.Second)
+	}
+	for _, c := range conns {
+		c.Close()
+	}
+}
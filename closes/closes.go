@@ -0,0 +1,189 @@
+// Package closes classifies why the connections of the example servers are
+// closed, and counts the closes for logging and metrics. Each server maps
+// the errors of its websocket library to a Reason and a Violation.
+package closes
+
+import (
+	"fmt"
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"github.com/gobwas/ws"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Linger is how long a connection the server closes for misbehaving is
+// given to answer its close frame. Closing the socket while the peer is
+// still sending would reset the connection and could drop the frame on its
+// way, so what the peer sends meanwhile is dropped instead.
+const Linger = 2 * time.Second
+
+// Reason classifies why a connection was closed.
+type Reason int
+
+const (
+	// Kick is a connection closed by the application.
+	Kick Reason = iota
+	// Peer is a connection closed by the peer with a close frame.
+	Peer
+	// PeerGone is a connection the peer shut down without a close frame.
+	PeerGone
+	// ProtocolError is a connection that violated the protocol.
+	ProtocolError
+	// Reset is a connection reset by the peer.
+	Reset
+	// Timeout is a connection that was idle for too long or did not
+	// answer a heartbeat.
+	Timeout
+	// RateLimit is a connection that exceeded the rate limit.
+	RateLimit
+	// Error is a connection that failed with any other error.
+	Error
+
+	// NumReasons is the number of reasons.
+	NumReasons
+)
+
+var reasonNames = [NumReasons]string{
+	Kick:          "kick",
+	Peer:          "peer_close",
+	PeerGone:      "peer_gone",
+	ProtocolError: "protocol_error",
+	Reset:         "reset",
+	Timeout:       "timeout",
+	RateLimit:     "rate_limit",
+	Error:         "error",
+}
+
+func (r Reason) String() string {
+	if r < 0 || r >= NumReasons {
+		return "unknown"
+	}
+	return reasonNames[r]
+}
+
+// Violation classifies how a connection violated the protocol.
+type Violation int
+
+const (
+	// Unmasked is a frame sent without a mask.
+	Unmasked Violation = iota
+	// ReservedBits is a frame setting reserved bits that no extension
+	// negotiated.
+	ReservedBits
+	// ReservedOpCode is a frame with a reserved opcode.
+	ReservedOpCode
+	// ControlFrame is a fragmented or oversized control frame.
+	ControlFrame
+	// UnexpectedFrame is a continuation frame outside of a fragmented
+	// message, or a data frame inside one.
+	UnexpectedFrame
+	// Compression is an invalid compressed message, or a compressed
+	// control or continuation frame.
+	Compression
+	// CloseFrame is a close frame with an invalid status code.
+	CloseFrame
+	// InvalidUTF8 is a text message or a close reason that is not valid
+	// UTF-8.
+	InvalidUTF8
+	// FrameTooBig is a frame larger than the server accepts.
+	FrameTooBig
+	// MessageTooBig is a message larger than the server accepts.
+	MessageTooBig
+
+	// NumViolations is the number of violations.
+	NumViolations
+)
+
+var violationNames = [NumViolations]string{
+	Unmasked:        "unmasked",
+	ReservedBits:    "reserved_bits",
+	ReservedOpCode:  "reserved_opcode",
+	ControlFrame:    "control_frame",
+	UnexpectedFrame: "unexpected_frame",
+	Compression:     "compression",
+	CloseFrame:      "close_frame",
+	InvalidUTF8:     "invalid_utf8",
+	FrameTooBig:     "frame_too_big",
+	MessageTooBig:   "message_too_big",
+}
+
+func (v Violation) String() string {
+	if v < 0 || v >= NumViolations {
+		return "unknown"
+	}
+	return violationNames[v]
+}
+
+// Code returns the status code of the close frame a connection is sent
+// when it commits v.
+func (v Violation) Code() ws.StatusCode {
+	switch v {
+	case InvalidUTF8:
+		return ws.StatusInvalidFramePayloadData
+	case FrameTooBig, MessageTooBig:
+		return ws.StatusMessageTooBig
+	}
+	return ws.StatusProtocolError
+}
+
+// Counts counts closed connections by reason, and the ones that violated
+// the protocol by violation. The zero value is ready to use.
+type Counts struct {
+	reasons    [NumReasons]int64
+	violations [NumViolations]int64
+}
+
+// Add counts a connection closed for r.
+func (c *Counts) Add(r Reason) {
+	atomic.AddInt64(&c.reasons[r], 1)
+}
+
+// AddViolation counts a connection closed for committing v.
+func (c *Counts) AddViolation(v Violation) {
+	atomic.AddInt64(&c.violations[v], 1)
+}
+
+// Closes returns the number of connections closed for r.
+func (c *Counts) Closes(r Reason) int64 {
+	return atomic.LoadInt64(&c.reasons[r])
+}
+
+// Violations returns the number of connections closed for committing v.
+func (c *Counts) Violations(v Violation) int64 {
+	return atomic.LoadInt64(&c.violations[v])
+}
+
+// Register adds the ws_closes_total and ws_violations_total counters to
+// set, read from c when scraped.
+func (c *Counts) Register(set *metrics.Set) {
+	load := func(v *int64) func() float64 {
+		return func() float64 {
+			return float64(atomic.LoadInt64(v))
+		}
+	}
+	for r := Reason(0); r < NumReasons; r++ {
+		set.NewCounterFunc(`ws_closes_total{reason="`+r.String()+`"}`, "Connections closed, by reason.", load(&c.reasons[r]))
+	}
+	for v := Violation(0); v < NumViolations; v++ {
+		set.NewCounterFunc(`ws_violations_total{violation="`+v.String()+`"}`, "Connections closed for violating the protocol, by violation.", load(&c.violations[v]))
+	}
+}
+
+// CloseSummary formats the closes by reason for logging.
+func (c *Counts) CloseSummary() string {
+	parts := make([]string, NumReasons)
+	for r := Reason(0); r < NumReasons; r++ {
+		parts[r] = fmt.Sprintf("%v=%v", r, c.Closes(r))
+	}
+	return strings.Join(parts, " ")
+}
+
+// ViolationSummary formats the closes by violation for logging.
+func (c *Counts) ViolationSummary() string {
+	parts := make([]string, NumViolations)
+	for v := Violation(0); v < NumViolations; v++ {
+		parts[v] = fmt.Sprintf("%v=%v", v, c.Violations(v))
+	}
+	return strings.Join(parts, " ")
+}
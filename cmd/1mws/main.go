@@ -0,0 +1,67 @@
+// Command 1mws runs any stage of the demo, or the client, from a single
+// binary, so that implementations can be switched without rebuilding:
+//
+//	1mws <command> [flags]
+//
+// Every command shares the -listen, -pprof, -log-file, -log-messages and
+// -memory-limit flags, and the servers from stage 2 on the connection
+// limit flags. Flags may also be set in the environment, as in
+// WS_LISTEN=:9000.
+package main
+
+import (
+	"fmt"
+	"github.com/eranyanay/1m-go-websockets/0_simple_web_server"
+	"github.com/eranyanay/1m-go-websockets/1_ws_example"
+	"github.com/eranyanay/1m-go-websockets/2_ws_ulimit"
+	"github.com/eranyanay/1m-go-websockets/3_optimize_ws_goroutines"
+	"github.com/eranyanay/1m-go-websockets/4_optimize_gobwas"
+	"github.com/eranyanay/1m-go-websockets/5_signaling"
+	"github.com/eranyanay/1m-go-websockets/client"
+	"log"
+	"os"
+)
+
+type command struct {
+	name string
+	help string
+	main func(args []string) error
+}
+
+var commands = []command{
+	{"simple", "plain net/http server", simple.Main},
+	{"example", "gorilla websocket server with no connection limit", example.Main},
+	{"goroutine", "gorilla websocket server with a goroutine per connection", goroutine.Main},
+	{"epoll-gorilla", "gorilla websocket server reading connections from epoll", epollgorilla.Main},
+	{"epoll-gobwas", "gobwas/ws server reading connections from epoll", epollgobwas.Main},
+	{"signaling", "WebRTC signaling server relaying messages between callers", signaling.Main},
+	{"client", "load generator opening connections and sending messages", client.Main},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: 1mws <command> [flags]\n\nCommands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.help)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun 1mws <command> -h for the flags of a command.\n")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	for _, c := range commands {
+		if c.name == os.Args[1] {
+			if err := c.main(os.Args[2:]); err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	}
+	if arg := os.Args[1]; arg != "-h" && arg != "-help" && arg != "--help" && arg != "help" {
+		fmt.Fprintf(os.Stderr, "1mws: unknown command %q\n\n", arg)
+	}
+	usage()
+	os.Exit(2)
+}
@@ -0,0 +1,136 @@
+// Package config holds the settings shared by the subcommands of 1mws:
+// the addresses to listen on, logging, memory and connection limits. Every
+// flag of a subcommand, shared or not, may also be set in the environment,
+// as WS_ followed by its name in upper case with dashes turned into
+// underscores, such as WS_MAX_CONNS for -max-conns. Flags given on the
+// command line take precedence.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	_ "net/http/pprof"
+	"os"
+	"strings"
+)
+
+// EnvPrefix starts the names of the environment variables read by Parse.
+const EnvPrefix = "WS_"
+
+// Config is the configuration shared by the servers and the client.
+type Config struct {
+	// Listen is the address servers accept connections on, and the port
+	// of which the client connects to.
+	Listen string
+	// Pprof is the address of the pprof listener, which also serves the
+	// metrics and debug handlers. It is disabled if empty.
+	Pprof string
+	// LogFile is the file logs are appended to, stderr if empty.
+	LogFile string
+	// LogMessages enables the log line written for every message.
+	LogMessages bool
+	// MemoryLimit is the heap size the garbage collector is tuned for, in
+	// bytes, or zero to leave it alone.
+	MemoryLimit int64
+}
+
+// New returns the default configuration. Subcommands may change the
+// defaults before registering the flags.
+func New() *Config {
+	return &Config{
+		Listen:      ":8000",
+		Pprof:       "localhost:6060",
+		LogMessages: true,
+	}
+}
+
+// Register defines the flags of c in fs, with the current values of c as
+// defaults.
+func (c *Config) Register(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "address the servers accept connections on, and the client connects to the port of")
+	fs.StringVar(&c.Pprof, "pprof", c.Pprof, "address of the pprof, metrics and debug listener, disabled if empty")
+	fs.StringVar(&c.LogFile, "log-file", c.LogFile, "file logs are appended to, stderr if empty")
+	fs.BoolVar(&c.LogMessages, "log-messages", c.LogMessages, "log every message, which slows down servers at high rates")
+	fs.Int64Var(&c.MemoryLimit, "memory-limit", c.MemoryLimit, "heap size in bytes the garbage collector is tuned for, 0 leaves it alone")
+}
+
+// Setup applies c once parsed: it redirects logs to LogFile and tunes the
+// garbage collector for MemoryLimit.
+func (c *Config) Setup() error {
+	if c.LogFile != "" {
+		f, err := os.OpenFile(c.LogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		log.SetOutput(f)
+	}
+	if c.MemoryLimit > 0 {
+		previousLimit := SetMemoryLimit(c.MemoryLimit)
+		log.Printf("Previous memory limit: %v", previousLimit)
+	}
+	return nil
+}
+
+// ServePprof serves pprof and the handlers of http.DefaultServeMux on
+// c.Pprof, unless it is empty.
+func (c *Config) ServePprof() {
+	if c.Pprof == "" {
+		return
+	}
+	go func() {
+		if err := http.ListenAndServe(c.Pprof, nil); err != nil {
+			log.Fatalf("Pprof failed: %v", err)
+		}
+	}()
+}
+
+// Messagef logs a line about a single message, unless LogMessages is off.
+func (c *Config) Messagef(format string, v ...interface{}) {
+	if c.LogMessages {
+		log.Printf(format, v...)
+	}
+}
+
+// NewFlagSet returns the flag set of the named subcommand, whose usage
+// mentions the environment variables.
+func NewFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage of 1mws %s:\n", name)
+		fs.PrintDefaults()
+		fmt.Fprintf(fs.Output(), "Every flag may also be set as %sNAME in the environment, such as %s for -listen.\n", EnvPrefix, EnvName("listen"))
+	}
+	return fs
+}
+
+// Parse parses the flags of fs from args, then sets the ones that were
+// not given from the environment.
+func Parse(fs *flag.FlagSet, args []string) error {
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := EnvName(f.Name)
+		if v, ok := os.LookupEnv(name); ok {
+			if serr := fs.Set(f.Name, v); serr != nil {
+				err = fmt.Errorf("invalid %v: %v", name, serr)
+			}
+		}
+	})
+	return err
+}
+
+// EnvName returns the environment variable of the flag called name.
+func EnvName(name string) string {
+	return EnvPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestEnvName(t *testing.T) {
+	tests := []struct {
+		name, want string
+	}{
+		{"listen", "WS_LISTEN"},
+		{"max-conns", "WS_MAX_CONNS"},
+		{"tls-cert", "WS_TLS_CERT"},
+	}
+	for _, tt := range tests {
+		if got := EnvName(tt.name); got != tt.want {
+			t.Errorf("EnvName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want Config
+		ok   bool
+	}{
+		{
+			name: "defaults",
+			want: *New(),
+			ok:   true,
+		},
+		{
+			name: "environment",
+			env:  map[string]string{"WS_LISTEN": ":9000", "WS_LOG_MESSAGES": "false", "WS_MEMORY_LIMIT": "1024"},
+			want: Config{Listen: ":9000", Pprof: "localhost:6060", MemoryLimit: 1024},
+			ok:   true,
+		},
+		{
+			name: "flags take precedence",
+			args: []string{"-listen=:9001", "-pprof="},
+			env:  map[string]string{"WS_LISTEN": ":9000", "WS_PPROF": "localhost:7070"},
+			want: Config{Listen: ":9001", LogMessages: true},
+			ok:   true,
+		},
+		{
+			name: "invalid environment",
+			env:  map[string]string{"WS_MEMORY_LIMIT": "lots"},
+		},
+	}
+	for _, tt := range tests {
+		for k, v := range tt.env {
+			os.Setenv(k, v)
+		}
+		c := New()
+		fs := NewFlagSet("test")
+		c.Register(fs)
+		err := Parse(fs, tt.args)
+		for k := range tt.env {
+			os.Unsetenv(k)
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: error %v", tt.name, err)
+			continue
+		}
+		if tt.ok && *c != tt.want {
+			t.Errorf("%v: %+v, want %+v", tt.name, *c, tt.want)
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package config
+
+import (
+	"flag"
+	"github.com/eranyanay/1m-go-websockets/admission"
+	"log"
+	"time"
+)
+
+// Limits bounds the connections a server accepts, in total and per client.
+type Limits struct {
+	// MaxConns is the maximum number of connections, as many as the file
+	// descriptor limit leaves room for once ReservedFDs are set aside if
+	// zero. Rejected clients are asked to retry after RetryAfter.
+	MaxConns    int
+	ReservedFDs int
+	RetryAfter  time.Duration
+	// IPQuota and SubnetQuota cap the connections per client address and
+	// per subnet of SubnetPrefix bits, except for the QuotaAllow networks.
+	IPQuota      int
+	SubnetQuota  int
+	SubnetPrefix int
+	QuotaAllow   string
+}
+
+// NewLimits returns the default limits.
+func NewLimits() *Limits {
+	return &Limits{
+		ReservedFDs:  admission.DefaultReserved,
+		RetryAfter:   admission.DefaultRetryAfter,
+		SubnetPrefix: 24,
+		QuotaAllow:   admission.DefaultAllow,
+	}
+}
+
+// Register defines the flags of l in fs, with the current values of l as
+// defaults.
+func (l *Limits) Register(fs *flag.FlagSet) {
+	fs.IntVar(&l.MaxConns, "max-conns", l.MaxConns, "maximum number of connections, as many as the file descriptor limit allows if 0")
+	fs.IntVar(&l.ReservedFDs, "reserved-fds", l.ReservedFDs, "file descriptors kept out of the connection limit for the pprof listener, log files and pollers")
+	fs.DurationVar(&l.RetryAfter, "retry-after", l.RetryAfter, "time clients rejected with 503 are asked to wait before reconnecting")
+	fs.IntVar(&l.IPQuota, "ip-quota", l.IPQuota, "maximum number of connections per client address, 0 disables it")
+	fs.IntVar(&l.SubnetQuota, "subnet-quota", l.SubnetQuota, "maximum number of connections per client subnet, 0 disables it")
+	fs.IntVar(&l.SubnetPrefix, "subnet-prefix", l.SubnetPrefix, "prefix length of the IPv4 subnets -subnet-quota applies to, IPv6 subnets are /64")
+	fs.StringVar(&l.QuotaAllow, "quota-allow", l.QuotaAllow, "comma separated networks whose clients are exempt from the quotas, such as the load generators")
+}
+
+// Admission raises the file descriptor limit and returns the controller
+// admitting connections within it and the client quotas, along with the
+// quota, which serves the live counts of the clients.
+func (l *Limits) Admission() (*admission.Controller, *admission.Quota, error) {
+	limit, err := admission.Limit(l.MaxConns, l.ReservedFDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("Admitting up to %v connections", limit)
+	allow, err := admission.ParseNetworks(l.QuotaAllow)
+	if err != nil {
+		return nil, nil, err
+	}
+	quota := &admission.Quota{PerIP: l.IPQuota, PerSubnet: l.SubnetQuota, IPv4Prefix: l.SubnetPrefix, Allow: allow}
+	return admission.New(limit, l.RetryAfter, quota), quota, nil
+}
@@ -0,0 +1,27 @@
+package config
+
+import (
+	"runtime"
+	"runtime/debug"
+)
+
+// SetMemoryLimit sets a limit on the maximum memory usage of the Go program.
+// The limit is specified in bytes. Returns the previous limit.
+func SetMemoryLimit(limit int64) int64 {
+	// Estimate the current limit based on total memory and the current GC target percentage.
+	memStats := &runtime.MemStats{}
+	runtime.ReadMemStats(memStats)
+	previousLimit := int64(memStats.HeapAlloc) * 100 / int64(debug.SetGCPercent(-1))
+
+	// Calculate the new GC target percentage based on the desired memory limit.
+	// If the limit is zero, reset to default GC behavior.
+	if limit > 0 {
+		newGCTarget := int(int64(100*memStats.HeapAlloc) / limit)
+		debug.SetGCPercent(newGCTarget)
+	} else {
+		debug.SetGCPercent(100) // Reset to default
+	}
+
+	// Return the previous limit for reference.
+	return previousLimit
+}
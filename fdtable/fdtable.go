@@ -0,0 +1,115 @@
+// Package fdtable maps the file descriptors of connections to the values
+// the example servers keep for them. Descriptors are small integers reused
+// by the kernel as soon as they are closed, so the table is a slice indexed
+// by fd and every value carries a generation: an event reported for a
+// closed connection whose fd was already reused by a new one does not
+// match the generation of the new one and is dropped.
+//
+// Lookups are made by the event loops for every event, so they take no
+// lock: slots are read with atomic loads, and only Put and Remove are
+// serialized.
+package fdtable
+
+import (
+	"sync"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Table is a table of values by fd. The zero value is an empty table.
+type Table struct {
+	// mu serializes the writers of slots, which holds a []unsafe.Pointer
+	// to the entry of every fd, or nil.
+	mu    sync.Mutex
+	slots atomic.Value
+	gen   uint32
+}
+
+type entry struct {
+	gen uint32
+	v   interface{}
+}
+
+// Next returns a new generation to Put a value with. Generations are set
+// before the value is stored so that it can carry its own.
+func (t *Table) Next() uint32 {
+	return atomic.AddUint32(&t.gen, 1)
+}
+
+// Put stores v under fd with generation gen, replacing whatever was there.
+func (t *Table) Put(fd int, gen uint32, v interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slots := t.load()
+	if fd >= len(slots) {
+		n := 2 * len(slots)
+		if n <= fd {
+			n = fd + 1
+		}
+		grown := make([]unsafe.Pointer, n)
+		copy(grown, slots)
+		t.slots.Store(grown)
+		slots = grown
+	}
+	atomic.StorePointer(&slots[fd], unsafe.Pointer(&entry{gen: gen, v: v}))
+}
+
+// Get returns the value stored under fd with generation gen, or nil if the
+// event it was reported for is stale.
+func (t *Table) Get(fd int, gen uint32) interface{} {
+	e := t.entry(fd)
+	if e == nil || e.gen != gen {
+		return nil
+	}
+	return e.v
+}
+
+// Lookup returns the value stored under fd and its generation, whatever it
+// is, or nil.
+func (t *Table) Lookup(fd int) (interface{}, uint32) {
+	e := t.entry(fd)
+	if e == nil {
+		return nil, 0
+	}
+	return e.v, e.gen
+}
+
+// Remove clears fd unless it was stored with another generation since. It
+// reports whether it did, so that of concurrent calls only one does.
+func (t *Table) Remove(fd int, gen uint32) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if e := t.entry(fd); e == nil || e.gen != gen {
+		return false
+	}
+	atomic.StorePointer(&t.load()[fd], nil)
+	return true
+}
+
+// Range calls f for the values stored under fd from on, by increasing fd,
+// until f returns false.
+func (t *Table) Range(from int, f func(fd int, gen uint32, v interface{}) bool) {
+	slots := t.load()
+	if from < 0 {
+		from = 0
+	}
+	for fd := from; fd < len(slots); fd++ {
+		e := (*entry)(atomic.LoadPointer(&slots[fd]))
+		if e != nil && !f(fd, e.gen, e.v) {
+			return
+		}
+	}
+}
+
+func (t *Table) load() []unsafe.Pointer {
+	slots, _ := t.slots.Load().([]unsafe.Pointer)
+	return slots
+}
+
+func (t *Table) entry(fd int) *entry {
+	slots := t.load()
+	if fd < 0 || fd >= len(slots) {
+		return nil
+	}
+	return (*entry)(atomic.LoadPointer(&slots[fd]))
+}
@@ -0,0 +1,94 @@
+package fdtable
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestTable(t *testing.T) {
+	var tab Table
+	g1 := tab.Next()
+	tab.Put(3, g1, "a")
+	g2 := tab.Next()
+	tab.Put(100, g2, "b")
+
+	tests := []struct {
+		fd   int
+		gen  uint32
+		want interface{}
+	}{
+		{3, g1, "a"},
+		{3, g2, nil},
+		{100, g2, "b"},
+		{4, g1, nil},
+		{-1, g1, nil},
+		{1000, g1, nil},
+	}
+	for _, tt := range tests {
+		if got := tab.Get(tt.fd, tt.gen); got != tt.want {
+			t.Errorf("Get(%v, %v) = %v, want %v", tt.fd, tt.gen, got, tt.want)
+		}
+	}
+
+	// The fd is reused: the stale generation neither finds nor removes
+	// the new value.
+	g3 := tab.Next()
+	tab.Put(3, g3, "c")
+	if got := tab.Get(3, g1); got != nil {
+		t.Errorf("Get with a stale generation = %v", got)
+	}
+	if tab.Remove(3, g1) {
+		t.Error("Remove with a stale generation succeeded")
+	}
+	if v, gen := tab.Lookup(3); v != "c" || gen != g3 {
+		t.Errorf("Lookup(3) = %v, %v, want c, %v", v, gen, g3)
+	}
+	if !tab.Remove(3, g3) {
+		t.Error("Remove failed")
+	}
+	if tab.Remove(3, g3) {
+		t.Error("second Remove succeeded")
+	}
+
+	var fds []int
+	tab.Range(0, func(fd int, gen uint32, v interface{}) bool {
+		fds = append(fds, fd)
+		return true
+	})
+	if len(fds) != 1 || fds[0] != 100 {
+		t.Errorf("Range visited %v, want [100]", fds)
+	}
+}
+
+func TestTableConcurrent(t *testing.T) {
+	var tab Table
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				fd := w*1000 + i
+				gen := tab.Next()
+				tab.Put(fd, gen, fd)
+				if got := tab.Get(fd, gen); got != fd {
+					t.Errorf("Get(%v) = %v", fd, got)
+					return
+				}
+				if i%2 == 0 && !tab.Remove(fd, gen) {
+					t.Errorf("Remove(%v) failed", fd)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	n := 0
+	tab.Range(0, func(fd int, gen uint32, v interface{}) bool {
+		n++
+		return true
+	})
+	if n != 2000 {
+		t.Errorf("%v values left, want 2000", n)
+	}
+}
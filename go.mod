@@ -3,7 +3,7 @@ module github.com/eranyanay/1m-go-websockets
 go 1.12
 
 require (
-	github.com/gobwas/httphead v0.0.0-20180130184737-2c6c146eadee // indirect
+	github.com/gobwas/httphead v0.0.0-20180130184737-2c6c146eadee
 	github.com/gobwas/pool v0.2.0 // indirect
 	github.com/gobwas/ws v1.0.3
 	github.com/gorilla/websocket v1.4.1
@@ -0,0 +1,262 @@
+// Package metrics exposes the counters of the example servers in the
+// Prometheus text format, so that they can be scraped from the pprof
+// listener instead of being logged every hundred connections. Metrics are
+// plain atomic values, or functions reading counters the servers keep
+// anyway, and cost nothing until scraped.
+//
+// Names may carry labels, as in ws_closes_total{reason="timeout"}: the
+// series sharing a name before the braces are written as a single family.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Default is the set served by the example servers on localhost:6060.
+var Default = NewSet()
+
+// Set is a group of metrics written together.
+type Set struct {
+	mu       sync.Mutex
+	families []*family
+	byName   map[string]*family
+}
+
+type family struct {
+	name   string
+	help   string
+	typ    string
+	series []series
+}
+
+type series struct {
+	name string
+	m    metric
+}
+
+// metric writes the samples of a series named name.
+type metric interface {
+	write(w *bufio.Writer, name string)
+}
+
+// NewSet creates an empty set.
+func NewSet() *Set {
+	return &Set{byName: make(map[string]*family)}
+}
+
+// register adds m to the family of name, which panics if a series of that
+// name exists already, or if the family was registered with another type.
+func (s *Set) register(name, help, typ string, m metric) {
+	base := name
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		base = name[:i]
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	f := s.byName[base]
+	if f == nil {
+		f = &family{name: base, help: help, typ: typ}
+		s.byName[base] = f
+		s.families = append(s.families, f)
+	}
+	if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %v registered as a %v and a %v", base, f.typ, typ))
+	}
+	for _, sr := range f.series {
+		if sr.name == name {
+			panic("metrics: duplicate series " + name)
+		}
+	}
+	f.series = append(f.series, series{name: name, m: m})
+}
+
+// NewCounter registers a counter.
+func (s *Set) NewCounter(name, help string) *Counter {
+	c := &Counter{}
+	s.register(name, help, "counter", c)
+	return c
+}
+
+// NewCounterFunc registers a counter whose value is returned by f.
+func (s *Set) NewCounterFunc(name, help string, f func() float64) {
+	s.register(name, help, "counter", valueFunc(f))
+}
+
+// NewGauge registers a gauge.
+func (s *Set) NewGauge(name, help string) *Gauge {
+	g := &Gauge{}
+	s.register(name, help, "gauge", g)
+	return g
+}
+
+// NewGaugeFunc registers a gauge whose value is returned by f.
+func (s *Set) NewGaugeFunc(name, help string, f func() float64) {
+	s.register(name, help, "gauge", valueFunc(f))
+}
+
+// NewHistogram registers a histogram with the given bucket upper bounds,
+// in increasing order.
+func (s *Set) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{bounds: buckets, counts: make([]uint64, len(buckets))}
+	s.register(name, help, "histogram", h)
+	return h
+}
+
+// ServeHTTP writes every metric of s.
+func (s *Set) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	bw := bufio.NewWriter(w)
+	s.mu.Lock()
+	families := append([]*family(nil), s.families...)
+	s.mu.Unlock()
+	for _, f := range families {
+		s.mu.Lock()
+		all := append([]series(nil), f.series...)
+		s.mu.Unlock()
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.typ)
+		for _, sr := range all {
+			sr.m.write(bw, sr.name)
+		}
+	}
+	bw.Flush()
+}
+
+// Counter is a monotonically increasing count.
+type Counter struct {
+	v int64
+}
+
+// Inc adds one to c.
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.v, 1)
+}
+
+// Add adds n to c.
+func (c *Counter) Add(n int) {
+	atomic.AddInt64(&c.v, int64(n))
+}
+
+// Value returns the count.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.v)
+}
+
+func (c *Counter) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", float64(c.Value()))
+}
+
+// Gauge is a value that goes up and down.
+type Gauge struct {
+	v int64
+}
+
+// Add adds n to g, which may be negative.
+func (g *Gauge) Add(n int) {
+	atomic.AddInt64(&g.v, int64(n))
+}
+
+// Set sets g to v.
+func (g *Gauge) Set(v int) {
+	atomic.StoreInt64(&g.v, int64(v))
+}
+
+// Value returns the value of g.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+func (g *Gauge) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", float64(g.Value()))
+}
+
+type valueFunc func() float64
+
+func (f valueFunc) write(w *bufio.Writer, name string) {
+	writeSample(w, name, "", f())
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	bounds []float64
+	// counts holds the observations of each bucket, not cumulated, and
+	// inf those above the last bound.
+	counts []uint64
+	inf    uint64
+	// sum holds the bits of the float64 sum of the observations.
+	sum uint64
+}
+
+// Observe adds v to h.
+func (h *Histogram) Observe(v float64) {
+	if i := sort.SearchFloat64s(h.bounds, v); i < len(h.bounds) {
+		atomic.AddUint64(&h.counts[i], 1)
+	} else {
+		atomic.AddUint64(&h.inf, 1)
+	}
+	for {
+		old := atomic.LoadUint64(&h.sum)
+		if atomic.CompareAndSwapUint64(&h.sum, old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *Histogram) write(w *bufio.Writer, name string) {
+	base, labels := name, ""
+	if i := strings.IndexByte(name, '{'); i >= 0 {
+		base, labels = name[:i], name[i+1:len(name)-1]+","
+	}
+	var total uint64
+	for i, b := range h.bounds {
+		total += atomic.LoadUint64(&h.counts[i])
+		writeSample(w, base+"_bucket{"+labels+`le="`+formatFloat(b)+`"}`, "", float64(total))
+	}
+	total += atomic.LoadUint64(&h.inf)
+	writeSample(w, base+"_bucket{"+labels+`le="+Inf"}`, "", float64(total))
+	suffix := ""
+	if labels != "" {
+		suffix = "{" + labels[:len(labels)-1] + "}"
+	}
+	writeSample(w, base+"_sum", suffix, math.Float64frombits(atomic.LoadUint64(&h.sum)))
+	writeSample(w, base+"_count", suffix, float64(total))
+}
+
+// ExponentialBuckets returns n bucket bounds, the first being start and
+// every next one factor times the previous.
+func ExponentialBuckets(start, factor float64, n int) []float64 {
+	b := make([]float64, n)
+	for i := range b {
+		b[i] = start
+		start *= factor
+	}
+	return b
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	w.WriteString(name)
+	w.WriteString(labels)
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case v == math.Trunc(v) && math.Abs(v) < 1<<53:
+		// Counters are written in full rather than with an exponent.
+		return strconv.FormatInt(int64(v), 10)
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
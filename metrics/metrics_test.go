@@ -0,0 +1,115 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeHTTP(t *testing.T) {
+	s := NewSet()
+	c := s.NewCounter("ws_accepted_total", "Connections accepted.")
+	c.Add(3)
+	c.Inc()
+	g := s.NewGauge("ws_connections", "Open connections.")
+	g.Set(10)
+	g.Add(-2)
+	s.NewCounter(`ws_closes_total{reason="peer_close"}`, "Connections closed.").Inc()
+	s.NewCounterFunc(`ws_closes_total{reason="timeout"}`, "Connections closed.", func() float64 { return 2 })
+	s.NewGaugeFunc("ws_ratio", "A ratio.", func() float64 { return 0.25 })
+	h := s.NewHistogram("ws_batch", "Messages per batch.", []float64{1, 4})
+	for _, v := range []float64{1, 2, 3, 10} {
+		h.Observe(v)
+	}
+	s.NewHistogram(`ws_wait_seconds{loop="0"}`, "Wait.", []float64{0.5}).Observe(0.25)
+
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	want := `# HELP ws_accepted_total Connections accepted.
+# TYPE ws_accepted_total counter
+ws_accepted_total 4
+# HELP ws_connections Open connections.
+# TYPE ws_connections gauge
+ws_connections 8
+# HELP ws_closes_total Connections closed.
+# TYPE ws_closes_total counter
+ws_closes_total{reason="peer_close"} 1
+ws_closes_total{reason="timeout"} 2
+# HELP ws_ratio A ratio.
+# TYPE ws_ratio gauge
+ws_ratio 0.25
+# HELP ws_batch Messages per batch.
+# TYPE ws_batch histogram
+ws_batch_bucket{le="1"} 1
+ws_batch_bucket{le="4"} 3
+ws_batch_bucket{le="+Inf"} 4
+ws_batch_sum 16
+ws_batch_count 4
+# HELP ws_wait_seconds Wait.
+# TYPE ws_wait_seconds histogram
+ws_wait_seconds_bucket{loop="0",le="0.5"} 1
+ws_wait_seconds_bucket{loop="0",le="+Inf"} 1
+ws_wait_seconds_sum{loop="0"} 0.25
+ws_wait_seconds_count{loop="0"} 1
+`
+	if got := w.Body.String(); got != want {
+		t.Errorf("got\n%v\nwant\n%v", got, want)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4" {
+		t.Errorf("Content-Type %q", ct)
+	}
+}
+
+func TestRegisterPanics(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(s *Set)
+	}{
+		{"duplicate series", func(s *Set) { s.NewCounter("a", ""); s.NewCounter("a", "") }},
+		{"duplicate labelled series", func(s *Set) { s.NewCounter(`a{x="1"}`, ""); s.NewCounter(`a{x="1"}`, "") }},
+		{"type mismatch", func(s *Set) { s.NewCounter(`a{x="1"}`, ""); s.NewGauge(`a{x="2"}`, "") }},
+	}
+	for _, tt := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%v: no panic", tt.name)
+				}
+			}()
+			tt.f(NewSet())
+		}()
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := []struct {
+		v    float64
+		want string
+	}{
+		{0, "0"},
+		{-3, "-3"},
+		{1e15, "1000000000000000"},
+		{1 << 53, "9.007199254740992e+15"},
+		{0.001, "0.001"},
+		{math.Inf(1), "+Inf"},
+		{math.Inf(-1), "-Inf"},
+	}
+	for _, tt := range tests {
+		if got := formatFloat(tt.v); got != tt.want {
+			t.Errorf("formatFloat(%v) = %q, want %q", tt.v, got, tt.want)
+		}
+	}
+}
+
+func TestExponentialBuckets(t *testing.T) {
+	b := ExponentialBuckets(0.001, 10, 4)
+	want := []float64{0.001, 0.01, 0.1, 1}
+	if len(b) != len(want) {
+		t.Fatalf("%v buckets, want %v", len(b), len(want))
+	}
+	for i := range b {
+		if math.Abs(b[i]-want[i]) > 1e-12 {
+			t.Errorf("bucket %v is %v, want %v", i, b[i], want[i])
+		}
+	}
+}
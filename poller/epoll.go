@@ -0,0 +1,61 @@
+package poller
+
+import (
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+// epoll is the epoll(7) backend. The generation of a descriptor is kept
+// in the padding word of its epoll_event data, next to the descriptor.
+type epoll struct {
+	fd     int
+	events []unix.EpollEvent
+}
+
+// NewEpoll creates an epoll instance.
+func NewEpoll() (Poller, error) {
+	fd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	return &epoll{fd: fd}, nil
+}
+
+func (e *epoll) Add(fd int, gen uint32, events uint32) error {
+	return unix.EpollCtl(e.fd, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Events: events, Fd: int32(fd), Pad: int32(gen)})
+}
+
+func (e *epoll) Modify(fd int, gen uint32, events uint32) error {
+	return unix.EpollCtl(e.fd, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Events: events, Fd: int32(fd), Pad: int32(gen)})
+}
+
+func (e *epoll) Remove(fd int) error {
+	return unix.EpollCtl(e.fd, unix.EPOLL_CTL_DEL, fd, nil)
+}
+
+func (e *epoll) Wait(events []Event, timeout time.Duration) (int, error) {
+	if cap(e.events) < len(events) {
+		e.events = make([]unix.EpollEvent, len(events))
+	}
+	// epoll_wait counts in milliseconds: round up, or a timeout below one
+	// would not wait at all.
+	ms := int(timeout / time.Millisecond)
+	if timeout > 0 && timeout%time.Millisecond != 0 {
+		ms++
+	}
+	n, err := unix.EpollWait(e.fd, e.events[:len(events)], ms)
+	if err == unix.EINTR {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < n; i++ {
+		events[i] = Event{Fd: int(e.events[i].Fd), Gen: uint32(e.events[i].Pad), Events: e.events[i].Events}
+	}
+	return n, nil
+}
+
+func (e *epoll) Close() error {
+	return unix.Close(e.fd)
+}
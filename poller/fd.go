@@ -0,0 +1,95 @@
+package poller
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"syscall"
+)
+
+// ErrUnsupportedConn is returned by SocketFD when no file descriptor can be
+// reached through a connection or any of the wrappers it is known to hide
+// behind.
+type ErrUnsupportedConn struct {
+	Conn net.Conn
+}
+
+func (e ErrUnsupportedConn) Error() string {
+	return fmt.Sprintf("poller: unsupported connection type %T", e.Conn)
+}
+
+// SocketFD extracts the file descriptor of the socket underlying conn.
+// Wrappers such as *tls.Conn are unwrapped through NetConn/UnderlyingConn
+// until a connection implementing syscall.Conn is found, which covers
+// *net.TCPConn and *net.UnixConn.
+func SocketFD(conn net.Conn) (int, error) {
+	c := conn
+	for {
+		switch v := c.(type) {
+		case syscall.Conn:
+			return rawFD(v)
+		case interface{ NetConn() net.Conn }:
+			c = v.NetConn()
+		case interface{ UnderlyingConn() net.Conn }:
+			c = v.UnderlyingConn()
+		default:
+			return -1, ErrUnsupportedConn{conn}
+		}
+		if c == nil {
+			return -1, ErrUnsupportedConn{conn}
+		}
+	}
+}
+
+func rawFD(conn syscall.Conn) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	if err := rc.Control(func(sysfd uintptr) {
+		fd = int(sysfd)
+	}); err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+// SocketError returns the pending error of the socket fd, reported with
+// Err, or io.EOF if there is none.
+func SocketError(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno == 0 {
+		return io.EOF
+	}
+	return unix.Errno(errno)
+}
+
+// Flush writes frames to the non-blocking socket fd until they are all
+// written or the socket buffer is full, and returns the frames left. A
+// partially written frame is kept at the head of them.
+func Flush(fd int, frames [][]byte) ([][]byte, error) {
+	for len(frames) > 0 {
+		n, err := unix.Write(fd, frames[0])
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return frames, nil
+		}
+		if err != nil {
+			return frames, err
+		}
+		if n < len(frames[0]) {
+			frames[0] = frames[0][n:]
+			continue
+		}
+		frames[0] = nil
+		frames = frames[1:]
+	}
+	return nil, nil
+}
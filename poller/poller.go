@@ -0,0 +1,64 @@
+// Package poller reports readiness of non-blocking file descriptors. It is
+// shared by the epoll based servers, which pick one of its backends at
+// startup.
+package poller
+
+import (
+	"fmt"
+	"golang.org/x/sys/unix"
+	"time"
+)
+
+// Event flags. They have the same values as their EPOLL* counterparts and
+// as the poll(2) masks io_uring reports, so backends pass them through.
+const (
+	In      = unix.EPOLLIN
+	Out     = unix.EPOLLOUT
+	Err     = unix.EPOLLERR
+	Hup     = unix.EPOLLHUP
+	RdHup   = unix.EPOLLRDHUP
+	Edge    = unix.EPOLLET
+	OneShot = unix.EPOLLONESHOT
+)
+
+// Event is the readiness of a single file descriptor. Gen is the
+// generation the descriptor was registered with, so that callers reusing
+// a closed descriptor for a new connection can recognise events that were
+// reported for the old one.
+type Event struct {
+	Fd     int
+	Gen    uint32
+	Events uint32
+}
+
+// Poller is a readiness notification mechanism. Registered descriptors are
+// level-triggered unless Edge or OneShot is part of their events; a
+// OneShot descriptor is reported once and has to be re-armed with Modify.
+type Poller interface {
+	// Add registers fd for events. gen is reported back with every event
+	// of fd.
+	Add(fd int, gen uint32, events uint32) error
+	// Modify replaces the events and the generation fd is registered for.
+	Modify(fd int, gen uint32, events uint32) error
+	// Remove unregisters fd.
+	Remove(fd int) error
+	// Wait fills events with ready descriptors, waiting up to timeout for
+	// at least one of them. It returns the number of events filled.
+	Wait(events []Event, timeout time.Duration) (int, error)
+	// Close releases the poller.
+	Close() error
+}
+
+// Backends lists the names accepted by New.
+var Backends = []string{"epoll", "uring"}
+
+// New creates a poller using the named backend.
+func New(backend string) (Poller, error) {
+	switch backend {
+	case "epoll":
+		return NewEpoll()
+	case "uring":
+		return NewURing(defaultURingEntries)
+	}
+	return nil, fmt.Errorf("poller: unknown backend %q", backend)
+}
@@ -0,0 +1,223 @@
+package poller
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// socketPair returns both ends of a connected non-blocking unix socket.
+func socketPair(t *testing.T) (int, int) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM|unix.SOCK_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fds[0], fds[1]
+}
+
+func TestBackends(t *testing.T) {
+	for _, backend := range Backends {
+		p, err := New(backend)
+		if err != nil {
+			t.Logf("%v: %v", backend, err)
+			continue
+		}
+		a, b := socketPair(t)
+		if err := p.Add(a, 7, In); err != nil {
+			t.Fatalf("%v: Add: %v", backend, err)
+		}
+		events := make([]Event, 4)
+		if n, err := p.Wait(events, 10*time.Millisecond); err != nil || n != 0 {
+			t.Errorf("%v: %v events, %v on an idle socket", backend, n, err)
+		}
+		unix.Write(b, []byte("x"))
+		n, err := p.Wait(events, time.Second)
+		if err != nil || n != 1 || events[0].Fd != a || events[0].Gen != 7 || events[0].Events&In == 0 {
+			t.Errorf("%v: %v %v after a write, want fd %v of generation 7 readable", backend, events[:n], err, a)
+		}
+		if err := p.Modify(a, 8, Out|OneShot); err != nil {
+			t.Fatalf("%v: Modify: %v", backend, err)
+		}
+		n, err = p.Wait(events, time.Second)
+		if err != nil || n != 1 || events[0].Gen != 8 || events[0].Events&Out == 0 {
+			t.Errorf("%v: %v %v, want fd %v of generation 8 writable", backend, events[:n], err, a)
+		}
+		if n, _ := p.Wait(events, 10*time.Millisecond); n != 0 {
+			t.Errorf("%v: a one-shot descriptor was reported twice", backend)
+		}
+		if err := p.Remove(a); err != nil {
+			t.Errorf("%v: Remove: %v", backend, err)
+		}
+		p.Close()
+		unix.Close(a)
+		unix.Close(b)
+	}
+	if _, err := New("kqueue"); err == nil {
+		t.Error("New(\"kqueue\") succeeded")
+	}
+}
+
+// TestWaitTimeout waits less than a millisecond, which epoll counts in.
+func TestWaitTimeout(t *testing.T) {
+	for _, backend := range Backends {
+		p, err := New(backend)
+		if err != nil {
+			continue
+		}
+		events := make([]Event, 4)
+		start := time.Now()
+		if n, err := p.Wait(events, 200*time.Microsecond); err != nil || n != 0 {
+			t.Errorf("%v: %v events, %v with nothing registered", backend, n, err)
+		}
+		if d := time.Since(start); d < 200*time.Microsecond {
+			t.Errorf("%v: waited %v, want 200µs", backend, d)
+		}
+		p.Close()
+	}
+}
+
+func TestFlush(t *testing.T) {
+	a, b := socketPair(t)
+	defer unix.Close(a)
+	unix.SetsockoptInt(a, unix.SOL_SOCKET, unix.SO_SNDBUF, 4096)
+
+	big := bytes.Repeat([]byte("x"), 1<<20)
+	left, err := Flush(a, [][]byte{[]byte("head"), big, []byte("tail")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(left) != 2 || len(left[0]) == 0 || len(left[0]) >= len(big) || string(left[1]) != "tail" {
+		t.Fatalf("left %v frames, the first of %v bytes", len(left), len(left[0]))
+	}
+	var got []byte
+	buf := make([]byte, 64<<10)
+	for len(left) > 0 {
+		n, _ := unix.Read(b, buf)
+		if n > 0 {
+			got = append(got, buf[:n]...)
+		}
+		if left, err = Flush(a, left); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		n, _ := unix.Read(b, buf)
+		if n <= 0 {
+			break
+		}
+		got = append(got, buf[:n]...)
+	}
+	if want := "head" + string(big) + "tail"; string(got) != want {
+		t.Errorf("read %v bytes, want %v", len(got), len(want))
+	}
+
+	unix.Close(b)
+	if _, err := Flush(a, [][]byte{[]byte("x")}); err != unix.EPIPE {
+		t.Errorf("Flush to a closed peer: %v, want %v", err, unix.EPIPE)
+	}
+}
+
+func TestSocketError(t *testing.T) {
+	a, b := socketPair(t)
+	defer unix.Close(a)
+	defer unix.Close(b)
+	if err := SocketError(a); err != io.EOF {
+		t.Errorf("no pending error: %v, want %v", err, io.EOF)
+	}
+	if err := SocketError(-1); err != unix.EBADF {
+		t.Errorf("invalid fd: %v, want %v", err, unix.EBADF)
+	}
+}
+
+// wrapper hides a connection the way a TLS or logging wrapper does.
+type wrapper struct {
+	net.Conn
+	inner net.Conn
+}
+
+func (w wrapper) NetConn() net.Conn { return w.inner }
+
+func TestSocketFD(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	tests := []struct {
+		name string
+		conn net.Conn
+		ok   bool
+	}{
+		{"tcp", c, true},
+		{"wrapped", wrapper{inner: c}, true},
+		{"pipe", c1, false},
+		{"wrapped pipe", wrapper{inner: c1}, false},
+		{"wrapped nil", wrapper{}, false},
+	}
+	for _, tt := range tests {
+		fd, err := SocketFD(tt.conn)
+		if tt.ok && (err != nil || fd < 0) {
+			t.Errorf("%v: %v %v", tt.name, fd, err)
+		}
+		if !tt.ok {
+			if _, ok := err.(ErrUnsupportedConn); !ok {
+				t.Errorf("%v: %v %v, want ErrUnsupportedConn", tt.name, fd, err)
+			}
+		}
+	}
+}
+
+// TestURingFullQueue re-arms more level-triggered descriptors at once than
+// the submission queue holds, which flushes it while queueing.
+func TestURingFullQueue(t *testing.T) {
+	p, err := NewURing(2)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer p.Close()
+	var fds []int
+	for i := 0; i < 8; i++ {
+		a, b := socketPair(t)
+		defer unix.Close(a)
+		defer unix.Close(b)
+		unix.Write(b, []byte("x"))
+		if err := p.Add(a, 1, In); err != nil {
+			t.Fatal(err)
+		}
+		fds = append(fds, a)
+	}
+	events := make([]Event, 16)
+	// The data is never read, so every round reports every descriptor,
+	// and the next one re-arms them all.
+	for round := 0; round < 3; round++ {
+		ready := make(map[int]bool)
+		for _, fd := range fds {
+			ready[fd] = true
+		}
+		for deadline := time.Now().Add(time.Second); len(ready) > 0 && time.Now().Before(deadline); {
+			n, err := p.Wait(events, 100*time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, ev := range events[:n] {
+				delete(ready, ev.Fd)
+			}
+		}
+		if len(ready) > 0 {
+			t.Fatalf("round %v: %v descriptors never reported", round, len(ready))
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package poller
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// defaultURingEntries is the size of the submission queue created by New.
+const defaultURingEntries = 4096
+
+// io_uring ABI bits that golang.org/x/sys does not provide.
+const (
+	uringOpPollAdd    = 6
+	uringOpPollRemove = 7
+
+	uringPollAddMulti = 1 << 0
+
+	uringEnterGetEvents = 1 << 0
+	uringEnterExtArg    = 1 << 3
+
+	uringFeatSingleMmap = 1 << 0
+	uringFeatExtArg     = 1 << 8
+
+	uringOffSQRing = 0
+	uringOffCQRing = 0x8000000
+	uringOffSQEs   = 0x10000000
+
+	uringCQEFMore = 1 << 1
+)
+
+// uringRemoveTag marks the user data of poll removal requests, whose
+// completions carry no readiness.
+const uringRemoveTag = 1 << 63
+
+var errURingUnsupported = errors.New("poller: io_uring without IORING_FEAT_SINGLE_MMAP and IORING_FEAT_EXT_ARG is not supported")
+
+type uringParams struct {
+	sqEntries    uint32
+	cqEntries    uint32
+	flags        uint32
+	sqThreadCPU  uint32
+	sqThreadIdle uint32
+	features     uint32
+	wqFd         uint32
+	resv         [3]uint32
+	sqOff        uringSQOffsets
+	cqOff        uringCQOffsets
+}
+
+type uringSQOffsets struct {
+	head, tail, ringMask, ringEntries, flags, dropped, array, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringCQOffsets struct {
+	head, tail, ringMask, ringEntries, overflow, cqes, flags, resv1 uint32
+	userAddr                                                        uint64
+}
+
+type uringSQE struct {
+	opcode      uint8
+	flags       uint8
+	ioprio      uint16
+	fd          int32
+	off         uint64
+	addr        uint64
+	len         uint32
+	opFlags     uint32
+	userData    uint64
+	bufIndex    uint16
+	personality uint16
+	spliceFdIn  int32
+	addr3       uint64
+	pad         uint64
+}
+
+type uringCQE struct {
+	userData uint64
+	res      int32
+	flags    uint32
+}
+
+type uringGetEventsArg struct {
+	sigmask   uint64
+	sigmaskSz uint32
+	pad       uint32
+	ts        uint64
+}
+
+// uringFD is the registration of a single descriptor.
+type uringFD struct {
+	events uint32
+	// userGen is the generation given by the caller.
+	userGen uint32
+	// gen is part of the user data of the current poll request, so that
+	// completions of requests replaced by Modify or Remove are ignored.
+	gen uint32
+	// armed is set while a poll request is pending in the kernel.
+	armed bool
+}
+
+// uring is the io_uring(7) backend. Every descriptor has a poll request
+// in flight: a multishot one for Edge descriptors, and a single-shot one
+// otherwise. Level-triggered descriptors are re-armed at the beginning of
+// the following Wait, once the caller has consumed the readiness it was
+// given, which matches the semantics of a level-triggered epoll.
+type uring struct {
+	fd int
+
+	sqRing, cqRing, sqesMem []byte
+
+	sqHead, sqTail *uint32
+	sqMask         uint32
+	sqEntries      uint32
+	sqes           []uringSQE
+
+	cqHead, cqTail *uint32
+	cqMask         uint32
+	cqes           []uringCQE
+
+	// mu guards the submission queue and the registrations. Completions
+	// are only consumed by Wait.
+	mu      sync.Mutex
+	pending uint32
+	fds     map[int]*uringFD
+	gen     uint32
+	rearm   []int
+
+	ts  unix.Timespec
+	arg uringGetEventsArg
+}
+
+// NewURing creates an io_uring instance with the given number of
+// submission queue entries. It requires Linux 5.13 or later.
+func NewURing(entries uint32) (Poller, error) {
+	var p uringParams
+	fd, _, errno := unix.Syscall(unix.SYS_IO_URING_SETUP, uintptr(entries), uintptr(unsafe.Pointer(&p)), 0)
+	if errno != 0 {
+		return nil, errno
+	}
+	u := &uring{fd: int(fd), fds: make(map[int]*uringFD)}
+	if p.features&uringFeatSingleMmap == 0 || p.features&uringFeatExtArg == 0 {
+		u.Close()
+		return nil, errURingUnsupported
+	}
+
+	size := p.sqOff.array + p.sqEntries*4
+	if cqSize := p.cqOff.cqes + p.cqEntries*uint32(unsafe.Sizeof(uringCQE{})); cqSize > size {
+		size = cqSize
+	}
+	var err error
+	u.sqRing, err = unix.Mmap(u.fd, uringOffSQRing, int(size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
+	u.cqRing = u.sqRing
+	u.sqesMem, err = unix.Mmap(u.fd, uringOffSQEs, int(p.sqEntries)*int(unsafe.Sizeof(uringSQE{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		u.Close()
+		return nil, err
+	}
+
+	u.sqHead = ringUint32(u.sqRing, p.sqOff.head)
+	u.sqTail = ringUint32(u.sqRing, p.sqOff.tail)
+	u.sqMask = *ringUint32(u.sqRing, p.sqOff.ringMask)
+	u.sqEntries = *ringUint32(u.sqRing, p.sqOff.ringEntries)
+	u.sqes = (*[1 << 20]uringSQE)(unsafe.Pointer(&u.sqesMem[0]))[:p.sqEntries:p.sqEntries]
+	array := (*[1 << 24]uint32)(unsafe.Pointer(&u.sqRing[p.sqOff.array]))[:p.sqEntries:p.sqEntries]
+	for i := range array {
+		array[i] = uint32(i)
+	}
+
+	u.cqHead = ringUint32(u.cqRing, p.cqOff.head)
+	u.cqTail = ringUint32(u.cqRing, p.cqOff.tail)
+	u.cqMask = *ringUint32(u.cqRing, p.cqOff.ringMask)
+	u.cqes = (*[1 << 24]uringCQE)(unsafe.Pointer(&u.cqRing[p.cqOff.cqes]))[:p.cqEntries:p.cqEntries]
+	return u, nil
+}
+
+func ringUint32(ring []byte, off uint32) *uint32 {
+	return (*uint32)(unsafe.Pointer(&ring[off]))
+}
+
+func (u *uring) Add(fd int, gen uint32, events uint32) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if _, ok := u.fds[fd]; ok {
+		return unix.EEXIST
+	}
+	st := &uringFD{events: events, userGen: gen}
+	if err := u.pollAdd(fd, st); err != nil {
+		return err
+	}
+	u.fds[fd] = st
+	return u.submit()
+}
+
+func (u *uring) Modify(fd int, gen uint32, events uint32) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, ok := u.fds[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	if st.armed {
+		if err := u.pollRemove(fd, st); err != nil {
+			return err
+		}
+	}
+	st.events = events
+	st.userGen = gen
+	if err := u.pollAdd(fd, st); err != nil {
+		// The next Wait arms fd with its new events.
+		u.rearm = append(u.rearm, fd)
+		return err
+	}
+	return u.submit()
+}
+
+func (u *uring) Remove(fd int) error {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	st, ok := u.fds[fd]
+	if !ok {
+		return unix.ENOENT
+	}
+	if st.armed {
+		if err := u.pollRemove(fd, st); err != nil {
+			return err
+		}
+	}
+	delete(u.fds, fd)
+	return u.submit()
+}
+
+func (u *uring) Wait(events []Event, timeout time.Duration) (int, error) {
+	u.mu.Lock()
+	for i, fd := range u.rearm {
+		if st, ok := u.fds[fd]; ok && !st.armed {
+			if err := u.pollAdd(fd, st); err != nil {
+				// Keep the descriptors left for the next Wait.
+				u.rearm = u.rearm[:copy(u.rearm, u.rearm[i:])]
+				u.mu.Unlock()
+				return 0, err
+			}
+		}
+	}
+	u.rearm = u.rearm[:0]
+	err := u.submit()
+	u.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	n := u.reap(events)
+	if n > 0 || timeout <= 0 {
+		return n, nil
+	}
+	u.ts = unix.NsecToTimespec(int64(timeout))
+	u.arg = uringGetEventsArg{ts: uint64(uintptr(unsafe.Pointer(&u.ts)))}
+	_, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), 0, 1,
+		uringEnterGetEvents|uringEnterExtArg, uintptr(unsafe.Pointer(&u.arg)), unsafe.Sizeof(u.arg))
+	if errno != 0 && errno != unix.EINTR && errno != unix.ETIME {
+		return 0, errno
+	}
+	return u.reap(events), nil
+}
+
+// reap moves completions into events.
+func (u *uring) reap(events []Event) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	head := atomic.LoadUint32(u.cqHead)
+	tail := atomic.LoadUint32(u.cqTail)
+	n := 0
+	for ; head != tail && n < len(events); head++ {
+		cqe := u.cqes[head&u.cqMask]
+		if cqe.userData&uringRemoveTag != 0 {
+			continue
+		}
+		fd := int(int32(uint32(cqe.userData)))
+		st, ok := u.fds[fd]
+		if !ok || st.gen != uint32(cqe.userData>>32) {
+			// Completion of a request replaced by Modify or Remove.
+			continue
+		}
+		if cqe.flags&uringCQEFMore == 0 {
+			st.armed = false
+			if st.events&OneShot == 0 {
+				u.rearm = append(u.rearm, fd)
+			}
+		}
+		ready := uint32(cqe.res)
+		if cqe.res < 0 {
+			ready = Err | Hup
+		}
+		events[n] = Event{Fd: fd, Gen: st.userGen, Events: ready}
+		n++
+	}
+	atomic.StoreUint32(u.cqHead, head)
+	return n
+}
+
+// pollAdd queues a poll request for fd. u.mu must be held.
+func (u *uring) pollAdd(fd int, st *uringFD) error {
+	gen := (u.gen + 1) &^ (1 << 31)
+	sqe := uringSQE{
+		opcode:   uringOpPollAdd,
+		fd:       int32(fd),
+		opFlags:  st.events &^ (Edge | OneShot),
+		userData: uint64(gen)<<32 | uint64(uint32(fd)),
+	}
+	if st.events&Edge != 0 && st.events&OneShot == 0 {
+		sqe.len = uringPollAddMulti
+	}
+	if err := u.push(sqe); err != nil {
+		return err
+	}
+	u.gen = gen
+	st.gen = gen
+	st.armed = true
+	return nil
+}
+
+// pollRemove queues the cancellation of fd's pending poll request. u.mu
+// must be held.
+func (u *uring) pollRemove(fd int, st *uringFD) error {
+	err := u.push(uringSQE{
+		opcode:   uringOpPollRemove,
+		fd:       -1,
+		addr:     uint64(st.gen)<<32 | uint64(uint32(fd)),
+		userData: uringRemoveTag,
+	})
+	if err != nil {
+		return err
+	}
+	st.armed = false
+	return nil
+}
+
+// push appends sqe to the submission queue, flushing the queue first if
+// it is full. It returns the error of the flush, leaving the queue as it
+// was, since writing sqe would overwrite a request the kernel has not
+// read. u.mu must be held.
+func (u *uring) push(sqe uringSQE) error {
+	tail := *u.sqTail
+	if tail-atomic.LoadUint32(u.sqHead) == u.sqEntries {
+		if err := u.submit(); err != nil {
+			return err
+		}
+	}
+	u.sqes[tail&u.sqMask] = sqe
+	atomic.StoreUint32(u.sqTail, tail+1)
+	u.pending++
+	return nil
+}
+
+// submit hands the queued requests to the kernel. u.mu must be held.
+func (u *uring) submit() error {
+	for u.pending > 0 {
+		n, _, errno := unix.Syscall6(unix.SYS_IO_URING_ENTER, uintptr(u.fd), uintptr(u.pending), 0, 0, 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return errno
+		}
+		u.pending -= uint32(n)
+	}
+	return nil
+}
+
+func (u *uring) Close() error {
+	if u.sqesMem != nil {
+		unix.Munmap(u.sqesMem)
+	}
+	if u.sqRing != nil {
+		unix.Munmap(u.sqRing)
+	}
+	return unix.Close(u.fd)
+}
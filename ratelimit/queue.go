@@ -0,0 +1,65 @@
+package ratelimit
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// Queue holds the connections of an event loop that are not read until
+// their buckets refill, ordered by when they are due. The loop pops the
+// due ones between waits, instead of every delayed connection arming a
+// timer of its own.
+type Queue struct {
+	mu    sync.Mutex
+	items items
+}
+
+// Push adds v, to be popped once due has passed.
+func (q *Queue) Push(v interface{}, due time.Time) {
+	q.mu.Lock()
+	heap.Push(&q.items, item{v: v, due: due})
+	q.mu.Unlock()
+}
+
+// Pop removes and returns the values due at now.
+func (q *Queue) Pop(now time.Time) []interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var due []interface{}
+	for len(q.items) > 0 && !q.items[0].due.After(now) {
+		due = append(due, heap.Pop(&q.items).(item).v)
+	}
+	return due
+}
+
+// Next returns when the first value is due, and false if q is empty.
+func (q *Queue) Next() (time.Time, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.items) == 0 {
+		return time.Time{}, false
+	}
+	return q.items[0].due, true
+}
+
+type item struct {
+	v   interface{}
+	due time.Time
+}
+
+// items is a min-heap of items by due time.
+type items []item
+
+func (h items) Len() int            { return len(h) }
+func (h items) Less(i, j int) bool  { return h[i].due.Before(h[j].due) }
+func (h items) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *items) Push(x interface{}) { *h = append(*h, x.(item)) }
+
+func (h *items) Pop() interface{} {
+	old := *h
+	it := old[len(old)-1]
+	old[len(old)-1] = item{}
+	*h = old[:len(old)-1]
+	return it
+}
@@ -0,0 +1,179 @@
+// Package ratelimit limits the rate of messages and bytes the example
+// servers read from each connection, so that a chatty client cannot keep
+// an event loop to itself. Token buckets are refilled from the time elapsed
+// since they were last taken from rather than by timers, so a connection
+// only costs 16 bytes of state, and connections whose reads are delayed
+// wait in a Queue of their event loop.
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Policy is what happens to a message that exceeds the rate.
+type Policy int
+
+const (
+	// Drop discards the message.
+	Drop Policy = iota
+	// Delay delivers the message, but the connection is not read again
+	// until its buckets have refilled.
+	Delay
+	// Close closes the connection with 1008 Policy Violation.
+	Close
+)
+
+var policyNames = []string{
+	Drop:  "drop",
+	Delay: "delay",
+	Close: "close",
+}
+
+func (p Policy) String() string {
+	if p < 0 || int(p) >= len(policyNames) {
+		return "unknown"
+	}
+	return policyNames[p]
+}
+
+// ParsePolicy returns the policy called name: drop, delay or close.
+func ParsePolicy(name string) (Policy, error) {
+	for p, n := range policyNames {
+		if n == name {
+			return Policy(p), nil
+		}
+	}
+	return 0, fmt.Errorf("ratelimit: unknown policy %q", name)
+}
+
+// Limiter is the rate every connection of a server is limited to.
+type Limiter struct {
+	// Messages is the number of messages a connection may send per
+	// second, in bursts of up to MessageBurst, which is a second worth if
+	// zero. A zero Messages does not limit messages.
+	Messages     float64
+	MessageBurst int
+	// Bytes is the number of payload bytes a connection may send per
+	// second, in bursts of up to ByteBurst, which is a second worth if
+	// zero. A zero Bytes does not limit bytes.
+	Bytes     float64
+	ByteBurst int
+	// Policy applies to the messages exceeding the rate.
+	Policy Policy
+}
+
+// Enabled reports whether l limits anything.
+func (l *Limiter) Enabled() bool {
+	return l.Messages > 0 || l.Bytes > 0
+}
+
+// Bucket holds the tokens a connection has left, and when they were last
+// refilled. The zero value is a full bucket.
+type Bucket struct {
+	last     int64
+	messages float32
+	bytes    float32
+}
+
+// Allow takes a message of size bytes from b if it conforms to the rate,
+// and reports whether it did. A message conforms if a message token is
+// left and the byte bucket is not in debt: a message larger than what is
+// left overdraws it, which delays the next ones.
+func (l *Limiter) Allow(b *Bucket, now time.Time, size int) bool {
+	l.refill(b, now)
+	if !l.conforms(b) {
+		return false
+	}
+	l.take(b, size)
+	return true
+}
+
+// Take takes a message of size bytes from b whether it conforms or not,
+// as the Delay policy does for messages it has read already, and reports
+// whether it conformed.
+func (l *Limiter) Take(b *Bucket, now time.Time, size int) bool {
+	l.refill(b, now)
+	ok := l.conforms(b)
+	l.take(b, size)
+	return ok
+}
+
+// Admit applies l to a message of size bytes read from b. It reports
+// whether the message is delivered, which it always is with the Delay
+// policy, and whether it exceeded the rate. A Close policy is left to the
+// caller, which closes the connection of a message that is not delivered.
+func (l *Limiter) Admit(b *Bucket, now time.Time, size int) (ok, limited bool) {
+	if l.Policy == Delay {
+		return true, !l.Take(b, now, size)
+	}
+	if l.Allow(b, now, size) {
+		return true, false
+	}
+	return false, true
+}
+
+// Wait returns how long b needs to refill after now before the next
+// message conforms, or zero if it does already.
+func (l *Limiter) Wait(b *Bucket, now time.Time) time.Duration {
+	l.refill(b, now)
+	var wait float64
+	if l.Messages > 0 && b.messages < 1 {
+		wait = float64(1-b.messages) / l.Messages
+	}
+	if l.Bytes > 0 && b.bytes <= 0 {
+		if w := float64(-b.bytes)/l.Bytes + 1e-9; w > wait {
+			wait = w
+		}
+	}
+	return time.Duration(wait * float64(time.Second))
+}
+
+func (l *Limiter) conforms(b *Bucket) bool {
+	return (l.Messages <= 0 || b.messages >= 1) && (l.Bytes <= 0 || b.bytes > 0)
+}
+
+func (l *Limiter) take(b *Bucket, size int) {
+	if l.Messages > 0 {
+		b.messages--
+	}
+	if l.Bytes > 0 {
+		b.bytes -= float32(size)
+	}
+}
+
+// refill adds the tokens earned since b was last refilled.
+func (l *Limiter) refill(b *Bucket, now time.Time) {
+	t := now.UnixNano()
+	messageBurst := burst(l.Messages, l.MessageBurst)
+	byteBurst := burst(l.Bytes, l.ByteBurst)
+	if b.last == 0 {
+		b.last, b.messages, b.bytes = t, messageBurst, byteBurst
+		return
+	}
+	elapsed := float64(t-b.last) / float64(time.Second)
+	if elapsed <= 0 {
+		return
+	}
+	b.last = t
+	b.messages = fill(b.messages, elapsed*l.Messages, messageBurst)
+	b.bytes = fill(b.bytes, elapsed*l.Bytes, byteBurst)
+}
+
+// burst returns the size of a bucket filled at rate.
+func burst(rate float64, n int) float32 {
+	if n > 0 {
+		return float32(n)
+	}
+	if rate < 1 {
+		return 1
+	}
+	return float32(rate)
+}
+
+func fill(tokens float32, earned float64, burst float32) float32 {
+	if tokens += float32(earned); tokens > burst {
+		return burst
+	}
+	return tokens
+}
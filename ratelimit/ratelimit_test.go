@@ -0,0 +1,155 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// step is a message of size bytes taken at ms milliseconds.
+type step struct {
+	ms   int
+	size int
+	ok   bool
+}
+
+func TestAllow(t *testing.T) {
+	tests := []struct {
+		name  string
+		l     Limiter
+		steps []step
+	}{
+		{
+			name:  "burst of a second worth",
+			l:     Limiter{Messages: 2},
+			steps: []step{{0, 0, true}, {0, 0, true}, {0, 0, false}, {499, 0, false}, {500, 0, true}, {500, 0, false}},
+		},
+		{
+			name:  "explicit burst",
+			l:     Limiter{Messages: 1, MessageBurst: 3},
+			steps: []step{{0, 0, true}, {0, 0, true}, {0, 0, true}, {0, 0, false}, {1000, 0, true}, {1000, 0, false}},
+		},
+		{
+			name:  "refill is capped by the burst",
+			l:     Limiter{Messages: 1, MessageBurst: 2},
+			steps: []step{{0, 0, true}, {10000, 0, true}, {10000, 0, true}, {10000, 0, false}},
+		},
+		{
+			name:  "rate below one a second bursts one",
+			l:     Limiter{Messages: 0.5},
+			steps: []step{{0, 0, true}, {0, 0, false}, {1999, 0, false}, {2000, 0, true}},
+		},
+		{
+			name: "a large message overdraws the bytes",
+			l:    Limiter{Bytes: 100},
+			// The second message leaves a debt of 150 bytes, paid back
+			// in 1.5s.
+			steps: []step{{0, 50, true}, {0, 200, true}, {0, 1, false}, {1499, 1, false}, {1501, 1, true}},
+		},
+		{
+			name:  "both buckets",
+			l:     Limiter{Messages: 10, Bytes: 10},
+			steps: []step{{0, 10, true}, {0, 1, false}, {100, 1, true}},
+		},
+		{
+			name:  "no limit",
+			l:     Limiter{},
+			steps: []step{{0, 1 << 20, true}, {0, 1 << 20, true}, {0, 1 << 20, true}},
+		},
+	}
+	start := time.Unix(1000, 0)
+	for _, tt := range tests {
+		var b Bucket
+		for i, st := range tt.steps {
+			now := start.Add(time.Duration(st.ms) * time.Millisecond)
+			if ok := tt.l.Allow(&b, now, st.size); ok != st.ok {
+				t.Errorf("%v: step %v: Allow = %v, want %v", tt.name, i, ok, st.ok)
+			}
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	start := time.Unix(1000, 0)
+	l := Limiter{Messages: 4, MessageBurst: 1, Bytes: 1000}
+	var b Bucket
+	if d := l.Wait(&b, start); d != 0 {
+		t.Errorf("full bucket: Wait = %v, want 0", d)
+	}
+	if !l.Take(&b, start, 10) {
+		t.Fatal("the first message does not conform")
+	}
+	if d := l.Wait(&b, start); d != 250*time.Millisecond {
+		t.Errorf("no message left: Wait = %v, want 250ms", d)
+	}
+	if d := l.Wait(&b, start.Add(100*time.Millisecond)); d < 150*time.Millisecond || d > 151*time.Millisecond {
+		t.Errorf("100ms later: Wait = %v, want 150ms", d)
+	}
+	// Take takes what does not conform too, which puts the bytes in debt.
+	if !l.Take(&b, start.Add(250*time.Millisecond), 3000) {
+		t.Error("a message refilled after 250ms does not conform")
+	}
+	if d := l.Wait(&b, start.Add(250*time.Millisecond)); d < 2*time.Second || d > 2*time.Second+time.Millisecond {
+		t.Errorf("2000 bytes in debt: Wait = %v, want 2s", d)
+	}
+}
+
+func TestAdmit(t *testing.T) {
+	start := time.Unix(1000, 0)
+	tests := []struct {
+		policy      Policy
+		ok, limited bool
+	}{
+		{Drop, false, true},
+		{Close, false, true},
+		{Delay, true, true},
+	}
+	for _, tt := range tests {
+		l := Limiter{Messages: 1, Policy: tt.policy}
+		var b Bucket
+		if ok, limited := l.Admit(&b, start, 0); !ok || limited {
+			t.Errorf("%v: first message: %v %v, want true false", tt.policy, ok, limited)
+		}
+		if ok, limited := l.Admit(&b, start, 0); ok != tt.ok || limited != tt.limited {
+			t.Errorf("%v: second message: %v %v, want %v %v", tt.policy, ok, limited, tt.ok, tt.limited)
+		}
+	}
+}
+
+func TestParsePolicy(t *testing.T) {
+	for _, p := range []Policy{Drop, Delay, Close} {
+		got, err := ParsePolicy(p.String())
+		if err != nil || got != p {
+			t.Errorf("ParsePolicy(%q) = %v, %v", p.String(), got, err)
+		}
+	}
+	if _, err := ParsePolicy("block"); err == nil {
+		t.Error("ParsePolicy(\"block\") succeeded")
+	}
+	if s := Policy(7).String(); s != "unknown" {
+		t.Errorf("Policy(7) = %q", s)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	start := time.Unix(1000, 0)
+	var q Queue
+	if _, ok := q.Next(); ok {
+		t.Error("an empty queue has a next value")
+	}
+	for _, ms := range []int{30, 10, 20, 10} {
+		q.Push(ms, start.Add(time.Duration(ms)*time.Millisecond))
+	}
+	if next, ok := q.Next(); !ok || !next.Equal(start.Add(10*time.Millisecond)) {
+		t.Errorf("Next = %v %v, want 10ms", next, ok)
+	}
+	if due := q.Pop(start.Add(5 * time.Millisecond)); len(due) != 0 {
+		t.Errorf("popped %v before they are due", due)
+	}
+	due := q.Pop(start.Add(20 * time.Millisecond))
+	if len(due) != 3 || due[0] != 10 || due[1] != 10 || due[2] != 20 {
+		t.Errorf("popped %v at 20ms, want [10 10 20]", due)
+	}
+	if due := q.Pop(start.Add(time.Second)); len(due) != 1 || due[0] != 30 {
+		t.Errorf("popped %v at 1s, want [30]", due)
+	}
+}
@@ -8,8 +8,8 @@
 CONNECTIONS=$1
 REPLICAS=$2
 IP=$3
-go build --tags "static netgo" -o client client.go
+go build --tags "static netgo" -o 1mws ./cmd/1mws
 for (( c=0; c<${REPLICAS}; c++ ))
 do
-    docker run -l 1m-go-websockets -v $(pwd)/client:/client -d alpine /client -conn=${CONNECTIONS} -ip=${IP}
+    docker run -l 1m-go-websockets -v $(pwd)/1mws:/1mws -d alpine /1mws client -conn=${CONNECTIONS} -ip=${IP}
 done
@@ -0,0 +1,89 @@
+package shutdown
+
+import (
+	"context"
+	"github.com/gorilla/websocket"
+	"sync"
+	"time"
+)
+
+// closeWriteWait bounds the write of a single close frame.
+const closeWriteWait = time.Second
+
+var goingAway = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+
+// Registry tracks the connections of a server that reads every gorilla
+// websocket connection from its own goroutine. The goroutine adds the
+// connection once upgraded and removes it when its read loop ends, which
+// happens once the peer answers the close frame sent by Drain.
+type Registry struct {
+	mu       sync.Mutex
+	conns    map[*websocket.Conn]struct{}
+	draining bool
+}
+
+// NewRegistry creates an empty registry.
+func NewRegistry() *Registry {
+	return &Registry{conns: make(map[*websocket.Conn]struct{})}
+}
+
+// Add registers conn. A connection added while the registry is draining is
+// sent a close frame right away.
+func (r *Registry) Add(conn *websocket.Conn) {
+	r.mu.Lock()
+	r.conns[conn] = struct{}{}
+	draining := r.draining
+	r.mu.Unlock()
+	if draining {
+		GoingAway(conn)
+	}
+}
+
+// Remove unregisters conn.
+func (r *Registry) Remove(conn *websocket.Conn) {
+	r.mu.Lock()
+	delete(r.conns, conn)
+	r.mu.Unlock()
+}
+
+// Len returns the number of registered connections.
+func (r *Registry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.conns)
+}
+
+// Drain sends a close frame to every registered connection, rate per
+// second, and waits until they are all removed or ctx is done. The
+// connections left are then closed.
+func (r *Registry) Drain(ctx context.Context, rate int) error {
+	r.mu.Lock()
+	r.draining = true
+	conns := make([]*websocket.Conn, 0, len(r.conns))
+	for conn := range r.conns {
+		conns = append(conns, conn)
+	}
+	r.mu.Unlock()
+
+	err := Pace(ctx, len(conns), rate, func(i int) {
+		GoingAway(conns[i])
+	})
+	if err == nil {
+		err = Wait(ctx, r.Len)
+	}
+
+	r.mu.Lock()
+	for conn := range r.conns {
+		conn.Close()
+	}
+	r.mu.Unlock()
+	return err
+}
+
+// GoingAway starts the closing handshake of conn with a 1001 Going Away
+// close frame, and closes conn if the frame cannot be written.
+func GoingAway(conn *websocket.Conn) {
+	if err := conn.WriteControl(websocket.CloseMessage, goingAway, time.Now().Add(closeWriteWait)); err != nil {
+		conn.Close()
+	}
+}
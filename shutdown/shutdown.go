@@ -0,0 +1,75 @@
+// Package shutdown drains the connections of the example servers when they
+// are asked to stop. Peers are sent a 1001 Going Away close frame at a
+// bounded rate, so that a million clients do not all reconnect to the next
+// instance at once, and are given a deadline to complete the closing
+// handshake.
+package shutdown
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	// DefaultRate is the number of close frames sent per second.
+	DefaultRate = 10000
+	// DefaultTimeout is how long a shutdown waits for peers to complete
+	// the closing handshake.
+	DefaultTimeout = 10 * time.Second
+)
+
+// pacerTick is the interval close frames are sent in batches at.
+const pacerTick = 10 * time.Millisecond
+
+// Notify returns a channel that receives SIGTERM and SIGINT.
+func Notify() <-chan os.Signal {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	return ch
+}
+
+// Pace calls f for every i in [0, n), at most rate times per second. It
+// returns ctx's error if ctx is done first.
+func Pace(ctx context.Context, n, rate int, f func(i int)) error {
+	if rate < 1 {
+		rate = DefaultRate
+	}
+	batch := rate * int(pacerTick) / int(time.Second)
+	if batch < 1 {
+		batch = 1
+	}
+	ticker := time.NewTicker(time.Duration(batch) * time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for i := 0; i < n; {
+		for end := i + batch; i < n && i < end; i++ {
+			f(i)
+		}
+		if i == n {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Wait polls open until it reports no open connections. It returns ctx's
+// error if ctx is done first.
+func Wait(ctx context.Context, open func() int) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for open() > 0 {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package shutdown
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPace(t *testing.T) {
+	tests := []struct {
+		n, rate int
+		// min is the least time calling f n times may take.
+		min time.Duration
+	}{
+		{0, 100, 0},
+		{5, 1000, 0},
+		{300, 1000, 200 * time.Millisecond},
+		{4, 20, 150 * time.Millisecond},
+		{10, 0, 0},
+	}
+	for _, tt := range tests {
+		var called []int
+		start := time.Now()
+		if err := Pace(context.Background(), tt.n, tt.rate, func(i int) { called = append(called, i) }); err != nil {
+			t.Fatal(err)
+		}
+		if elapsed := time.Since(start); elapsed < tt.min {
+			t.Errorf("%v at %v/s: took %v, want at least %v", tt.n, tt.rate, elapsed, tt.min)
+		}
+		if len(called) != tt.n {
+			t.Errorf("%v at %v/s: called %v times", tt.n, tt.rate, len(called))
+			continue
+		}
+		for i, v := range called {
+			if v != i {
+				t.Errorf("%v at %v/s: call %v was for %v", tt.n, tt.rate, i, v)
+				break
+			}
+		}
+	}
+}
+
+func TestPaceCanceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n := 0
+	if err := Pace(ctx, 1000, 10, func(int) { n++ }); err != context.DeadlineExceeded {
+		t.Errorf("Pace = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if n == 0 || n >= 1000 {
+		t.Errorf("called %v times before the deadline", n)
+	}
+}
+
+func TestWait(t *testing.T) {
+	open := 3
+	if err := Wait(context.Background(), func() int { open--; return open }); err != nil || open != 0 {
+		t.Errorf("Wait = %v with %v open", err, open)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := Wait(ctx, func() int { return 1 }); err != context.DeadlineExceeded {
+		t.Errorf("Wait = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
@@ -0,0 +1,160 @@
+// Package wheel tracks the activity of the connections of an event loop
+// on a hashed timing wheel, to ping the idle ones and evict those that do
+// not answer, without a timer or a goroutine per connection.
+package wheel
+
+import (
+	"sync"
+	"time"
+)
+
+// Tick is the resolution of the wheel.
+const Tick = time.Second
+
+// entry is the activity state of a single connection.
+type entry struct {
+	// last is the time of the last activity, in unix nanoseconds.
+	last int64
+	// pinged is the time a ping was sent at, 0 if no ping is pending.
+	pinged int64
+	// deadline is the time the entry is scheduled at and slot the slot it
+	// is stored in.
+	deadline int64
+	slot     int
+}
+
+// Wheel tracks the activity of every connection of an event loop by fd.
+// Recording activity only updates a timestamp; connections are rescheduled
+// lazily when their slot comes up.
+type Wheel struct {
+	mu      sync.Mutex
+	slots   []map[int]struct{}
+	entries map[int]*entry
+	// current is the last tick the wheel was advanced to.
+	current int64
+	// idle is the inactivity after which a connection is pinged, and
+	// pongWait how long it then has to show any activity. With a zero
+	// pongWait idle connections are expired without a ping.
+	idle     time.Duration
+	pongWait time.Duration
+}
+
+// New returns a wheel pinging connections after idle and evicting them if
+// they show no activity for pongWait after that. With a zero pongWait
+// connections are evicted after idle without a ping.
+func New(idle, pongWait time.Duration) *Wheel {
+	// The wheel spans the longest delay an entry is scheduled with, so
+	// that an entry is only visited once before it is due.
+	n := int((idle+pongWait)/Tick) + 2
+	w := &Wheel{
+		slots:    make([]map[int]struct{}, n),
+		entries:  make(map[int]*entry),
+		current:  time.Now().UnixNano() / int64(Tick),
+		idle:     idle,
+		pongWait: pongWait,
+	}
+	for i := range w.slots {
+		w.slots[i] = make(map[int]struct{})
+	}
+	return w
+}
+
+// Add starts tracking fd.
+func (w *Wheel) Add(fd int) {
+	now := time.Now().UnixNano()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	en := &entry{last: now}
+	w.entries[fd] = en
+	w.schedule(fd, en, now+int64(w.idle))
+}
+
+// Remove stops tracking fd.
+func (w *Wheel) Remove(fd int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if en, ok := w.entries[fd]; ok {
+		delete(w.slots[en.slot], fd)
+		delete(w.entries, fd)
+	}
+}
+
+// Touch records activity on fd, which also answers a pending ping.
+func (w *Wheel) Touch(fd int) {
+	now := time.Now().UnixNano()
+	w.mu.Lock()
+	if en, ok := w.entries[fd]; ok {
+		en.last = now
+	}
+	w.mu.Unlock()
+}
+
+// Advance moves the wheel to now. It returns the connections that have
+// been idle long enough to be pinged, and the ones that have to be evicted
+// because they did not answer a ping in time.
+func (w *Wheel) Advance(now time.Time) (ping, expired []int) {
+	nanos := now.UnixNano()
+	tick := nanos / int64(Tick)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if tick-w.current > int64(len(w.slots)) {
+		w.current = tick - int64(len(w.slots))
+	}
+	for w.current < tick {
+		w.current++
+		slot := w.slots[w.current%int64(len(w.slots))]
+		for fd := range slot {
+			en := w.entries[fd]
+			if en.deadline > nanos {
+				continue
+			}
+			delete(slot, fd)
+			switch w.expire(fd, en, nanos) {
+			case expirePing:
+				ping = append(ping, fd)
+			case expireEvict:
+				delete(w.entries, fd)
+				expired = append(expired, fd)
+			}
+		}
+	}
+	return ping, expired
+}
+
+const (
+	expireNone = iota
+	expirePing
+	expireEvict
+)
+
+// expire decides what happens to an entry whose deadline has passed, and
+// reschedules it unless it is evicted.
+func (w *Wheel) expire(fd int, en *entry, now int64) int {
+	if en.pinged != 0 {
+		if en.last <= en.pinged {
+			return expireEvict
+		}
+		en.pinged = 0
+	}
+	if idle := en.last + int64(w.idle); idle > now {
+		w.schedule(fd, en, idle)
+		return expireNone
+	}
+	if w.pongWait == 0 {
+		return expireEvict
+	}
+	en.pinged = now
+	w.schedule(fd, en, now+int64(w.pongWait))
+	return expirePing
+}
+
+func (w *Wheel) schedule(fd int, en *entry, deadline int64) {
+	// Round up, a slot is visited once its whole tick has begun.
+	tick := (deadline + int64(Tick) - 1) / int64(Tick)
+	if tick <= w.current {
+		tick = w.current + 1
+	}
+	en.deadline = deadline
+	en.slot = int(tick % int64(len(w.slots)))
+	w.slots[en.slot][fd] = struct{}{}
+}
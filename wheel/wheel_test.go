@@ -0,0 +1,123 @@
+package wheel
+
+import (
+	"testing"
+	"time"
+)
+
+// advance is a move of the wheel to after seconds from the start, with
+// the fds touched beforehand and those expected to be pinged and expired.
+type advance struct {
+	after   float64
+	touch   []int
+	ping    []int
+	expired []int
+}
+
+func TestAdvance(t *testing.T) {
+	tests := []struct {
+		name           string
+		idle, pongWait time.Duration
+		steps          []advance
+	}{
+		{
+			name: "ping then evict",
+			idle: 3 * time.Second, pongWait: 2 * time.Second,
+			steps: []advance{
+				{after: 2},
+				{after: 4.5, ping: []int{1}},
+				{after: 5.5},
+				{after: 7.5, expired: []int{1}},
+				{after: 20},
+			},
+		},
+		{
+			name: "activity answers a ping",
+			idle: 3 * time.Second, pongWait: 2 * time.Second,
+			steps: []advance{
+				{after: 4.5, ping: []int{1}},
+				{after: 5.5, touch: []int{1}},
+				{after: 7.5},
+				{after: 9.5, ping: []int{1}},
+			},
+		},
+		{
+			name: "activity postpones the ping",
+			idle: 3 * time.Second, pongWait: 2 * time.Second,
+			steps: []advance{
+				{after: 2, touch: []int{1}},
+				{after: 4.5},
+				{after: 6.5, ping: []int{1}},
+			},
+		},
+		{
+			name: "evicted without a ping",
+			idle: 3 * time.Second,
+			steps: []advance{
+				{after: 2},
+				{after: 4.5, expired: []int{1}},
+			},
+		},
+		{
+			name: "a long pause",
+			idle: 3 * time.Second, pongWait: 2 * time.Second,
+			steps: []advance{
+				{after: 60, ping: []int{1}},
+				{after: 120, expired: []int{1}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		w := New(tt.idle, tt.pongWait)
+		start := time.Now()
+		w.Add(1)
+		for i, st := range tt.steps {
+			for _, fd := range st.touch {
+				// Touch records the current time, move its entry to the
+				// time of the step instead.
+				w.Touch(fd)
+				w.entries[fd].last = start.Add(seconds(st.after)).UnixNano()
+			}
+			ping, expired := w.Advance(start.Add(seconds(st.after)))
+			if !equal(ping, st.ping) || !equal(expired, st.expired) {
+				t.Errorf("%v: step %v: pinged %v and expired %v, want %v and %v", tt.name, i, ping, expired, st.ping, st.expired)
+			}
+		}
+	}
+}
+
+func TestRemove(t *testing.T) {
+	w := New(time.Second, 0)
+	start := time.Now()
+	w.Add(1)
+	w.Add(2)
+	w.Remove(1)
+	w.Remove(3)
+	if _, expired := w.Advance(start.Add(5 * time.Second)); !equal(expired, []int{2}) {
+		t.Errorf("expired %v, want [2]", expired)
+	}
+	if len(w.entries) != 0 {
+		t.Errorf("%v entries left", len(w.entries))
+	}
+	for i, slot := range w.slots {
+		if len(slot) != 0 {
+			t.Errorf("slot %v holds %v", i, slot)
+		}
+	}
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+func equal(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
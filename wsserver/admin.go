@@ -0,0 +1,94 @@
+package wsserver
+
+import (
+	"github.com/eranyanay/1m-go-websockets/admin"
+	"github.com/gobwas/ws"
+	"sync/atomic"
+	"time"
+)
+
+// ID returns the identifier of c in the admin API: its fd in the upper 32
+// bits and its generation in the lower ones, so that it is unique among
+// the connections of the server and increases with the fd.
+func (c *Conn) ID() uint64 {
+	return uint64(c.fd)<<32 | uint64(c.gen)
+}
+
+// Admin returns the connections of s as an admin.Source. Connections are
+// closed with Kick.
+func (s *Server) Admin() admin.Source {
+	return adminSource{s}
+}
+
+type adminSource struct {
+	s *Server
+}
+
+func (a adminSource) Conns(after uint64, limit int) []admin.Conn {
+	conns := a.s.conns.after(after, limit)
+	infos := make([]admin.Conn, len(conns))
+	for i, c := range conns {
+		infos[i] = info(c)
+	}
+	return infos
+}
+
+func (a adminSource) Conn(id uint64) (admin.Conn, bool) {
+	c := a.lookup(id)
+	if c == nil {
+		return admin.Conn{}, false
+	}
+	in := info(c)
+	c.mu.Lock()
+	in.Details = map[string]interface{}{
+		"queued_frames": len(c.frames),
+		"closing":       c.closing,
+		"delayed":       c.delayed != 0,
+	}
+	c.mu.Unlock()
+	in.Details["buffered_bytes"] = atomic.LoadInt64(&c.buffered)
+	in.Details["compressed"] = c.dec.deflate
+	if st, ok := c.TLSState(); ok {
+		in.Details["tls_server_name"] = st.ServerName
+	}
+	in.Details["topics"] = a.s.topicNames(c)
+	return in, true
+}
+
+func (a adminSource) Close(id uint64, code int, reason string) error {
+	c := a.lookup(id)
+	if c == nil {
+		return admin.ErrNotFound
+	}
+	return c.Kick(ws.StatusCode(code), reason)
+}
+
+func (a adminSource) Send(id uint64, binary bool, msg []byte) error {
+	c := a.lookup(id)
+	if c == nil {
+		return admin.ErrNotFound
+	}
+	op := ws.OpText
+	if binary {
+		op = ws.OpBinary
+	}
+	return c.WriteMessage(op, msg)
+}
+
+func (a adminSource) lookup(id uint64) *Conn {
+	return a.s.conns.get(int(id>>32), uint32(id))
+}
+
+// info returns the counters of c.
+func info(c *Conn) admin.Conn {
+	return admin.Conn{
+		ID:          c.ID(),
+		Remote:      c.RemoteAddr().String(),
+		Connected:   time.Unix(0, c.since),
+		LastActive:  time.Unix(0, atomic.LoadInt64(&c.active)),
+		MessagesIn:  atomic.LoadInt64(&c.traffic.messagesIn),
+		BytesIn:     atomic.LoadInt64(&c.traffic.bytesIn),
+		MessagesOut: atomic.LoadInt64(&c.traffic.messagesOut),
+		BytesOut:    atomic.LoadInt64(&c.traffic.bytesOut),
+	}
+}
@@ -0,0 +1,120 @@
+package wsserver
+
+import (
+	"github.com/gobwas/ws"
+	"sync"
+)
+
+// BroadcastStats reports how a broadcast frame was handed to the
+// connections of the server.
+type BroadcastStats struct {
+	// Delivered is the number of connections the frame was written to
+	// entirely.
+	Delivered int
+	// Slow is the number of connections the frame was queued for, because
+	// their socket buffer was full or earlier frames were still queued.
+	Slow int
+	// Dropped is the number of connections that did not get the frame:
+	// their queue was full, they were closing or writing to them failed.
+	Dropped int
+}
+
+func (st *BroadcastStats) add(o BroadcastStats) {
+	st.Delivered += o.Delivered
+	st.Slow += o.Slow
+	st.Dropped += o.Dropped
+}
+
+// Broadcast sends a single frame message of type op to every connection.
+// The message is compressed once for the connections that negotiated
+// compression. See BroadcastFrame.
+func (s *Server) Broadcast(op ws.OpCode, payload []byte) (BroadcastStats, error) {
+	frames, err := s.compile(op, payload)
+	if err != nil {
+		return BroadcastStats{}, err
+	}
+	return s.fanOut(s.conns.all(), frames), nil
+}
+
+// BroadcastFrame writes an encoded frame to every connection. The frame is
+// shared by all of them rather than copied, and must not be modified
+// afterwards. Writes never block, frames that do not fit in a socket buffer
+// are queued as with Conn.Write.
+func (s *Server) BroadcastFrame(frame []byte) BroadcastStats {
+	return s.fanOut(s.conns.all(), frames{plain: frame})
+}
+
+// frames is a message encoded once for many connections, and compressed
+// for those that negotiated compression unless deflated is nil.
+type frames struct {
+	plain, deflated []byte
+}
+
+// compile encodes a single frame message of type op.
+func (s *Server) compile(op ws.OpCode, payload []byte) (f frames, err error) {
+	if f.plain, err = ws.CompileFrame(ws.NewFrame(op, true, payload)); err != nil {
+		return f, err
+	}
+	if s.opts.Compression.Enabled {
+		f.deflated, err = s.deflate.frame(op, payload)
+	}
+	return f, err
+}
+
+// fanOut writes frames to conns. Connections are sharded by event loop
+// and every shard is written from its own goroutine.
+func (s *Server) fanOut(conns []*Conn, frames frames) BroadcastStats {
+	shards := make(map[*loop][]*Conn, len(s.loops))
+	for _, c := range conns {
+		shards[c.loop] = append(shards[c.loop], c)
+	}
+	results := make([]BroadcastStats, 0, len(shards))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, conns := range shards {
+		wg.Add(1)
+		go func(conns []*Conn) {
+			defer wg.Done()
+			var st BroadcastStats
+			for _, c := range conns {
+				if frames.deflated != nil && c.dec.deflate {
+					st.add(c.broadcast(frames.deflated))
+				} else {
+					st.add(c.broadcast(frames.plain))
+				}
+			}
+			mu.Lock()
+			results = append(results, st)
+			mu.Unlock()
+		}(conns)
+	}
+	wg.Wait()
+	var st BroadcastStats
+	for _, r := range results {
+		st.add(r)
+	}
+	return st
+}
+
+// broadcast writes frame to c and counts the outcome. A connection that
+// fails to write is closed.
+func (c *Conn) broadcast(frame []byte) BroadcastStats {
+	c.mu.Lock()
+	if c.closed || c.closing {
+		c.mu.Unlock()
+		return BroadcastStats{Dropped: 1}
+	}
+	err := c.write(frame)
+	queued := len(c.frames) > 0
+	c.mu.Unlock()
+	switch {
+	case err == ErrQueueFull:
+		return BroadcastStats{Dropped: 1}
+	case err != nil:
+		c.loop.close(c, err)
+		return BroadcastStats{Dropped: 1}
+	case queued:
+		return BroadcastStats{Slow: 1}
+	}
+	return BroadcastStats{Delivered: 1}
+}
@@ -0,0 +1,306 @@
+package wsserver
+
+import (
+	"crypto/tls"
+	"errors"
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/eranyanay/1m-go-websockets/poller"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/gobwas/ws"
+	"golang.org/x/sys/unix"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned by Conn.Write when the peer is too slow to
+	// keep up with the frames queued for it.
+	ErrQueueFull = errors.New("wsserver: outbound queue is full")
+	// ErrClosed is returned when writing to a closed connection.
+	ErrClosed = errors.New("wsserver: connection is closed")
+	// ErrIdle is reported to Handler.OnClose for connections closed
+	// because they did not answer a heartbeat ping.
+	ErrIdle = errors.New("wsserver: connection is idle")
+	// ErrServerClosed is returned when registering a connection with a
+	// closed server.
+	ErrServerClosed = errors.New("wsserver: server is closed")
+	// ErrRateLimited is reported to Handler.OnClose for connections closed
+	// because they exceeded the rate limit.
+	ErrRateLimited = errors.New("wsserver: rate limit exceeded")
+	// ErrKicked is reported to Handler.OnClose for connections closed with
+	// Kick.
+	ErrKicked = errors.New("wsserver: connection kicked")
+)
+
+// Conn is a WebSocket connection registered with one of the server's event
+// loops.
+type Conn struct {
+	// buffered is the number of bytes the decoder keeps between reads. It
+	// is first in the struct to be 64-bit aligned for atomic access.
+	buffered int64
+	// traffic counts the messages and bytes of the connection, and since
+	// and active are when it was registered and last heard from, in Unix
+	// nanoseconds, as reported by the admin API.
+	traffic traffic
+	since   int64
+	active  int64
+
+	conn net.Conn
+	fd   int
+	gen  uint32
+	loop *loop
+	// tls is set for connections served over TLS.
+	tls *tlsConn
+
+	// dec and rate are only used by the goroutine the connection is
+	// reported to.
+	dec  decoder
+	rate ratelimit.Bucket
+
+	// mu guards the outbound queue and the registration state below.
+	mu sync.Mutex
+	// frames holds encoded frames that did not fit in the socket buffer.
+	// They are written once the poller reports the socket as writable.
+	frames [][]byte
+	// polling is set while writability is polled for.
+	polling bool
+	// busy is set while a one-shot connection is handed to a worker and
+	// disarmed, so its registration must not be modified until resumed.
+	busy bool
+	// opening is set until the fd is polled, once OnOpen returned.
+	opening bool
+	// closing is set once a close frame was queued, after which no other
+	// frame may be sent.
+	closing bool
+	closed  bool
+	// delayed is the time, in Unix nanoseconds, until which the connection
+	// is not read because it exceeded the rate limit, or zero.
+	delayed int64
+	// failed is the error the connection lingers with since it was sent a
+	// close frame for misbehaving.
+	failed error
+
+	// subs are the topics the connection subscribed to, with its index
+	// among their members, guarded by the server's topicsMu.
+	subs map[*topic]int
+
+	ctx interface{}
+}
+
+// NetConn returns the underlying network connection. It must not be read
+// from or written to directly.
+func (c *Conn) NetConn() net.Conn {
+	return c.conn
+}
+
+// TLSState returns the state of the TLS connection, such as the server name
+// the client asked for, and false if c is not served over TLS.
+func (c *Conn) TLSState() (tls.ConnectionState, bool) {
+	if c.tls == nil {
+		return tls.ConnectionState{}, false
+	}
+	return c.tls.ConnectionState(), true
+}
+
+// RemoteAddr returns the remote network address.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// SetContext attaches an arbitrary value to the connection.
+func (c *Conn) SetContext(v interface{}) {
+	c.mu.Lock()
+	c.ctx = v
+	c.mu.Unlock()
+}
+
+// Context returns the value attached with SetContext.
+func (c *Conn) Context() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ctx
+}
+
+// WriteMessage sends a single frame message of type op, compressed if the
+// connection negotiated compression. See Write.
+func (c *Conn) WriteMessage(op ws.OpCode, p []byte) error {
+	var frame []byte
+	var err error
+	// deflate is set before the connection is registered.
+	if c.dec.deflate {
+		frame, err = c.loop.server.deflate.frame(op, p)
+	} else {
+		frame, err = ws.CompileFrame(ws.NewFrame(op, true, p))
+	}
+	if err != nil {
+		return err
+	}
+	return c.Write(frame)
+}
+
+// Write queues an encoded frame and writes as much of the queue as the
+// socket accepts right away. The rest is written by the event loop once
+// the socket is writable again. Write never blocks; ErrQueueFull is
+// returned when the peer is too slow to keep up. frame must not be
+// modified afterwards, but may be shared between connections.
+func (c *Conn) Write(frame []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.closing {
+		return ErrClosed
+	}
+	return c.write(frame)
+}
+
+// CloseHandshake sends a close frame with code and reason after the frames
+// already queued. The connection is closed once the peer answers with its
+// own close frame; frames written in the meantime are rejected with
+// ErrClosed. Peers that never answer are left to the heartbeat, if any.
+func (c *Conn) CloseHandshake(code ws.StatusCode, reason string) error {
+	frame, err := ws.CompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.closing {
+		return ErrClosed
+	}
+	c.closing = true
+	return c.write(frame)
+}
+
+// Kick sends a close frame with code and reason after the frames already
+// queued, and closes the connection with ErrKicked once the peer hangs up
+// or closes.Linger has passed. Unlike CloseHandshake it does not wait for
+// the peer to answer: what the peer sends meanwhile is discarded. A
+// connection that cannot be sent the frame is closed right away.
+func (c *Conn) Kick(code ws.StatusCode, reason string) error {
+	frame, err := ws.CompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, reason)))
+	if err != nil {
+		return err
+	}
+	if err := c.fail(frame, ErrKicked); err != nil {
+		return c.loop.close(c, err)
+	}
+	return nil
+}
+
+// write queues frame, encrypted if c is served over TLS, and flushes the
+// queue. c.mu must be held.
+func (c *Conn) write(frame []byte) error {
+	if len(c.frames) >= c.loop.queueLimit {
+		return ErrQueueFull
+	}
+	atomic.AddInt64(&c.loop.traffic.messagesOut, 1)
+	atomic.AddInt64(&c.loop.traffic.bytesOut, int64(len(frame)))
+	atomic.AddInt64(&c.traffic.messagesOut, 1)
+	atomic.AddInt64(&c.traffic.bytesOut, int64(len(frame)))
+	if c.tls != nil {
+		// A sealed record has to be sent for the next ones to be valid,
+		// so the queue is only checked before.
+		var err error
+		if frame, err = c.tls.seal(frame); err != nil {
+			return err
+		}
+	}
+	return c.push(frame)
+}
+
+// push queues bytes to send and flushes the queue. c.mu must be held.
+func (c *Conn) push(frame []byte) error {
+	c.frames = append(c.frames, frame)
+	if c.polling {
+		return nil
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	if len(c.frames) > 0 {
+		c.polling = true
+		if !c.busy && !c.opening {
+			return c.loop.arm(c)
+		}
+	}
+	return nil
+}
+
+// fail sends frame, the close frame of a connection the server closes for
+// misbehaving with err or the answer to the close frame of the peer, and
+// shuts down the write side of the socket. Closing
+// the socket while the peer is still sending would reset the connection
+// and could drop the frame on its way, so the connection lingers instead:
+// what the peer sends is discarded until it hangs up or closes.Linger has
+// passed, and it is then closed with err. fail returns err if the
+// connection has to be closed right away instead.
+func (c *Conn) fail(frame []byte, err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || c.closing {
+		return err
+	}
+	c.closing = true
+	if werr := c.write(frame); werr != nil {
+		return err
+	}
+	if len(c.frames) == 0 {
+		unix.Shutdown(c.fd, unix.SHUT_WR)
+	}
+	c.failed = err
+	c.loop.delayed.Push(lingering{c}, time.Now().Add(closes.Linger))
+	return nil
+}
+
+// lingering is the entry of a connection closed for misbehaving in the
+// delayed queue of its loop, which closes it once due.
+type lingering struct {
+	c *Conn
+}
+
+// failure returns the error c lingers with since fail, or nil.
+func (c *Conn) failure() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.failed
+}
+
+// discard reads and drops what a lingering connection sent, up to
+// maxReadBufferSize bytes per call. It returns nil while the peer has
+// not hung up, and the error c failed with once it did.
+func (c *Conn) discard() error {
+	var buf [readChunk]byte
+	for n := 0; n < maxReadBufferSize; {
+		m, err := unix.Read(c.fd, buf[:])
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EAGAIN:
+			return nil
+		case err != nil || m == 0:
+			return c.failure()
+		}
+		n += m
+	}
+	return nil
+}
+
+// Close closes the connection without a closing handshake.
+func (c *Conn) Close() error {
+	return c.loop.close(c, nil)
+}
+
+func (c *Conn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
+
+// flush writes queued frames until the queue is empty or the socket buffer
+// is full. c.mu must be held.
+func (c *Conn) flush() error {
+	var err error
+	c.frames, err = poller.Flush(c.fd, c.frames)
+	return err
+}
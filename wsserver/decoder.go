@@ -0,0 +1,296 @@
+package wsserver
+
+import (
+	"encoding/binary"
+	"github.com/gobwas/ws"
+	"golang.org/x/sys/unix"
+	"io"
+	"unicode/utf8"
+)
+
+var (
+	errUnmaskedFrame   = ws.ProtocolError("frame from client is not masked")
+	errReservedBits    = ws.ProtocolError("non-zero reserved bits")
+	errReservedOpCode  = ws.ProtocolError("reserved opcode")
+	errControlFrame    = ws.ProtocolError("fragmented or oversized control frame")
+	errUnexpectedFrame = ws.ProtocolError("unexpected continuation or data frame")
+	errCloseFrame      = ws.ProtocolError("close frame payload of one byte")
+	errInvalidUTF8     = ws.ProtocolError("invalid UTF-8 in text message")
+	errFrameTooBig     = ws.ProtocolError("frame exceeds the size limit")
+	errMessageTooBig   = ws.ProtocolError("message exceeds the size limit")
+)
+
+const (
+	// readChunk is the minimum amount of bytes read from a socket per read
+	// call.
+	readChunk = 4096
+	// readBufferSize is the initial size of a readBuffer.
+	readBufferSize = 64 << 10
+	// maxReadBufferSize is the size past which a readBuffer grown by a
+	// large frame is released once the frame was dispatched.
+	maxReadBufferSize = 1 << 20
+	// maxPendingCopy is the size of the largest partial frame copied in
+	// and out of the lent buffer. Larger ones are kept in a buffer of the
+	// connection's own, which is read into directly, so that a frame
+	// trickled a few bytes at a time is not copied on every read.
+	maxPendingCopy = readChunk
+	// defaultMaxMessageSize bounds the messages of a client unless
+	// Options.MaxMessageSize is set.
+	defaultMaxMessageSize = 16 << 20
+)
+
+// limits bounds what a client may send.
+type limits struct {
+	frame, message int64
+}
+
+// readBuffer is a scratch buffer frames are read and decoded in. Every
+// event loop, and every worker in one-shot mode, owns one and lends it to
+// the connection it is serving, so idle connections do not hold a read
+// buffer of their own.
+type readBuffer struct {
+	// buf holds bytes read from the socket, buf[off:] is not decoded yet.
+	buf []byte
+	off int
+	// inflated holds the last decompressed message, and cipher the last
+	// bytes read from a TLS connection.
+	inflated []byte
+	cipher   []byte
+	// spare holds the buffer of the event loop while buf is the buffer of
+	// the connection being served.
+	spare []byte
+}
+
+// fill reads once from the non-blocking socket fd. It returns false when
+// nothing was available, and io.EOF when the peer has shut down its side
+// of the connection.
+func (rb *readBuffer) fill(fd int) (bool, error) {
+	rb.grow()
+	for {
+		n, err := unix.Read(fd, rb.buf[len(rb.buf):cap(rb.buf)])
+		if err == unix.EINTR {
+			continue
+		}
+		if err == unix.EAGAIN {
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if n == 0 {
+			return false, io.EOF
+		}
+		rb.buf = rb.buf[:len(rb.buf)+n]
+		return true, nil
+	}
+}
+
+// grow drops the bytes already decoded and makes room for at least
+// readChunk more.
+func (rb *readBuffer) grow() {
+	if rb.off > 0 {
+		rb.buf = rb.buf[:copy(rb.buf, rb.buf[rb.off:])]
+		rb.off = 0
+	}
+	if cap(rb.buf)-len(rb.buf) < readChunk {
+		buf := make([]byte, len(rb.buf), 2*cap(rb.buf)+readChunk)
+		copy(buf, rb.buf)
+		rb.buf = buf
+	}
+}
+
+// decoder decodes the frames of a connection incrementally. Between reads
+// it keeps whatever does not form a complete frame yet, as well as the
+// fragments of a message that is not finished, so a connection sending a
+// frame byte by byte never blocks the event loop.
+type decoder struct {
+	// pending holds the beginning of a frame left over by the last read.
+	// Past maxPendingCopy bytes, it is the buffer the next read goes to.
+	pending []byte
+	// op and message hold a fragmented data message in progress, and
+	// compressed is set if it is compressed.
+	op         ws.OpCode
+	message    []byte
+	compressed bool
+
+	// deflate is set if permessage-deflate was negotiated. The peer may
+	// then compress messages with the history of the previous ones, of
+	// which window keeps the last windowSize bytes, or none if windowSize
+	// is zero.
+	deflate    bool
+	windowSize int
+	window     []byte
+}
+
+// load lends rb to d, starting with the bytes d kept from its last read.
+// A large partial frame is not copied: rb reads into d's buffer instead,
+// until store gives rb its own back.
+func (d *decoder) load(rb *readBuffer) {
+	if rb.buf == nil {
+		rb.buf = make([]byte, 0, readBufferSize)
+	}
+	if len(d.pending) > maxPendingCopy {
+		rb.spare, rb.buf = rb.buf, d.pending
+	} else {
+		rb.buf = append(rb.buf[:0], d.pending...)
+	}
+	rb.off = 0
+	d.pending = nil
+}
+
+// store takes the undecoded bytes back from rb before it is lent to
+// another connection. A large partial frame is copied once into a buffer
+// of d's own, and then kept there.
+func (d *decoder) store(rb *readBuffer) {
+	rest := rb.buf[rb.off:]
+	switch {
+	case len(rest) > maxPendingCopy && rb.spare != nil:
+		if rb.off > 0 {
+			rb.buf = rb.buf[:copy(rb.buf, rest)]
+		}
+		d.pending = rb.buf
+		rb.buf, rb.spare = rb.spare, nil
+	case len(rest) > maxPendingCopy:
+		d.pending = append(make([]byte, 0, 2*len(rest)), rest...)
+	case len(rest) > 0:
+		d.pending = append([]byte(nil), rest...)
+	}
+	if rb.spare != nil {
+		rb.buf, rb.spare = rb.spare, nil
+	}
+	rb.buf, rb.off = rb.buf[:0], 0
+	if cap(rb.buf) > maxReadBufferSize {
+		rb.buf = nil
+	}
+	if cap(rb.inflated) > maxReadBufferSize {
+		rb.inflated = nil
+	}
+}
+
+// retained returns the number of bytes d keeps between reads.
+func (d *decoder) retained() int {
+	return cap(d.pending) + cap(d.message) + cap(d.window)
+}
+
+// next returns the next complete message decoded from rb. Control frames
+// are returned as soon as they are complete, even between the fragments of
+// a data message. ok is false when more bytes are needed. Unless it was
+// fragmented, the payload is unmasked in place and borrows rb's memory, so
+// it is only valid until rb is filled again. Compressed messages are
+// decompressed in rb as well. Frames and messages exceeding lim are
+// rejected as soon as their header is read.
+func (d *decoder) next(rb *readBuffer, lim limits) (op ws.OpCode, payload []byte, ok bool, err error) {
+	var rsv byte
+	if d.deflate {
+		rsv = ws.Rsv(true, false, false)
+	}
+	for {
+		b := rb.buf[rb.off:]
+		h, n, complete, err := parseHeader(b, rsv, lim.frame)
+		if !complete || err != nil {
+			return 0, nil, false, err
+		}
+		if !h.OpCode.IsControl() && int64(len(d.message))+h.Length > lim.message {
+			return 0, nil, false, errMessageTooBig
+		}
+		if h.Length > int64(len(b)-n) {
+			return 0, nil, false, nil
+		}
+		end := n + int(h.Length)
+		payload = b[n:end]
+		ws.Cipher(payload, h.Mask, 0)
+		rb.off += end
+
+		switch {
+		case h.Rsv1() && (h.OpCode.IsControl() || h.OpCode == ws.OpContinuation):
+			return 0, nil, false, errCompressedCtrl
+		case h.OpCode.IsControl():
+			return h.OpCode, payload, true, nil
+		case h.OpCode == ws.OpContinuation:
+			if d.op == 0 {
+				return 0, nil, false, errUnexpectedFrame
+			}
+			d.message = append(d.message, payload...)
+		case d.op != 0:
+			return 0, nil, false, errUnexpectedFrame
+		case h.Fin:
+			return d.complete(h.OpCode, payload, h.Rsv1(), rb, lim)
+		default:
+			d.op, d.message = h.OpCode, append([]byte(nil), payload...)
+			d.compressed = h.Rsv1()
+		}
+		if h.Fin {
+			op, payload, compressed := d.op, d.message, d.compressed
+			d.op, d.message, d.compressed = 0, nil, false
+			return d.complete(op, payload, compressed, rb, lim)
+		}
+	}
+}
+
+// complete returns a data message once its last frame is decoded,
+// decompressing it first if it is compressed. Text messages must be valid
+// UTF-8.
+func (d *decoder) complete(op ws.OpCode, payload []byte, compressed bool, rb *readBuffer, lim limits) (ws.OpCode, []byte, bool, error) {
+	if compressed {
+		var err error
+		if payload, err = d.inflate(payload, rb, lim.message); err != nil {
+			return 0, nil, false, err
+		}
+	}
+	if op == ws.OpText && !utf8.Valid(payload) {
+		return 0, nil, false, errInvalidUTF8
+	}
+	return op, payload, true, nil
+}
+
+// parseHeader parses a client frame header from the beginning of b, which
+// may only set the reserved bits in rsv and send data frames of up to
+// maxFrame bytes. It returns the header and its size, or ok == false if b
+// is too short.
+func parseHeader(b []byte, rsv byte, maxFrame int64) (h ws.Header, n int, ok bool, err error) {
+	if len(b) < 2 {
+		return h, 0, false, nil
+	}
+	h.Fin = b[0]&0x80 != 0
+	h.Rsv = (b[0] & 0x70) >> 4
+	h.OpCode = ws.OpCode(b[0] & 0x0f)
+	h.Masked = b[1]&0x80 != 0
+
+	switch {
+	case h.Rsv&^rsv != 0:
+		return h, 0, false, errReservedBits
+	case h.OpCode.IsReserved():
+		return h, 0, false, errReservedOpCode
+	case !h.Masked:
+		return h, 0, false, errUnmaskedFrame
+	}
+
+	n = 2
+	length := int64(b[1] & 0x7f)
+	switch length {
+	case 126:
+		if len(b) < n+2 {
+			return h, 0, false, nil
+		}
+		length = int64(binary.BigEndian.Uint16(b[n:]))
+		n += 2
+	case 127:
+		if len(b) < n+8 {
+			return h, 0, false, nil
+		}
+		length = int64(binary.BigEndian.Uint64(b[n:]))
+		n += 8
+	}
+	if h.OpCode.IsControl() && (!h.Fin || length > ws.MaxControlFramePayloadSize) {
+		return h, 0, false, errControlFrame
+	}
+	if length < 0 || length > maxFrame && !h.OpCode.IsControl() {
+		return h, 0, false, errFrameTooBig
+	}
+	if len(b) < n+4 {
+		return h, 0, false, nil
+	}
+	copy(h.Mask[:], b[n:n+4])
+	h.Length = length
+	return h, n + 4, true, nil
+}
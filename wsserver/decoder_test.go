@@ -0,0 +1,235 @@
+package wsserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/gobwas/ws"
+	"testing"
+)
+
+// clientFrame encodes a frame as a client sends it, masked unless
+// unmasked is set.
+type clientFrame struct {
+	op       ws.OpCode
+	fin      bool
+	rsv      byte
+	payload  []byte
+	unmasked bool
+}
+
+func (f clientFrame) bytes(t *testing.T) []byte {
+	t.Helper()
+	h := ws.Header{Fin: f.fin, Rsv: f.rsv, OpCode: f.op, Length: int64(len(f.payload)), Masked: !f.unmasked}
+	payload := append([]byte(nil), f.payload...)
+	if h.Masked {
+		h.Mask = ws.NewMask()
+		ws.Cipher(payload, h.Mask, 0)
+	}
+	var b bytes.Buffer
+	if err := ws.WriteHeader(&b, h); err != nil {
+		t.Fatal(err)
+	}
+	b.Write(payload)
+	return b.Bytes()
+}
+
+func text(fin bool, p string) clientFrame {
+	return clientFrame{op: ws.OpText, fin: fin, payload: []byte(p)}
+}
+
+func continuation(fin bool, p string) clientFrame {
+	return clientFrame{op: ws.OpContinuation, fin: fin, payload: []byte(p)}
+}
+
+// compressed returns a frame carrying p compressed as permessage-deflate
+// does, without the empty block ending the flush.
+func compressed(t *testing.T, op ws.OpCode, p string) clientFrame {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestSpeed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte(p))
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return clientFrame{op: op, fin: true, rsv: ws.Rsv(true, false, false), payload: b.Bytes()[:b.Len()-4]}
+}
+
+type message struct {
+	op      ws.OpCode
+	payload string
+}
+
+type decoderTest struct {
+	name    string
+	frames  []clientFrame
+	lim     limits
+	deflate bool
+	want    []message
+	err     error
+}
+
+func decoderTests(t *testing.T) []decoderTest {
+	long := string(bytes.Repeat([]byte("x"), 70000))
+	return []decoderTest{
+		{name: "text", frames: []clientFrame{text(true, "hello")}, want: []message{{ws.OpText, "hello"}}},
+		{name: "binary", frames: []clientFrame{{op: ws.OpBinary, fin: true, payload: []byte{0xff, 0}}}, want: []message{{ws.OpBinary, "\xff\x00"}}},
+		{name: "empty", frames: []clientFrame{text(true, "")}, want: []message{{ws.OpText, ""}}},
+		{name: "16-bit length", frames: []clientFrame{text(true, long[:300])}, want: []message{{ws.OpText, long[:300]}}},
+		{name: "64-bit length", frames: []clientFrame{text(true, long)}, want: []message{{ws.OpText, long}}},
+		{
+			name:   "fragmented",
+			frames: []clientFrame{text(false, "he"), continuation(false, "l"), continuation(true, "lo")},
+			want:   []message{{ws.OpText, "hello"}},
+		},
+		{
+			name:   "control between fragments",
+			frames: []clientFrame{text(false, "he"), {op: ws.OpPing, fin: true, payload: []byte("p")}, continuation(true, "llo")},
+			want:   []message{{ws.OpPing, "p"}, {ws.OpText, "hello"}},
+		},
+		{
+			name:   "messages in a row",
+			frames: []clientFrame{text(true, "a"), {op: ws.OpClose, fin: true}, text(true, "b")},
+			want:   []message{{ws.OpText, "a"}, {ws.OpClose, ""}, {ws.OpText, "b"}},
+		},
+		{name: "unmasked", frames: []clientFrame{{op: ws.OpText, fin: true, payload: []byte("a"), unmasked: true}}, err: errUnmaskedFrame},
+		{name: "reserved bits", frames: []clientFrame{{op: ws.OpText, fin: true, rsv: ws.Rsv(true, false, false)}}, err: errReservedBits},
+		{name: "reserved bits with deflate", frames: []clientFrame{{op: ws.OpText, fin: true, rsv: ws.Rsv(false, true, false)}}, deflate: true, err: errReservedBits},
+		{name: "reserved opcode", frames: []clientFrame{{op: 0x3, fin: true}}, err: errReservedOpCode},
+		{name: "fragmented control", frames: []clientFrame{{op: ws.OpPing, fin: false}}, err: errControlFrame},
+		{name: "oversized control", frames: []clientFrame{{op: ws.OpPing, fin: true, payload: make([]byte, 126)}}, err: errControlFrame},
+		{name: "lone continuation", frames: []clientFrame{continuation(true, "a")}, err: errUnexpectedFrame},
+		{name: "data inside fragments", frames: []clientFrame{text(false, "a"), text(true, "b")}, err: errUnexpectedFrame},
+		{name: "invalid UTF-8", frames: []clientFrame{text(true, "\xff")}, err: errInvalidUTF8},
+		{
+			name:   "UTF-8 split across fragments",
+			frames: []clientFrame{text(false, "\xc3"), continuation(true, "\xa9")},
+			want:   []message{{ws.OpText, "é"}},
+		},
+		{name: "frame too big", frames: []clientFrame{text(true, "0123456789a")}, lim: limits{frame: 10, message: 100}, err: errFrameTooBig},
+		{
+			name:   "message too big",
+			frames: []clientFrame{text(false, "01234567"), continuation(true, "01234567")},
+			lim:    limits{frame: 10, message: 15},
+			err:    errMessageTooBig,
+		},
+		{
+			name:   "control frames above the frame limit",
+			frames: []clientFrame{{op: ws.OpPing, fin: true, payload: []byte("0123456789abc")}},
+			lim:    limits{frame: 10, message: 10},
+			want:   []message{{ws.OpPing, "0123456789abc"}},
+		},
+		{name: "compressed", frames: []clientFrame{compressed(t, ws.OpText, "hello hello hello")}, deflate: true, want: []message{{ws.OpText, "hello hello hello"}}},
+		{name: "compressed without deflate", frames: []clientFrame{compressed(t, ws.OpText, "hello")}, err: errReservedBits},
+		{name: "compressed control", frames: []clientFrame{compressed(t, ws.OpPing, "hello")}, deflate: true, err: errCompressedCtrl},
+		{
+			name:    "compressed bomb",
+			frames:  []clientFrame{compressed(t, ws.OpBinary, long)},
+			lim:     limits{frame: 1000, message: 1000},
+			deflate: true,
+			err:     errMessageTooBig,
+		},
+		{
+			name:    "invalid compressed",
+			frames:  []clientFrame{{op: ws.OpText, fin: true, rsv: ws.Rsv(true, false, false), payload: []byte{0xff, 0xff}}},
+			deflate: true,
+			err:     errInflate,
+		},
+	}
+}
+
+// decodeAll decodes the frames of tt, read chunk bytes at a time, or all at
+// once if chunk is zero.
+func decodeAll(t *testing.T, tt decoderTest, chunk int) ([]message, error) {
+	var in []byte
+	for _, f := range tt.frames {
+		in = append(in, f.bytes(t)...)
+	}
+	if chunk == 0 {
+		chunk = len(in)
+	}
+	lim := tt.lim
+	if lim.message == 0 {
+		lim = limits{frame: defaultMaxMessageSize, message: defaultMaxMessageSize}
+	}
+	d := decoder{deflate: tt.deflate}
+	var rb readBuffer
+	var got []message
+	for len(in) > 0 {
+		n := chunk
+		if n > len(in) {
+			n = len(in)
+		}
+		d.load(&rb)
+		rb.buf = append(rb.buf, in[:n]...)
+		in = in[n:]
+		for {
+			op, payload, ok, err := d.next(&rb, lim)
+			if err != nil {
+				return got, err
+			}
+			if !ok {
+				break
+			}
+			got = append(got, message{op, string(payload)})
+		}
+		d.store(&rb)
+	}
+	if len(d.pending) > 0 || d.op != 0 {
+		t.Errorf("%v: %v bytes and a message of type %v left", tt.name, len(d.pending), d.op)
+	}
+	return got, nil
+}
+
+func TestDecoder(t *testing.T) {
+	for _, tt := range decoderTests(t) {
+		for _, chunk := range []int{0, 1} {
+			got, err := decodeAll(t, tt, chunk)
+			if err != tt.err {
+				t.Errorf("%v, chunks of %v: error %v, want %v", tt.name, chunk, err, tt.err)
+				continue
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("%v, chunks of %v: %v messages, want %v", tt.name, chunk, len(got), len(tt.want))
+				continue
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("%v, chunks of %v: message %v is %v %.20q, want %v %.20q", tt.name, chunk, i, got[i].op, got[i].payload, tt.want[i].op, tt.want[i].payload)
+				}
+			}
+		}
+	}
+}
+
+// TestDecoderKeepsLargePartialFrame checks that a large frame trickled in
+// is read into the connection's buffer instead of being copied in and out
+// of the lent one.
+func TestDecoderKeepsLargePartialFrame(t *testing.T) {
+	var d decoder
+	var rb readBuffer
+	d.load(&rb)
+	own := rb.buf
+	rb.buf = append(rb.buf, make([]byte, 2*maxPendingCopy)...)
+	d.store(&rb)
+	if &rb.buf[:1][0] != &own[:1][0] {
+		t.Fatal("the buffer of the loop was not given back")
+	}
+	kept := &d.pending[0]
+	for i := 0; i < 3; i++ {
+		d.load(&rb)
+		if &rb.buf[0] != kept {
+			t.Fatalf("read %v: the partial frame was copied", i)
+		}
+		rb.buf = append(rb.buf, 0)
+		d.store(&rb)
+		if &d.pending[0] != kept {
+			t.Fatalf("read %v: the partial frame was copied back", i)
+		}
+	}
+	if len(d.pending) != 2*maxPendingCopy+3 {
+		t.Fatalf("kept %v bytes, want %v", len(d.pending), 2*maxPendingCopy+3)
+	}
+}
@@ -0,0 +1,274 @@
+package wsserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"io"
+	"strconv"
+	"sync"
+)
+
+const (
+	// maxWindowBits is the window of compress/flate, and the default of
+	// permessage-deflate.
+	maxWindowBits = 15
+	// minWindowBits is the smallest history kept for a client. RFC 7692
+	// allows a window of 8 bits, which zlib raises to 9.
+	minWindowBits = 9
+)
+
+var (
+	errInflate        = ws.ProtocolError("invalid compressed message")
+	errCompressedCtrl = ws.ProtocolError("compressed control or continuation frame")
+
+	extensionName = []byte("permessage-deflate")
+	// deflateTail ends a compressed message: the empty stored block that
+	// senders strip, followed by a final one so that flate reports io.EOF.
+	deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+	inflaters sync.Pool
+)
+
+// Compression configures the permessage-deflate extension (RFC 7692).
+//
+// Messages sent by the server are always compressed on their own, and the
+// server_no_context_takeover parameter is always negotiated: compress/flate
+// writers can then be shared by every connection instead of costing
+// hundreds of KB each, and a message broadcast to many connections is
+// compressed once. compress/flate always compresses with a 32KB window, so
+// offers asking for a smaller server_max_window_bits are declined.
+type Compression struct {
+	// Enabled accepts permessage-deflate from clients that offer it.
+	Enabled bool
+	// Level is the compress/flate level messages are compressed with,
+	// flate.BestSpeed if zero.
+	Level int
+	// ClientNoContextTakeover asks clients to compress every message on
+	// its own. Otherwise the end of the last messages received from a
+	// client is kept, up to its window, to decompress the next ones.
+	ClientNoContextTakeover bool
+	// ClientMaxWindowBits limits the window of clients that let the server
+	// choose it, and so the memory kept per connection with context
+	// takeover, from 8 to 15 bits. 15 if zero.
+	ClientMaxWindowBits int
+}
+
+// negotiate returns the response to the first offer of permessage-deflate
+// among offers that can be accepted.
+func (o *Compression) negotiate(offers []httphead.Option) (httphead.Option, bool) {
+	for _, offer := range offers {
+		if !bytes.Equal(offer.Name, extensionName) {
+			continue
+		}
+		resp := map[string]string{"server_no_context_takeover": ""}
+		if o.ClientNoContextTakeover {
+			resp["client_no_context_takeover"] = ""
+		}
+		ok := true
+		offer.Parameters.ForEach(func(k, v []byte) bool {
+			switch string(k) {
+			case "server_no_context_takeover":
+				ok = len(v) == 0
+			case "client_no_context_takeover":
+				ok = len(v) == 0
+				resp["client_no_context_takeover"] = ""
+			case "server_max_window_bits":
+				bits, err := strconv.Atoi(string(v))
+				ok = err == nil && bits == maxWindowBits
+			case "client_max_window_bits":
+				bits := maxWindowBits
+				if len(v) > 0 {
+					var err error
+					bits, err = strconv.Atoi(string(v))
+					ok = err == nil && bits >= 8 && bits <= maxWindowBits
+				}
+				if limit := o.ClientMaxWindowBits; limit > 0 && limit < bits {
+					bits = limit
+				}
+				resp["client_max_window_bits"] = strconv.Itoa(bits)
+			default:
+				ok = false
+			}
+			return ok
+		})
+		if ok {
+			return httphead.NewOption(string(extensionName), resp), true
+		}
+	}
+	return httphead.Option{}, false
+}
+
+// selectExtensions is the ws.Upgrader callback negotiating compression on
+// connections accepted by Serve.
+func (o *Compression) selectExtensions(header []byte, selected []httphead.Option) ([]httphead.Option, bool) {
+	offers, ok := httphead.ParseOptions(header, nil)
+	if !ok {
+		return selected, false
+	}
+	if len(selected) > 0 {
+		return selected, true
+	}
+	if resp, ok := o.negotiate(offers); ok {
+		selected = append(selected, resp)
+	}
+	return selected, true
+}
+
+// handshakeState returns the state of a connection that negotiated the
+// extensions exts, or nil if it did not negotiate compression.
+func handshakeState(exts []httphead.Option) *connState {
+	for _, ext := range exts {
+		if !bytes.Equal(ext.Name, extensionName) {
+			continue
+		}
+		st := &connState{Deflate: true, WindowSize: 1 << maxWindowBits}
+		if _, ok := ext.Parameters.Get("client_no_context_takeover"); ok {
+			st.WindowSize = 0
+		} else if v, ok := ext.Parameters.Get("client_max_window_bits"); ok {
+			if bits, err := strconv.Atoi(string(v)); err == nil {
+				if bits < minWindowBits {
+					bits = minWindowBits
+				}
+				st.WindowSize = 1 << uint(bits)
+			}
+		}
+		return st
+	}
+	return nil
+}
+
+// compressor compresses outbound messages with pooled flate writers.
+type compressor struct {
+	level int
+	pool  sync.Pool
+}
+
+// frame compiles a compressed single frame message of type op.
+func (z *compressor) frame(op ws.OpCode, p []byte) ([]byte, error) {
+	var b bytes.Buffer
+	w, _ := z.pool.Get().(*flate.Writer)
+	if w == nil {
+		var err error
+		if w, err = flate.NewWriter(&b, z.level); err != nil {
+			return nil, err
+		}
+	} else {
+		w.Reset(&b)
+	}
+	w.Write(p)
+	err := w.Flush()
+	z.pool.Put(w)
+	if err != nil {
+		return nil, err
+	}
+	// Flush ends the output with an empty stored block, which the
+	// receiver appends back.
+	f := ws.NewFrame(op, true, b.Bytes()[:b.Len()-4])
+	f.Header.Rsv = ws.Rsv(true, false, false)
+	return ws.CompileFrame(f)
+}
+
+// inflater is a flate reader along with the source it reads from, pooled
+// together.
+type inflater struct {
+	src tailReader
+	r   io.ReadCloser
+}
+
+// inflate decompresses a message into rb's scratch buffer, with the history
+// of the previous messages if the peer uses context takeover. The result
+// is only valid until the next message is inflated. Decompression stops
+// past limit bytes, so that a small message cannot expand into an
+// unbounded one.
+func (d *decoder) inflate(p []byte, rb *readBuffer, limit int64) ([]byte, error) {
+	f, _ := inflaters.Get().(*inflater)
+	if f == nil {
+		f = &inflater{src: tailReader{p: p}}
+		f.r = flate.NewReaderDict(&f.src, d.window)
+	} else {
+		f.src = tailReader{p: p}
+		f.r.(flate.Resetter).Reset(&f.src, d.window)
+	}
+	defer inflaters.Put(f)
+
+	out := rb.inflated[:0]
+	for {
+		if int64(len(out)) > limit {
+			return nil, errMessageTooBig
+		}
+		if len(out) == cap(out) {
+			size := 2*cap(out) + readChunk
+			if int64(size) > limit+1 {
+				size = int(limit + 1)
+			}
+			buf := make([]byte, len(out), size)
+			copy(buf, out)
+			out = buf
+		}
+		n, err := f.r.Read(out[len(out):cap(out)])
+		out = out[:len(out)+n]
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errInflate
+		}
+	}
+	rb.inflated = out
+	d.remember(out)
+	return out, nil
+}
+
+// remember keeps the end of a decompressed message as the history the next
+// one may refer to.
+func (d *decoder) remember(p []byte) {
+	size := d.windowSize
+	if size == 0 {
+		return
+	}
+	if len(p) >= size {
+		d.window = append(d.window[:0], p[len(p)-size:]...)
+		return
+	}
+	if n := len(d.window) + len(p) - size; n > 0 {
+		d.window = d.window[:copy(d.window, d.window[n:])]
+	}
+	d.window = append(d.window, p...)
+}
+
+// tailReader reads a compressed payload followed by deflateTail. It is an
+// io.ByteReader, so that flate reads it without buffering.
+type tailReader struct {
+	p    []byte
+	tail int
+}
+
+func (r *tailReader) Read(b []byte) (int, error) {
+	n := copy(b, r.p)
+	r.p = r.p[n:]
+	if n < len(b) && r.tail < len(deflateTail) {
+		m := copy(b[n:], deflateTail[r.tail:])
+		r.tail += m
+		n += m
+	}
+	if n == 0 {
+		return 0, io.EOF
+	}
+	return n, nil
+}
+
+func (r *tailReader) ReadByte() (byte, error) {
+	if len(r.p) > 0 {
+		b := r.p[0]
+		r.p = r.p[1:]
+		return b, nil
+	}
+	if r.tail < len(deflateTail) {
+		b := deflateTail[r.tail]
+		r.tail++
+		return b, nil
+	}
+	return 0, io.EOF
+}
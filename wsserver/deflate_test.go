@@ -0,0 +1,137 @@
+package wsserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		opts   Compression
+		offers string
+		// want is the parameters of the response, sorted, or "-" if
+		// every offer is declined.
+		want string
+	}{
+		{Compression{}, "permessage-deflate", "server_no_context_takeover"},
+		{Compression{}, "x-webkit-deflate-frame", "-"},
+		{Compression{ClientNoContextTakeover: true}, "permessage-deflate", "client_no_context_takeover server_no_context_takeover"},
+		{Compression{}, "permessage-deflate; client_no_context_takeover", "client_no_context_takeover server_no_context_takeover"},
+		{Compression{}, "permessage-deflate; client_max_window_bits", "client_max_window_bits=15 server_no_context_takeover"},
+		{Compression{}, "permessage-deflate; client_max_window_bits=10", "client_max_window_bits=10 server_no_context_takeover"},
+		{Compression{ClientMaxWindowBits: 9}, "permessage-deflate; client_max_window_bits=12", "client_max_window_bits=9 server_no_context_takeover"},
+		{Compression{}, "permessage-deflate; client_max_window_bits=7", "-"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=15", "server_no_context_takeover"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=10", "-"},
+		{Compression{}, "permessage-deflate; server_max_window_bits=10, permessage-deflate", "server_no_context_takeover"},
+		{Compression{}, "permessage-deflate; unknown", "-"},
+	}
+	for _, tt := range tests {
+		offers, ok := httphead.ParseOptions([]byte(tt.offers), nil)
+		if !ok {
+			t.Fatalf("invalid offers %q", tt.offers)
+		}
+		got := "-"
+		if resp, ok := tt.opts.negotiate(offers); ok {
+			got = parameters(resp)
+		}
+		if got != tt.want {
+			t.Errorf("%+v, %q: %q, want %q", tt.opts, tt.offers, got, tt.want)
+		}
+	}
+}
+
+// parameters formats the parameters of opt, sorted.
+func parameters(opt httphead.Option) string {
+	var params []string
+	opt.Parameters.ForEach(func(k, v []byte) bool {
+		p := string(k)
+		if len(v) > 0 {
+			p += "=" + string(v)
+		}
+		params = append(params, p)
+		return true
+	})
+	sort.Strings(params)
+	return strings.Join(params, " ")
+}
+
+func TestHandshakeState(t *testing.T) {
+	tests := []struct {
+		ext    string
+		window int
+	}{
+		{"permessage-deflate; server_no_context_takeover", 1 << 15},
+		{"permessage-deflate; client_no_context_takeover", 0},
+		{"permessage-deflate; client_max_window_bits=10", 1 << 10},
+		{"permessage-deflate; client_max_window_bits=8", 1 << minWindowBits},
+	}
+	for _, tt := range tests {
+		exts, _ := httphead.ParseOptions([]byte(tt.ext), nil)
+		st := handshakeState(exts)
+		if st == nil || !st.Deflate || st.WindowSize != tt.window {
+			t.Errorf("%q: %+v, want a window of %v", tt.ext, st, tt.window)
+		}
+	}
+	if st := handshakeState(nil); st != nil {
+		t.Errorf("no extension: %+v, want nil", st)
+	}
+}
+
+// TestInflateContextTakeover decompresses messages compressed with the
+// history of the previous ones, as a client with context takeover sends
+// them.
+func TestInflateContextTakeover(t *testing.T) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := decoder{deflate: true, windowSize: 1 << 15}
+	var rb readBuffer
+	lim := limits{frame: 1 << 20, message: 1 << 20}
+	msgs := []string{"the quick brown fox jumps over the lazy dog", "the quick brown fox jumps over the lazy cat", "the lazy dog"}
+	for i, msg := range msgs {
+		b.Reset()
+		w.Write([]byte(msg))
+		if err := w.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		f := clientFrame{op: ws.OpText, fin: true, rsv: ws.Rsv(true, false, false), payload: b.Bytes()[:b.Len()-4]}
+		d.load(&rb)
+		rb.buf = append(rb.buf, f.bytes(t)...)
+		op, payload, ok, err := d.next(&rb, lim)
+		if err != nil || !ok || op != ws.OpText || string(payload) != msg {
+			t.Fatalf("message %v: %v %q %v %v, want %q", i, op, payload, ok, err, msg)
+		}
+		d.store(&rb)
+	}
+}
+
+func TestCompressorFrame(t *testing.T) {
+	z := compressor{level: flate.BestSpeed}
+	for _, msg := range []string{"", "hello", string(bytes.Repeat([]byte("ab"), 10000))} {
+		frame, err := z.frame(ws.OpText, []byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := ws.ReadFrame(bytes.NewReader(frame))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !f.Header.Rsv1() || !f.Header.Fin || f.Header.OpCode != ws.OpText {
+			t.Errorf("%.10q: header %+v", msg, f.Header)
+		}
+		var d decoder
+		var rb readBuffer
+		got, err := d.inflate(f.Payload, &rb, 1<<20)
+		if err != nil || string(got) != msg {
+			t.Errorf("%.10q: inflated to %.10q, %v", msg, got, err)
+		}
+	}
+}
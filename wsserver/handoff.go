@@ -0,0 +1,375 @@
+package wsserver
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"github.com/gobwas/ws"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"os"
+)
+
+// handoffBatch is the number of descriptors passed per message, below the
+// SCM_MAX_FD limit of 253.
+const handoffBatch = 250
+
+var errHandoff = errors.New("wsserver: malformed handoff")
+
+// connState is the protocol state of a connection passed to another
+// process: the bytes read but not decoded yet, an unfinished fragmented
+// message, the frames not written yet, the topics it subscribed to and
+// its compression history. The state of a new connection only holds the
+// compression it negotiated.
+type connState struct {
+	Pending    []byte
+	Op         ws.OpCode
+	Message    []byte
+	Compressed bool
+	Frames     [][]byte
+	Closing    bool
+	Topics     []string
+	Deflate    bool
+	WindowSize int
+	Window     []byte
+}
+
+// handoffRecord is a message of the handoff protocol. The descriptors of
+// its listeners and connections, in this order, are passed along with it.
+type handoffRecord struct {
+	Listeners int
+	Conns     []connState
+	Done      bool
+}
+
+// Handoff passes listeners and every registered connection to the process
+// at the other end of uc, which takes them over with Takeover, and then
+// closes the server without closing the sockets, so peers do not notice
+// the restart. listeners are closed in this process; they may include the
+// listeners given to Serve. Connections being registered, such as those
+// in OnOpen, are waited for and passed too. Connections served over TLS
+// are not passed and are closed. Connections lingering after a close
+// frame of the server, or delayed by the rate limit, are passed without
+// their timeout or delay, so the other process reads them until the peer
+// closes them. Both are counted and logged.
+func (s *Server) Handoff(uc *net.UnixConn, listeners []net.Listener) error {
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, ln := range listeners {
+		fl, ok := ln.(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return ErrUnsupportedListener{ln}
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+	}
+
+	// Stop serving before the state of the connections is taken, and let
+	// the connections being registered meanwhile join the others.
+	for _, ln := range listeners {
+		ln.Close()
+	}
+	s.halt()
+	s.wg.Wait()
+	s.registering.Wait()
+
+	fds := make([]int, len(files))
+	for i, f := range files {
+		fds[i] = int(f.Fd())
+	}
+	if err := writeRecord(uc, handoffRecord{Listeners: len(fds)}, fds); err != nil {
+		return err
+	}
+	conns := s.conns.all()
+	var loss handoffLoss
+	for i := 0; i < len(conns); i += handoffBatch {
+		batch := conns[i:]
+		if len(batch) > handoffBatch {
+			batch = batch[:handoffBatch]
+		}
+		var rec handoffRecord
+		var fds []int
+		for _, c := range batch {
+			if st, ok := c.detach(&loss); ok {
+				st.Topics = s.topicNames(c)
+				rec.Conns = append(rec.Conns, st)
+				fds = append(fds, c.fd)
+			}
+		}
+		if err := writeRecord(uc, rec, fds); err != nil {
+			return err
+		}
+	}
+	if err := writeRecord(uc, handoffRecord{Done: true}, nil); err != nil {
+		return err
+	}
+	if loss != (handoffLoss{}) {
+		s.logf("Handoff closed %v TLS connections, and passed %v lingering and %v delayed ones without their timeout", loss.tls, loss.lingering, loss.delayed)
+	}
+
+	// Keep the sockets open until the other process has them.
+	var ack [1]byte
+	if _, err := io.ReadFull(uc, ack[:]); err != nil {
+		return err
+	}
+	s.closeOnce.Do(func() {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+		for _, l := range s.loops {
+			l.poller.Close()
+		}
+	})
+	return nil
+}
+
+// Takeover receives the listeners and connections passed by Handoff from
+// the process at the other end of uc. The connections are registered,
+// calling Handler.OnOpen for each of them, and the listeners returned for
+// the caller to serve.
+func (s *Server) Takeover(uc *net.UnixConn) ([]net.Listener, error) {
+	r := &handoffReader{uc: uc, oob: make([]byte, 2*unix.CmsgSpace(handoffBatch*4))}
+	defer r.discard()
+	rec, fds, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+	var listeners []net.Listener
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "listener")
+		ln, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		listeners = append(listeners, ln)
+	}
+	for {
+		rec, fds, err = r.next()
+		if err != nil {
+			return listeners, err
+		}
+		if rec.Done {
+			break
+		}
+		for i := range rec.Conns {
+			s.adopt(fds[i], &rec.Conns[i])
+		}
+	}
+	_, err = uc.Write([]byte{1})
+	return listeners, err
+}
+
+// adopt registers the connection passed as fd.
+func (s *Server) adopt(fd int, st *connState) {
+	f := os.NewFile(uintptr(fd), "conn")
+	conn, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		s.logf("Failed to take over connection %v", err)
+		return
+	}
+	s.claim(conn.RemoteAddr().String())
+	if _, err := s.register(conn, nil, st); err != nil {
+		s.logf("Failed to add connection %v", err)
+		conn.Close()
+	}
+}
+
+// ErrUnsupportedListener is returned by Handoff for listeners that are not
+// backed by a file descriptor.
+type ErrUnsupportedListener struct {
+	Listener net.Listener
+}
+
+func (e ErrUnsupportedListener) Error() string {
+	return "wsserver: cannot hand off listener on " + e.Listener.Addr().String()
+}
+
+// handoffLoss counts the connections a handoff does not pass as they are.
+type handoffLoss struct {
+	// tls is the number of connections closed because their session
+	// cannot be passed.
+	tls int
+	// lingering and delayed are the number of connections passed without
+	// the deadline of a close frame the server sent, or without the delay
+	// of the rate limit.
+	lingering int
+	delayed   int
+}
+
+// detach takes the state of c for a handoff and marks it closed, so that
+// it is not written to anymore. It returns false if c was closed already,
+// or is served over TLS, whose session cannot be handed off, and counts
+// what it leaves out in loss. The server must be halted.
+func (c *Conn) detach(loss *handoffLoss) (connState, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return connState{}, false
+	}
+	if c.tls != nil {
+		loss.tls++
+		return connState{}, false
+	}
+	if c.failed != nil {
+		loss.lingering++
+	}
+	if c.delayed != 0 {
+		loss.delayed++
+	}
+	c.closed = true
+	return connState{
+		Pending:    c.dec.pending,
+		Op:         c.dec.op,
+		Message:    c.dec.message,
+		Compressed: c.dec.compressed,
+		Frames:     c.frames,
+		Closing:    c.closing,
+		Deflate:    c.dec.deflate,
+		WindowSize: c.dec.windowSize,
+		Window:     c.dec.window,
+	}, true
+}
+
+// restore sets the state of a connection taken over or just upgraded,
+// before it is registered.
+func (c *Conn) restore(st *connState) {
+	c.dec.pending = st.Pending
+	c.dec.op, c.dec.message, c.dec.compressed = st.Op, st.Message, st.Compressed
+	c.dec.deflate, c.dec.windowSize, c.dec.window = st.Deflate, st.WindowSize, st.Window
+	c.frames = st.Frames
+	c.closing = st.Closing
+	c.buffered = int64(c.dec.retained())
+}
+
+// resumeWrites writes the frames a connection taken over was given, before
+// it is polled. If they do not fit, it is polled for writability as well.
+func (c *Conn) resumeWrites() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.flush(); err != nil {
+		return err
+	}
+	c.polling = len(c.frames) > 0
+	return nil
+}
+
+// writeRecord sends rec, prefixed by its length, with fds attached to its
+// first byte.
+func writeRecord(uc *net.UnixConn, rec handoffRecord, fds []int) error {
+	var b bytes.Buffer
+	b.Write(make([]byte, 4))
+	if err := gob.NewEncoder(&b).Encode(rec); err != nil {
+		return err
+	}
+	p := b.Bytes()
+	binary.BigEndian.PutUint32(p, uint32(len(p)-4))
+	var oob []byte
+	if len(fds) > 0 {
+		oob = unix.UnixRights(fds...)
+	}
+	n, _, err := uc.WriteMsgUnix(p, oob, nil)
+	if err != nil {
+		return err
+	}
+	_, err = uc.Write(p[n:])
+	return err
+}
+
+// handoffReader reads the records sent by writeRecord. Descriptors are
+// queued in the order they arrive in, which is the order of the records
+// they belong to.
+type handoffReader struct {
+	uc  *net.UnixConn
+	buf []byte
+	fds []int
+	oob []byte
+}
+
+func (r *handoffReader) next() (handoffRecord, []int, error) {
+	var rec handoffRecord
+	for len(r.buf) < 4 {
+		if err := r.fill(); err != nil {
+			return rec, nil, err
+		}
+	}
+	n := int(binary.BigEndian.Uint32(r.buf))
+	for len(r.buf) < 4+n {
+		if err := r.fill(); err != nil {
+			return rec, nil, err
+		}
+	}
+	if err := gob.NewDecoder(bytes.NewReader(r.buf[4 : 4+n])).Decode(&rec); err != nil {
+		return rec, nil, err
+	}
+	r.buf = r.buf[4+n:]
+	count := rec.Listeners + len(rec.Conns)
+	if count > len(r.fds) {
+		return rec, nil, errHandoff
+	}
+	fds := r.fds[:count]
+	r.fds = r.fds[count:]
+	return rec, fds, nil
+}
+
+// discard closes the descriptors received but not returned by next, which
+// are left if the handoff fails.
+func (r *handoffReader) discard() {
+	for _, fd := range r.fds {
+		unix.Close(fd)
+	}
+	r.fds = nil
+}
+
+// fill reads the next chunk of the stream along with its descriptors. If
+// the descriptors were truncated, the ones received are closed, since they
+// can no longer be matched with their records.
+func (r *handoffReader) fill() error {
+	buf := make([]byte, 64<<10)
+	n, oobn, flags, _, err := r.uc.ReadMsgUnix(buf, r.oob)
+	if err != nil {
+		return err
+	}
+	var fds []int
+	if oobn > 0 {
+		msgs, perr := unix.ParseSocketControlMessage(r.oob[:oobn])
+		for i := range msgs {
+			rights, err := unix.ParseUnixRights(&msgs[i])
+			if err != nil {
+				perr = err
+				continue
+			}
+			fds = append(fds, rights...)
+		}
+		if err == nil {
+			err = perr
+		}
+	}
+	if err == nil && flags&unix.MSG_CTRUNC != 0 {
+		err = errHandoff
+	}
+	if err != nil {
+		for _, fd := range fds {
+			unix.Close(fd)
+		}
+		return err
+	}
+	if n == 0 && oobn == 0 {
+		return io.ErrUnexpectedEOF
+	}
+	r.buf = append(r.buf, buf[:n]...)
+	r.fds = append(r.fds, fds...)
+	return nil
+}
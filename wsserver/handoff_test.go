@@ -0,0 +1,124 @@
+package wsserver
+
+import (
+	"github.com/gobwas/ws"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// unixPair returns both ends of a connected unix socket.
+func unixPair(t *testing.T) (*net.UnixConn, *net.UnixConn) {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		f := os.NewFile(uintptr(fd), "pair")
+		c, err := net.FileConn(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns[i] = c.(*net.UnixConn)
+	}
+	return conns[0], conns[1]
+}
+
+func openFDs(t *testing.T) int {
+	t.Helper()
+	entries, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip(err)
+	}
+	return len(entries)
+}
+
+func TestHandoffTruncatedRights(t *testing.T) {
+	w, r := unixPair(t)
+	defer w.Close()
+	defer r.Close()
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fds := make([]int, 8)
+	for i := range fds {
+		fds[i] = int(f.Fd())
+	}
+
+	before := openFDs(t)
+	if err := writeRecord(w, handoffRecord{Listeners: len(fds)}, fds); err != nil {
+		t.Fatal(err)
+	}
+	// Room for fewer descriptors than were sent truncates them.
+	hr := &handoffReader{uc: r, oob: make([]byte, unix.CmsgSpace(2*4))}
+	if _, _, err := hr.next(); err != errHandoff {
+		t.Fatalf("next = %v, want %v", err, errHandoff)
+	}
+	if after := openFDs(t); after != before {
+		t.Errorf("%v descriptors open after a truncated handoff, want %v", after, before)
+	}
+}
+
+// pausedOpenHandler greets connections from an OnOpen that reports it
+// started on started and then takes a while, and echoes them.
+type pausedOpenHandler struct {
+	echoHandler
+	started chan struct{}
+}
+
+func (h pausedOpenHandler) OnOpen(c *Conn) {
+	h.started <- struct{}{}
+	time.Sleep(100 * time.Millisecond)
+	c.WriteMessage(ws.OpText, []byte("hello"))
+}
+
+// TestHandoffWaitsForRegistration hands a server off while a connection is
+// in its OnOpen, which has to be passed along with the others.
+func TestHandoffWaitsForRegistration(t *testing.T) {
+	h := pausedOpenHandler{started: make(chan struct{}, 1)}
+	s, addr := serve(t, h, Options{Loops: 1})
+	c := dial(t, addr, nil)
+	defer c.Close()
+	<-h.started
+
+	w, r := unixPair(t)
+	defer w.Close()
+	defer r.Close()
+	next, err := NewServer(echoHandler{}, Options{Loops: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer next.Close()
+	errs := make(chan error, 1)
+	go func() {
+		listeners, err := next.Takeover(r)
+		for _, ln := range listeners {
+			ln.Close()
+		}
+		errs <- err
+	}()
+	s.mu.Lock()
+	listeners := s.listeners
+	s.mu.Unlock()
+	if err := s.Handoff(w, listeners); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatal(err)
+	}
+	if got := string(c.receive(t)); got != "hello" {
+		t.Errorf("first message %q, want the greeting", got)
+	}
+	c.send(t, ws.OpText, []byte("hi"))
+	if got := string(c.receive(t)); got != "hi" {
+		t.Errorf("echo %q after the handoff, want hi", got)
+	}
+}
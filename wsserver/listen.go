@@ -0,0 +1,162 @@
+package wsserver
+
+import (
+	"context"
+	"github.com/gobwas/ws"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"syscall"
+	"time"
+)
+
+const (
+	// defaultAcceptors is the number of goroutines accepting connections
+	// per listener.
+	defaultAcceptors = 16
+	// defaultHandshakeTimeout bounds the handshake of connections accepted
+	// by Serve.
+	defaultHandshakeTimeout = 5 * time.Second
+	// handshakeBufferSize is the size of the pooled buffer handshakes are
+	// read with, unless the upgrader sets one.
+	handshakeBufferSize = 1024
+)
+
+// Serve accepts connections on ln, performs the WebSocket handshake on
+// them without going through net/http, and registers them. Connections
+// are accepted and upgraded by Options.Acceptors goroutines, so a peer
+// that is slow to send its request only holds one of them until the
+// handshake times out. Serve returns when ln fails or the server is
+// shut down or closed, in which case the error is nil.
+func (s *Server) Serve(ln net.Listener) error {
+	s.mu.Lock()
+	if s.draining {
+		s.mu.Unlock()
+		return nil
+	}
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		return nil
+	default:
+	}
+	s.listeners = append(s.listeners, ln)
+	s.mu.Unlock()
+
+	errs := make(chan error, s.opts.Acceptors)
+	for i := 0; i < s.opts.Acceptors; i++ {
+		go func() {
+			errs <- s.accept(ln)
+		}()
+	}
+	var err error
+	for i := 0; i < s.opts.Acceptors; i++ {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			ln.Close()
+		}
+	}
+	return err
+}
+
+// accept runs a single accept loop on ln. Temporary errors, such as
+// running out of file descriptors, are retried with a backoff.
+func (s *Server) accept(ln net.Listener) error {
+	var delay time.Duration
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if s.isDraining() {
+				return nil
+			}
+			select {
+			case <-s.done:
+				return nil
+			default:
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				s.logf("Failed to accept %v; retrying in %v", err, delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		s.upgrade(conn)
+	}
+}
+
+// upgrade performs the handshake on conn and registers it. A connection
+// beyond Options.Admission has its request read and answered with 503
+// Service Unavailable, or 429 Too Many Requests, instead.
+func (s *Server) upgrade(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(s.opts.HandshakeTimeout))
+	rejected := s.acquire(conn.RemoteAddr().String())
+	var rw io.ReadWriter = conn
+	var t *tlsConn
+	if s.opts.TLSConfig != nil {
+		t = newTLSConn(conn, s.opts.TLSConfig)
+		if err := t.Handshake(); err != nil {
+			s.reject(conn, rejected)
+			return
+		}
+		rw = t
+	}
+	if rejected != nil {
+		u := s.opts.Upgrader
+		u.OnBeforeUpgrade = func() (ws.HandshakeHeader, error) {
+			return nil, ws.RejectConnectionError(
+				ws.RejectionStatus(s.opts.Admission.Status(rejected)),
+				ws.RejectionHeader(ws.HandshakeHeaderHTTP(s.opts.Admission.Header())),
+				ws.RejectionReason(rejected.Error()),
+			)
+		}
+		u.Upgrade(rw)
+		s.reject(conn, rejected)
+		return
+	}
+	hs, err := s.opts.Upgrader.Upgrade(rw)
+	if err != nil {
+		s.reject(conn, rejected)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if _, err := s.register(conn, t, handshakeState(hs.Extensions)); err != nil {
+		s.logf("Failed to add connection %v", err)
+		conn.Close()
+	}
+}
+
+// reject closes conn, which failed its handshake, and releases it unless
+// it was rejected by Options.Admission already.
+func (s *Server) reject(conn net.Conn, rejected error) {
+	if rejected == nil {
+		s.release(conn.RemoteAddr().String())
+	}
+	conn.Close()
+}
+
+// ListenReusePort listens on the TCP address addr with SO_REUSEPORT set,
+// so that several listeners, each served by its own Serve call, can share
+// the address and have the kernel balance incoming connections between
+// them.
+func ListenReusePort(addr string) (net.Listener, error) {
+	lc := net.ListenConfig{
+		Control: func(network, address string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		},
+	}
+	return lc.Listen(context.Background(), "tcp", addr)
+}
@@ -0,0 +1,328 @@
+package wsserver
+
+import (
+	"github.com/eranyanay/1m-go-websockets/poller"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/eranyanay/1m-go-websockets/wheel"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// loop is a single event loop. Readiness is reported by a poller.Poller,
+// epoll(7) unless another backend is chosen. Connections are looked up in
+// the connection table shared by the loops of the server.
+type loop struct {
+	// traffic is first in the struct to be 64-bit aligned for atomic
+	// access.
+	traffic traffic
+
+	server     *Server
+	poller     poller.Poller
+	events     uint32
+	waitEvents []poller.Event
+	queueLimit int
+	wheel      *wheel.Wheel
+	size       int64
+
+	// woken holds connections to serve on the next wait although the
+	// poller did not report them.
+	wokenMu sync.Mutex
+	woken   []*Conn
+	// delayed holds the connections not read until they are due, for
+	// exceeding the rate limit.
+	delayed ratelimit.Queue
+}
+
+// newLoop creates an event loop polling with the named backend. In
+// oneshot mode descriptors are edge-triggered and one-shot: a connection
+// is reported by wait at most once until it is re-armed with resume, so it
+// can be handed to a worker without another worker picking it up
+// concurrently.
+func newLoop(s *Server, backend string, oneshot bool) (*loop, error) {
+	events := uint32(poller.In | poller.RdHup)
+	if oneshot {
+		events |= poller.Edge | poller.OneShot
+	}
+	p, err := poller.New(backend)
+	if err != nil {
+		return nil, err
+	}
+	return &loop{
+		server:     s,
+		poller:     p,
+		events:     events,
+		waitEvents: make([]poller.Event, 100),
+		queueLimit: defaultQueueLimit,
+	}, nil
+}
+
+// open stores c in the table and counts it, before its fd is polled by
+// add, so that its first event finds it.
+func (l *loop) open(c *Conn) {
+	l.server.conns.put(c)
+	atomic.AddInt64(&l.size, 1)
+}
+
+// add polls the fd of c, opened by open, for the events of the loop and
+// for writability if frames were queued in the meantime. It returns
+// ErrClosed if c was closed since.
+func (l *loop) add(c *Conn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	if err := l.poller.Add(c.fd, c.gen, l.interest(c)); err != nil {
+		return err
+	}
+	c.opening = false
+	if l.wheel != nil {
+		l.wheel.Add(c.fd)
+	}
+	return nil
+}
+
+// close unregisters c and closes it, reporting err to the handler. Only
+// the first call has an effect.
+func (l *loop) close(c *Conn, err error) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.frames = nil
+	polled := !c.opening
+	c.mu.Unlock()
+
+	// The fd may be reused as soon as it is closed, so it must be out of
+	// the poller, the table and the wheel by then.
+	var perr error
+	if polled {
+		perr = l.poller.Remove(c.fd)
+	}
+	l.server.conns.remove(c)
+	if l.wheel != nil {
+		l.wheel.Remove(c.fd)
+	}
+	atomic.AddInt64(&l.size, -1)
+
+	cerr := c.conn.Close()
+	l.server.closed(c, err)
+	if perr != nil {
+		return perr
+	}
+	return cerr
+}
+
+// wake has c served by the next wait. A TLS connection may have read more
+// than its handshake, and a delayed connection may have frames left in its
+// decoder, which the socket will not report as readable again.
+func (l *loop) wake(c *Conn) {
+	l.wokenMu.Lock()
+	l.woken = append(l.woken, c)
+	l.wokenMu.Unlock()
+}
+
+// delay stops reading c for d, because it exceeded the rate limit.
+func (l *loop) delay(c *Conn, d time.Duration) error {
+	due := time.Now().Add(d)
+	c.mu.Lock()
+	c.delayed = due.UnixNano()
+	var err error
+	if !l.oneshot() {
+		err = l.arm(c)
+	}
+	c.mu.Unlock()
+	l.delayed.Push(c, due)
+	return err
+}
+
+// undelay reads the delayed connections that are due again, and closes
+// the lingering ones whose peer did not hang up in time.
+func (l *loop) undelay(now time.Time) {
+	for _, v := range l.delayed.Pop(now) {
+		if lc, ok := v.(lingering); ok {
+			l.close(lc.c, lc.c.failure())
+			continue
+		}
+		c := v.(*Conn)
+		c.mu.Lock()
+		// A connection delayed again since is left to its later entry.
+		if c.closed || c.failed != nil || c.delayed == 0 || c.delayed > now.UnixNano() {
+			c.mu.Unlock()
+			continue
+		}
+		c.delayed = 0
+		var err error
+		if !l.oneshot() || !c.busy {
+			err = l.arm(c)
+		}
+		c.mu.Unlock()
+		if err != nil {
+			l.server.logf("Failed to re-arm %v", err)
+		}
+		l.wake(c)
+	}
+}
+
+// touch records activity on c.
+func (l *loop) touch(c *Conn) {
+	atomic.StoreInt64(&c.active, time.Now().UnixNano())
+	if l.wheel != nil {
+		l.wheel.Touch(c.fd)
+	}
+}
+
+// expire advances the timing wheel to now. It returns the connections that
+// have been idle long enough to be pinged, and the ones that did not
+// answer a ping in time and have to be closed.
+func (l *loop) expire(now time.Time) (ping, expired []*Conn) {
+	if l.wheel == nil {
+		return nil, nil
+	}
+	pingFDs, expiredFDs := l.wheel.Advance(now)
+	if len(pingFDs) == 0 && len(expiredFDs) == 0 {
+		return nil, nil
+	}
+	for _, fd := range pingFDs {
+		if c := l.server.conns.lookup(fd); c != nil && c.loop == l {
+			ping = append(ping, c)
+		}
+	}
+	for _, fd := range expiredFDs {
+		if c := l.server.conns.lookup(fd); c != nil && c.loop == l {
+			expired = append(expired, c)
+		}
+	}
+	return ping, expired
+}
+
+// resume re-arms a connection reported by a one-shot loop.
+func (l *loop) resume(c *Conn) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.busy = false
+	return l.arm(c)
+}
+
+// arm sets the interest of c's fd. c.mu must be held.
+func (l *loop) arm(c *Conn) error {
+	return l.poller.Modify(c.fd, c.gen, l.interest(c))
+}
+
+// interest returns the events c's fd is polled for: those of the loop,
+// with writability while frames are queued and without readability while
+// it is delayed. c.mu must be held.
+func (l *loop) interest(c *Conn) uint32 {
+	events := l.events
+	if c.polling {
+		events |= poller.Out
+	}
+	if c.delayed != 0 {
+		events &^= poller.In
+	}
+	return events
+}
+
+func (l *loop) oneshot() bool {
+	return l.events&poller.OneShot != 0
+}
+
+// ready is a connection reported by wait, with the poller events it was
+// reported for.
+type ready struct {
+	c      *Conn
+	events uint32
+}
+
+// wait returns the connections that are readable, were shut down by the
+// peer or failed. Queued frames of writable connections are flushed on
+// the way and a connection failing to write is reported as well, with
+// poller.Err set, so that it gets closed.
+func (l *loop) wait() ([]ready, error) {
+	events := l.waitEvents
+	timeout := 100 * time.Millisecond
+	l.wokenMu.Lock()
+	woken := l.woken
+	l.woken = nil
+	l.wokenMu.Unlock()
+	if len(woken) > 0 {
+		timeout = 0
+	} else if due, ok := l.delayed.Next(); ok {
+		if d := time.Until(due); d < timeout {
+			timeout = d
+		}
+		if timeout < 0 {
+			timeout = 0
+		}
+	}
+	n, err := l.poller.Wait(events, timeout)
+	if err != nil {
+		return nil, err
+	}
+	var connections []ready
+	for _, c := range woken {
+		c.mu.Lock()
+		switch {
+		case c.closed:
+		case !l.oneshot():
+			connections = append(connections, ready{c: c, events: poller.In})
+		case !c.busy:
+			// The connection stays armed: if the poller reports it before
+			// its worker resumes it, it is left to the worker.
+			c.busy = true
+			connections = append(connections, ready{c: c, events: poller.In})
+		}
+		c.mu.Unlock()
+	}
+	for i := 0; i < n; i++ {
+		c := l.server.conns.get(events[i].Fd, events[i].Gen)
+		if c == nil {
+			// The connection was closed after the event was reported.
+			continue
+		}
+		flags := events[i].Events
+		isReady := flags&(poller.In|poller.RdHup|poller.Hup|poller.Err) != 0
+		writable := flags&poller.Out != 0
+		if writable || l.oneshot() {
+			c.mu.Lock()
+			if writable {
+				if err := c.flush(); err != nil {
+					flags |= poller.Err
+					isReady = true
+				} else if len(c.frames) == 0 {
+					c.polling = false
+				}
+			}
+			var err error
+			switch {
+			case !l.oneshot():
+				if !c.polling {
+					err = l.arm(c)
+				}
+			case c.busy:
+				// Write re-armed the connection while a worker still holds
+				// it. Leave it disarmed, the worker resumes it.
+				isReady = false
+			case isReady:
+				// The connection stays disarmed until its worker resumes it.
+				c.busy = true
+			default:
+				err = l.arm(c)
+			}
+			c.mu.Unlock()
+			if err != nil {
+				l.server.logf("Failed to re-arm %v", err)
+			}
+		}
+		if isReady {
+			connections = append(connections, ready{c: c, events: flags})
+		}
+	}
+	return connections, nil
+}
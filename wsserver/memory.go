@@ -0,0 +1,79 @@
+package wsserver
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// MemoryStats reports the memory used by a server, in bytes unless noted
+// otherwise.
+type MemoryStats struct {
+	Connections int `json:"connections"`
+	// HeapInuse is the heap in use by the whole process.
+	HeapInuse uint64 `json:"heap_inuse"`
+	// Buffered is kept by the decoders of idle connections: the beginning
+	// of frames that were not received entirely, and unfinished messages.
+	Buffered int64 `json:"buffered"`
+	// Queued is held by frames waiting for sockets to become writable.
+	Queued int64 `json:"queued"`
+	// SocketMemory is the kernel memory used by the buffers of every TCP
+	// socket of the host, as reported by /proc/net/sockstat, or zero if it
+	// is not available.
+	SocketMemory uint64 `json:"socket_memory"`
+
+	HeapPerConnection   float64 `json:"heap_per_connection"`
+	SocketPerConnection float64 `json:"socket_per_connection"`
+}
+
+// Memory walks the connections of the server and reports its memory use.
+// It is meant for debugging and takes the lock of every connection.
+func (s *Server) Memory() MemoryStats {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	st := MemoryStats{HeapInuse: ms.HeapInuse, SocketMemory: socketMemory()}
+	for _, c := range s.conns.all() {
+		st.Connections++
+		st.Buffered += atomic.LoadInt64(&c.buffered)
+		c.mu.Lock()
+		for _, frame := range c.frames {
+			st.Queued += int64(len(frame))
+		}
+		c.mu.Unlock()
+	}
+	if st.Connections > 0 {
+		st.HeapPerConnection = float64(st.HeapInuse) / float64(st.Connections)
+		st.SocketPerConnection = float64(st.SocketMemory) / float64(st.Connections)
+	}
+	return st
+}
+
+// socketMemory returns the memory allocated to TCP socket buffers, which
+// /proc/net/sockstat reports in pages on its "TCP:" line.
+func socketMemory() uint64 {
+	f, err := os.Open("/proc/net/sockstat")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "TCP:" {
+			continue
+		}
+		for i := 1; i+1 < len(fields); i += 2 {
+			if fields[i] == "mem" {
+				pages, err := strconv.ParseUint(fields[i+1], 10, 64)
+				if err != nil {
+					return 0
+				}
+				return pages * uint64(os.Getpagesize())
+			}
+		}
+	}
+	return 0
+}
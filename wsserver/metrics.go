@@ -0,0 +1,63 @@
+package wsserver
+
+import (
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"sync/atomic"
+)
+
+var (
+	// pollBuckets bound the number of connections reported by a wait,
+	// which is at most the 100 events of a loop.
+	pollBuckets = []float64{0, 1, 2, 5, 10, 20, 50, 100}
+	// loopBuckets bound the time a loop takes to handle a wait, from 10µs
+	// to about a second.
+	loopBuckets = metrics.ExponentialBuckets(1e-5, 4, 9)
+)
+
+// traffic counts the messages and bytes a loop read and queued.
+type traffic struct {
+	messagesIn  int64
+	bytesIn     int64
+	messagesOut int64
+	bytesOut    int64
+}
+
+// traffic sums the traffic of every loop.
+func (s *Server) traffic() traffic {
+	var t traffic
+	for _, l := range s.loops {
+		t.messagesIn += atomic.LoadInt64(&l.traffic.messagesIn)
+		t.bytesIn += atomic.LoadInt64(&l.traffic.bytesIn)
+		t.messagesOut += atomic.LoadInt64(&l.traffic.messagesOut)
+		t.bytesOut += atomic.LoadInt64(&l.traffic.bytesOut)
+	}
+	return t
+}
+
+// registerMetrics adds the metrics of s to set. Counters are read when
+// scraped, from the ones Stats reports.
+func (s *Server) registerMetrics(set *metrics.Set) {
+	load := func(v *int64) func() float64 {
+		return func() float64 {
+			return float64(atomic.LoadInt64(v))
+		}
+	}
+	set.NewGaugeFunc("ws_connections", "Connections currently registered.", load(&s.count))
+	set.NewCounterFunc("ws_upgrades_total", "Connections registered since the server started.", load(&s.upgrades))
+	s.closes.Register(set)
+	set.NewCounterFunc("ws_rate_limited_total", "Messages that exceeded the rate limit.", load(&s.limited))
+	set.NewCounterFunc("ws_messages_received_total", "Data messages received.", func() float64 {
+		return float64(s.traffic().messagesIn)
+	})
+	set.NewCounterFunc("ws_received_bytes_total", "Payload bytes of the data messages received.", func() float64 {
+		return float64(s.traffic().bytesIn)
+	})
+	set.NewCounterFunc("ws_messages_sent_total", "Frames queued, control frames included.", func() float64 {
+		return float64(s.traffic().messagesOut)
+	})
+	set.NewCounterFunc("ws_sent_bytes_total", "Bytes of frames queued.", func() float64 {
+		return float64(s.traffic().bytesOut)
+	})
+	s.pollEvents = set.NewHistogram("ws_poll_events", "Connections reported ready by a wait of an event loop.", pollBuckets)
+	s.loopSeconds = set.NewHistogram("ws_loop_seconds", "Time an event loop takes to handle the connections reported by a wait.", loopBuckets)
+}
@@ -0,0 +1,61 @@
+package wsserver
+
+import (
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"golang.org/x/sys/unix"
+	"io"
+)
+
+// CloseReason classifies why a connection was closed.
+type CloseReason = closes.Reason
+
+const (
+	// CloseKick is a connection closed by the application, with Close
+	// or Kick.
+	CloseKick = closes.Kick
+	// ClosePeer is a connection closed by the peer with a close frame.
+	ClosePeer = closes.Peer
+	// ClosePeerGone is a connection the peer shut down without a close
+	// frame.
+	ClosePeerGone = closes.PeerGone
+	// CloseProtocolError is a connection that violated the protocol.
+	CloseProtocolError = closes.ProtocolError
+	// CloseReset is a connection reset by the peer.
+	CloseReset = closes.Reset
+	// CloseTimeout is a connection that did not answer a heartbeat.
+	CloseTimeout = closes.Timeout
+	// CloseRateLimit is a connection that exceeded the rate limit.
+	CloseRateLimit = closes.RateLimit
+	// CloseError is a connection that failed with any other error.
+	CloseError = closes.Error
+)
+
+// ReasonOf classifies the error a connection was closed with, as passed to
+// Handler.OnClose.
+func ReasonOf(err error) CloseReason {
+	switch err := err.(type) {
+	case nil:
+		return CloseKick
+	case wsutil.ClosedError:
+		return ClosePeer
+	case ws.ProtocolError:
+		return CloseProtocolError
+	case unix.Errno:
+		if err == unix.ECONNRESET || err == unix.EPIPE {
+			return CloseReset
+		}
+	}
+	switch err {
+	case io.EOF:
+		return ClosePeerGone
+	case ErrIdle:
+		return CloseTimeout
+	case ErrRateLimited:
+		return CloseRateLimit
+	case ErrKicked:
+		return CloseKick
+	}
+	return CloseError
+}
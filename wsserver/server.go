@@ -0,0 +1,768 @@
+// Package wsserver is a WebSocket server that serves every connection from
+// a few event loops instead of a goroutine per connection. It packages the
+// epoll and gobwas/ws design of the 4_optimize_gobwas example so that
+// applications can be built on it.
+package wsserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/tls"
+	"github.com/eranyanay/1m-go-websockets/admission"
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/eranyanay/1m-go-websockets/metrics"
+	"github.com/eranyanay/1m-go-websockets/poller"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/eranyanay/1m-go-websockets/shutdown"
+	"github.com/eranyanay/1m-go-websockets/wheel"
+	"github.com/gobwas/httphead"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQueueLimit is the number of frames that may be queued for a
+// connection whose socket is not writable.
+const defaultQueueLimit = 64
+
+var (
+	pingFrame       = ws.MustCompileFrame(ws.NewPingFrame(nil))
+	emptyCloseFrame = ws.MustCompileFrame(ws.NewCloseFrame(nil))
+	// rateLimitedFrame closes connections exceeding the rate limit.
+	rateLimitedFrame = ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(ws.StatusPolicyViolation, "rate limit exceeded")))
+)
+
+// Handler responds to the events of WebSocket connections. Its methods are
+// called from the event loops, or from the worker pool in one-shot mode,
+// and must not block. Events of a single connection are never delivered
+// concurrently.
+type Handler interface {
+	// OnOpen is called once a connection is registered, before it is
+	// polled, so no other event of it is delivered until OnOpen returns.
+	OnOpen(c *Conn)
+	// OnMessage is called for every complete text or binary message.
+	// Control frames are handled by the server. payload is borrowed from a
+	// buffer shared with other connections and must be copied to be kept
+	// after OnMessage returns.
+	OnMessage(c *Conn, op ws.OpCode, payload []byte)
+	// OnClose is called once a connection is closed. err is the reason,
+	// a wsutil.ClosedError if the peer sent a close frame, or nil if the
+	// connection was closed by the application. ReasonOf classifies it.
+	OnClose(c *Conn, err error)
+}
+
+// Options configures a Server. The zero value is usable.
+type Options struct {
+	// Backend is the name of the poller.Poller backend, epoll if empty.
+	Backend string
+	// Loops is the number of event loops, GOMAXPROCS if zero.
+	Loops int
+	// OneShot selects edge-triggered, one-shot polling. Ready connections
+	// are then handled by a pool of Workers goroutines, NumCPU if zero,
+	// instead of by the event loop itself.
+	OneShot bool
+	Workers int
+	// QueueLimit is the number of outbound frames that may be queued per
+	// connection, 64 if zero.
+	QueueLimit int
+	// Idle is the inactivity after which a connection is pinged, and
+	// PongWait how long it has to answer before it is closed. A zero Idle
+	// disables heartbeats, a zero PongWait closes idle connections without
+	// pinging them.
+	Idle     time.Duration
+	PongWait time.Duration
+	// Upgrader performs the handshake of connections accepted by Serve. Its
+	// callbacks can inspect the request line and headers as they are read.
+	// Handshakes are read with a 1KB pooled buffer unless ReadBufferSize
+	// is set.
+	Upgrader ws.Upgrader
+	// Acceptors is the number of goroutines accepting and upgrading
+	// connections per listener given to Serve, 16 if zero. Handshakes
+	// mostly wait on the network, so there are usually more of them than
+	// CPUs.
+	Acceptors int
+	// HandshakeTimeout bounds the handshake of connections accepted by
+	// Serve, 5 seconds if zero.
+	HandshakeTimeout time.Duration
+	// Compression enables permessage-deflate. Unless Upgrader selects
+	// extensions itself, it is negotiated by ServeHTTP and Serve.
+	Compression Compression
+	// TLSConfig serves the connections accepted by Serve over TLS. It
+	// needs at least one certificate or GetCertificate; the certificate is
+	// picked by the server name the client asks for. ServeHTTP cannot
+	// take over connections from an http.Server serving TLS.
+	TLSConfig *tls.Config
+	// MaxFrameSize and MaxMessageSize bound the payload of the frames and
+	// of the messages, once decompressed, that clients may send. Larger
+	// ones are refused as soon as their header is read, and the connection
+	// closed with 1009 Message Too Big. MaxMessageSize is 16MB if zero, and
+	// MaxFrameSize is MaxMessageSize if zero.
+	MaxFrameSize   int64
+	MaxMessageSize int64
+	// RateLimit limits the data messages and bytes each connection may
+	// send. Depending on its policy, messages exceeding it are dropped,
+	// delay the next read of the connection, or close it with 1008 Policy
+	// Violation and ErrRateLimited.
+	RateLimit ratelimit.Limiter
+	// MaxSubscriptions bounds the topics a connection may subscribe to,
+	// 16 if zero, and MaxTopics the topics of the server, 65536 if zero.
+	MaxSubscriptions int
+	MaxTopics        int
+	// Admission bounds the number of connections, and the number of them
+	// per client if it has a quota. Upgrades beyond it are answered with
+	// 503 Service Unavailable, or 429 Too Many Requests, by ServeHTTP and
+	// Serve, while Register and Takeover count connections whether there
+	// is room for them or not. A nil Admission admits every connection.
+	Admission *admission.Controller
+	// Metrics is the set the metrics of the server are registered in,
+	// such as metrics.Default. They are kept out of any set if nil, and
+	// the poller waits are not timed.
+	Metrics *metrics.Set
+}
+
+// Server dispatches the events of its connections to a Handler.
+type Server struct {
+	handler Handler
+	opts    Options
+	loops   []*loop
+	conns   connTable
+	jobs    chan ready
+	count   int64
+	deflate compressor
+	limits  limits
+	// rate is the rate limit, nil if connections are not limited, and
+	// limited counts the messages that exceeded it.
+	rate    *ratelimit.Limiter
+	limited int64
+
+	// closes counts closed connections by CloseReason and Violation, and
+	// peerCodes the status codes of close frames sent by peers.
+	closes    closes.Counts
+	codesMu   sync.Mutex
+	peerCodes map[ws.StatusCode]int64
+	// upgrades counts the connections registered since the server
+	// started.
+	upgrades int64
+	// pollEvents and loopSeconds are the histograms of the number of
+	// connections reported by each wait, and of the time taken to handle
+	// them, nil without Options.Metrics.
+	pollEvents  *metrics.Histogram
+	loopSeconds *metrics.Histogram
+
+	// topicsMu guards topics and the subscriptions of every connection.
+	topicsMu sync.RWMutex
+	topics   map[string]*topic
+
+	// mu guards listeners and draining.
+	mu        sync.Mutex
+	listeners []net.Listener
+	draining  bool
+
+	// done is closed to stop the event loops and the workers, which wg
+	// waits for. registering counts the connections being registered; it
+	// is only added to under mu while done is open, so that it can be
+	// waited for once the server is halted.
+	done        chan struct{}
+	wg          sync.WaitGroup
+	registering sync.WaitGroup
+	haltOnce    sync.Once
+	closeOnce   sync.Once
+}
+
+// NewServer creates a server and starts its event loops.
+func NewServer(h Handler, opts Options) (*Server, error) {
+	if opts.Backend == "" {
+		opts.Backend = "epoll"
+	}
+	if opts.Loops < 1 {
+		opts.Loops = runtime.GOMAXPROCS(0)
+	}
+	if opts.Workers < 1 {
+		opts.Workers = runtime.NumCPU()
+	}
+	if opts.Acceptors < 1 {
+		opts.Acceptors = defaultAcceptors
+	}
+	if opts.HandshakeTimeout <= 0 {
+		opts.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if opts.Upgrader.ReadBufferSize == 0 {
+		opts.Upgrader.ReadBufferSize = handshakeBufferSize
+	}
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = defaultMaxMessageSize
+	}
+	if opts.MaxFrameSize <= 0 {
+		opts.MaxFrameSize = opts.MaxMessageSize
+	}
+	if opts.MaxSubscriptions <= 0 {
+		opts.MaxSubscriptions = defaultMaxSubscriptions
+	}
+	if opts.MaxTopics <= 0 {
+		opts.MaxTopics = defaultMaxTopics
+	}
+	if opts.Compression.Level == 0 {
+		opts.Compression.Level = flate.BestSpeed
+	}
+	if u := &opts.Upgrader; opts.Compression.Enabled && u.Extension == nil && u.ExtensionCustom == nil {
+		u.ExtensionCustom = opts.Compression.selectExtensions
+	}
+	s := &Server{handler: h, opts: opts, done: make(chan struct{}), peerCodes: make(map[ws.StatusCode]int64), topics: make(map[string]*topic)}
+	s.deflate.level = opts.Compression.Level
+	s.limits = limits{frame: opts.MaxFrameSize, message: opts.MaxMessageSize}
+	if opts.RateLimit.Enabled() {
+		s.rate = &s.opts.RateLimit
+	}
+	for i := 0; i < opts.Loops; i++ {
+		l, err := newLoop(s, opts.Backend, opts.OneShot)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		if opts.QueueLimit > 0 {
+			l.queueLimit = opts.QueueLimit
+		}
+		if opts.Idle > 0 {
+			l.wheel = wheel.New(opts.Idle, opts.PongWait)
+		}
+		s.loops = append(s.loops, l)
+	}
+	if opts.Metrics != nil {
+		s.registerMetrics(opts.Metrics)
+	}
+	if opts.OneShot {
+		// The pool is bounded by the channel: when every worker is busy the
+		// loops stop waiting on the poller instead of queueing without limit.
+		s.jobs = make(chan ready, opts.Workers)
+		for i := 0; i < opts.Workers; i++ {
+			s.wg.Add(1)
+			go s.worker()
+		}
+	}
+	for _, l := range s.loops {
+		s.wg.Add(1)
+		go s.run(l)
+	}
+	return s, nil
+}
+
+// ServeHTTP upgrades the request to a WebSocket connection and registers
+// it with the server.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.TLS != nil {
+		http.Error(w, "wsserver: TLS is only supported by Serve", http.StatusNotImplemented)
+		return
+	}
+	if err := s.acquire(r.RemoteAddr); err != nil {
+		s.opts.Admission.Reject(w, err)
+		return
+	}
+	var u ws.HTTPUpgrader
+	var st *connState
+	if s.opts.Compression.Enabled {
+		// HTTPUpgrader echoes the offers it selects, so the response is
+		// negotiated here and sent as an extra header.
+		var offers []httphead.Option
+		for _, v := range r.Header[http.CanonicalHeaderKey("Sec-WebSocket-Extensions")] {
+			offers, _ = httphead.ParseOptions([]byte(v), offers)
+		}
+		if resp, ok := s.opts.Compression.negotiate(offers); ok {
+			var b bytes.Buffer
+			httphead.WriteOptions(&b, []httphead.Option{resp})
+			u.Header = http.Header{"Sec-WebSocket-Extensions": {b.String()}}
+			st = handshakeState([]httphead.Option{resp})
+		}
+	}
+	conn, _, _, err := u.Upgrade(r, w)
+	if err != nil {
+		s.release(r.RemoteAddr)
+		return
+	}
+	if _, err := s.register(conn, nil, st); err != nil {
+		log.Printf("Failed to add connection %v", err)
+		conn.Close()
+	}
+}
+
+// Register adds a connection that completed the WebSocket handshake to the
+// least loaded event loop.
+func (s *Server) Register(conn net.Conn) (*Conn, error) {
+	s.claim(conn.RemoteAddr().String())
+	return s.register(conn, nil, nil)
+}
+
+// acquire counts a connection from remote about to be upgraded against
+// Options.Admission, and returns why it was rejected if there was no room
+// for it.
+func (s *Server) acquire(remote string) error {
+	if s.opts.Admission == nil {
+		return nil
+	}
+	return s.opts.Admission.Acquire(remote)
+}
+
+// claim counts a connection from remote against Options.Admission whether
+// there is room for it or not.
+func (s *Server) claim(remote string) {
+	if s.opts.Admission != nil {
+		s.opts.Admission.Claim(remote)
+	}
+}
+
+// release uncounts a connection from remote that was acquired or claimed.
+func (s *Server) release(remote string) {
+	if s.opts.Admission != nil {
+		s.opts.Admission.Release(remote)
+	}
+}
+
+// register adds conn to the least loaded event loop, restoring st if it
+// was taken over from another process or negotiated compression. t is the
+// TLS layer over conn, if any. conn must have been acquired or claimed; it
+// is released once closed, or right away if it cannot be registered.
+func (s *Server) register(conn net.Conn, t *tlsConn, st *connState) (*Conn, error) {
+	s.mu.Lock()
+	select {
+	case <-s.done:
+		s.mu.Unlock()
+		s.release(conn.RemoteAddr().String())
+		return nil, ErrServerClosed
+	default:
+	}
+	s.registering.Add(1)
+	s.mu.Unlock()
+	defer s.registering.Done()
+	fd, err := poller.SocketFD(conn)
+	if err != nil {
+		s.release(conn.RemoteAddr().String())
+		return nil, err
+	}
+	l := s.loops[0]
+	for _, o := range s.loops[1:] {
+		if atomic.LoadInt64(&o.size) < atomic.LoadInt64(&l.size) {
+			l = o
+		}
+	}
+	now := time.Now().UnixNano()
+	c := &Conn{conn: conn, fd: fd, loop: l, tls: t, since: now, active: now, opening: true}
+	if st != nil {
+		c.restore(st)
+	}
+	if t != nil {
+		t.sock.polled = true
+	}
+	// The fd is only polled once OnOpen returned, so that no other event
+	// of c is delivered before or during it. Until then c is closed and
+	// written to without the poller.
+	l.open(c)
+	atomic.AddInt64(&s.count, 1)
+	atomic.AddInt64(&s.upgrades, 1)
+	if st != nil {
+		if err := c.resumeWrites(); err != nil {
+			l.close(c, err)
+			return nil, err
+		}
+		for _, name := range st.Topics {
+			s.Subscribe(c, name)
+		}
+	}
+	s.handler.OnOpen(c)
+	if err := l.add(c); err == ErrClosed {
+		// OnOpen closed c.
+		return c, nil
+	} else if err != nil {
+		l.close(c, err)
+		return nil, err
+	}
+	if t != nil {
+		l.wake(c)
+	}
+	if s.isDraining() {
+		s.goAway(c)
+	}
+	return c, nil
+}
+
+// Len returns the number of registered connections.
+func (s *Server) Len() int {
+	return int(atomic.LoadInt64(&s.count))
+}
+
+// Shutdown gracefully stops the server. It closes the listeners given to
+// Serve, then sends every connection a 1001 Going Away close frame, rate
+// per second, and waits for the peers to answer until ctx is done. The
+// server is closed on return, along with the connections left.
+func (s *Server) Shutdown(ctx context.Context, rate int) error {
+	s.mu.Lock()
+	s.draining = true
+	for _, ln := range s.listeners {
+		ln.Close()
+	}
+	s.mu.Unlock()
+
+	conns := s.conns.all()
+	err := shutdown.Pace(ctx, len(conns), rate, func(i int) {
+		s.goAway(conns[i])
+	})
+	if err == nil {
+		err = shutdown.Wait(ctx, s.Len)
+	}
+	s.Close()
+	return err
+}
+
+// goAway starts the closing handshake of c, closing it right away if the
+// close frame cannot be sent.
+func (s *Server) goAway(c *Conn) {
+	err := c.CloseHandshake(ws.StatusGoingAway, "server shutting down")
+	if err != nil && err != ErrClosed {
+		c.Close()
+	}
+}
+
+func (s *Server) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// Close closes the listeners given to Serve and every connection, and
+// stops the event loops.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.halt()
+		for _, c := range s.conns.all() {
+			c.Close()
+		}
+		for _, l := range s.loops {
+			l.poller.Close()
+		}
+	})
+	return nil
+}
+
+// Stats is a snapshot of the server's counters.
+type Stats struct {
+	// Connections is the number of registered connections.
+	Connections int
+	// Closes is the number of closed connections by reason.
+	Closes map[CloseReason]int64
+	// PeerCodes is the number of close frames received by status code.
+	PeerCodes map[ws.StatusCode]int64
+	// Violations is the number of connections closed for violating the
+	// protocol, by Violation.
+	Violations map[Violation]int64
+	// Topics is the number of topics with at least one subscriber.
+	Topics int
+	// RateLimited is the number of messages that exceeded the rate limit.
+	RateLimited int64
+	// Upgrades is the number of connections registered since the server
+	// started.
+	Upgrades int64
+	// MessagesIn and BytesIn count the data messages received and their
+	// payload bytes, and MessagesOut and BytesOut the frames and bytes
+	// queued, control frames included.
+	MessagesIn  int64
+	BytesIn     int64
+	MessagesOut int64
+	BytesOut    int64
+}
+
+// Stats returns the current counters of the server.
+func (s *Server) Stats() Stats {
+	st := Stats{
+		Connections: s.Len(),
+		Closes:      make(map[CloseReason]int64, closes.NumReasons),
+		PeerCodes:   make(map[ws.StatusCode]int64),
+		Violations:  make(map[Violation]int64, closes.NumViolations),
+		RateLimited: atomic.LoadInt64(&s.limited),
+		Upgrades:    atomic.LoadInt64(&s.upgrades),
+	}
+	t := s.traffic()
+	st.MessagesIn, st.BytesIn, st.MessagesOut, st.BytesOut = t.messagesIn, t.bytesIn, t.messagesOut, t.bytesOut
+	for r := CloseReason(0); r < closes.NumReasons; r++ {
+		st.Closes[r] = s.closes.Closes(r)
+	}
+	for v := Violation(0); v < closes.NumViolations; v++ {
+		st.Violations[v] = s.closes.Violations(v)
+	}
+	s.codesMu.Lock()
+	for code, n := range s.peerCodes {
+		st.PeerCodes[code] = n
+	}
+	s.codesMu.Unlock()
+	s.topicsMu.RLock()
+	st.Topics = len(s.topics)
+	s.topicsMu.RUnlock()
+	return st
+}
+
+// halt closes the listeners given to Serve and tells the event loops and
+// the workers to return.
+func (s *Server) halt() {
+	s.haltOnce.Do(func() {
+		s.mu.Lock()
+		close(s.done)
+		for _, ln := range s.listeners {
+			ln.Close()
+		}
+		s.mu.Unlock()
+	})
+}
+
+func (s *Server) closed(c *Conn, err error) {
+	s.unsubscribeAll(c)
+	atomic.AddInt64(&s.count, -1)
+	s.release(c.RemoteAddr().String())
+	reason := ReasonOf(err)
+	s.closes.Add(reason)
+	if v, ok := ViolationOf(err); ok {
+		s.closes.AddViolation(v)
+	}
+	if ce, ok := err.(wsutil.ClosedError); ok {
+		s.codesMu.Lock()
+		s.peerCodes[ce.Code]++
+		s.codesMu.Unlock()
+	}
+	switch reason {
+	case CloseProtocolError, CloseReset, CloseError:
+		s.logf("Closed %v: %v %v", c.RemoteAddr(), reason, err)
+	}
+	s.handler.OnClose(c, err)
+}
+
+func (s *Server) logf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// run is the event loop of l. Ready connections are handled inline, or
+// sent to the worker pool in one-shot mode. Idle connections are pinged
+// and closed between waits.
+func (s *Server) run(l *loop) {
+	defer s.wg.Done()
+	var rb readBuffer
+	for {
+		connections, err := l.wait()
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+		var start time.Time
+		if s.loopSeconds != nil {
+			start = time.Now()
+			s.pollEvents.Observe(float64(len(connections)))
+		}
+		s.heartbeat(l)
+		l.undelay(time.Now())
+		if err != nil {
+			s.logf("Failed to epoll wait %v", err)
+			continue
+		}
+		for _, r := range connections {
+			if s.jobs == nil {
+				s.handle(r, &rb)
+				continue
+			}
+			select {
+			case s.jobs <- r:
+			case <-s.done:
+				return
+			}
+		}
+		if s.loopSeconds != nil {
+			s.loopSeconds.Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// heartbeat pings idle connections and closes the ones that did not
+// answer the previous ping.
+func (s *Server) heartbeat(l *loop) {
+	ping, expired := l.expire(time.Now())
+	for _, c := range ping {
+		// A closing connection may not be pinged, but is still waited for.
+		if err := c.Write(pingFrame); err != nil && err != ErrClosed {
+			expired = append(expired, c)
+		}
+	}
+	for _, c := range expired {
+		l.close(c, ErrIdle)
+	}
+}
+
+// worker handles connections reported by one-shot loops. A connection is
+// not reported again until it is resumed, so messages of a single
+// connection are still handled in order.
+func (s *Server) worker() {
+	defer s.wg.Done()
+	var rb readBuffer
+	for {
+		select {
+		case r := <-s.jobs:
+			if s.handle(r, &rb) {
+				if err := r.c.loop.resume(r.c); err != nil {
+					r.c.loop.close(r.c, err)
+				}
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// handle reads what is available on a ready connection and dispatches
+// every complete message. It returns false if the connection was closed.
+func (s *Server) handle(r ready, rb *readBuffer) bool {
+	if err := s.serve(r.c, r.events, rb); err != nil {
+		r.c.loop.close(r.c, err)
+		return false
+	}
+	return true
+}
+
+// serve decodes the frames available on c without blocking, in rb. Partial
+// frames are kept by the decoder until the rest of them arrives. A failed
+// socket is closed with its pending error; frames that arrived before the
+// peer shut down its side are still dispatched before it is closed.
+func (s *Server) serve(c *Conn, events uint32, rb *readBuffer) error {
+	if events&poller.Err != 0 {
+		return poller.SocketError(c.fd)
+	}
+	if c.failure() != nil {
+		return c.discard()
+	}
+	c.dec.load(rb)
+	err := s.decode(c, rb)
+	c.dec.store(rb)
+	if c.tls != nil {
+		c.tls.sock.keep()
+	}
+	atomic.StoreInt64(&c.buffered, int64(c.dec.retained()))
+	return err
+}
+
+// decode reads c's socket into rb until it is drained, and dispatches the
+// complete frames after each read.
+func (s *Server) decode(c *Conn, rb *readBuffer) error {
+	for {
+		var more bool
+		var ferr error
+		if c.tls != nil {
+			more, ferr = rb.fillTLS(c.fd, c.tls)
+			if err := c.flushTLS(); err != nil {
+				return err
+			}
+		} else {
+			more, ferr = rb.fill(c.fd)
+		}
+		wait, err := s.dispatch(c, rb)
+		if err != nil || c.isClosed() {
+			return err
+		}
+		if c.failure() != nil {
+			rb.off = len(rb.buf)
+			return c.discard()
+		}
+		// A connection that exceeded the rate limit is not read until its
+		// buckets refill. The frames left in rb are kept by the decoder.
+		if wait > 0 && ferr == nil {
+			return c.loop.delay(c, wait)
+		}
+		if ferr != nil || !more {
+			return ferr
+		}
+	}
+}
+
+// dispatch handles the complete frames in rb. With the delay policy, it
+// stops after a message that exhausted the rate limit and returns how long
+// c has to wait before it is read again.
+func (s *Server) dispatch(c *Conn, rb *readBuffer) (time.Duration, error) {
+	for {
+		op, payload, ok, err := c.dec.next(rb, s.limits)
+		if err != nil {
+			return 0, violated(c, err)
+		}
+		if !ok {
+			return 0, nil
+		}
+		c.loop.touch(c)
+		switch op {
+		case ws.OpPing:
+			err = c.Write(ws.MustCompileFrame(ws.NewPongFrame(payload)))
+		case ws.OpPong:
+		case ws.OpClose:
+			// The answer lingers like the close frame of a violation, so
+			// that closing the socket does not drop it.
+			if len(payload) == 0 {
+				return 0, c.fail(emptyCloseFrame, wsutil.ClosedError{Code: ws.StatusNoStatusRcvd})
+			}
+			if len(payload) == 1 {
+				return 0, violated(c, errCloseFrame)
+			}
+			code, reason := ws.ParseCloseFrameData(payload)
+			if err := ws.CheckCloseFrameData(code, reason); err != nil {
+				return 0, violated(c, err)
+			}
+			return 0, c.fail(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, ""))), wsutil.ClosedError{Code: code, Reason: reason})
+		default:
+			atomic.AddInt64(&c.loop.traffic.messagesIn, 1)
+			atomic.AddInt64(&c.loop.traffic.bytesIn, int64(len(payload)))
+			atomic.AddInt64(&c.traffic.messagesIn, 1)
+			atomic.AddInt64(&c.traffic.bytesIn, int64(len(payload)))
+			if s.rate != nil {
+				if ok, err := s.admit(c, len(payload)); !ok {
+					if err != nil || s.rate.Policy == ratelimit.Close {
+						return 0, err
+					}
+					continue
+				}
+			}
+			s.handler.OnMessage(c, op, payload)
+			if c.isClosed() {
+				return 0, nil
+			}
+			if s.rate != nil && s.rate.Policy == ratelimit.Delay {
+				if wait := s.rate.Wait(&c.rate, time.Now()); wait > 0 {
+					return wait, nil
+				}
+			}
+		}
+		if err != nil && err != ErrQueueFull {
+			return 0, err
+		}
+	}
+}
+
+// admit applies the rate limit to a data message of size bytes read from
+// c. It returns false if the message is dropped, which with the close
+// policy sends c a close frame, after which it lingers until it is closed
+// with ErrRateLimited. With the delay policy every message is delivered.
+func (s *Server) admit(c *Conn, size int) (bool, error) {
+	ok, limited := s.rate.Admit(&c.rate, time.Now(), size)
+	if limited {
+		atomic.AddInt64(&s.limited, 1)
+	}
+	if !ok && s.rate.Policy == ratelimit.Close {
+		return false, c.fail(rateLimitedFrame, ErrRateLimited)
+	}
+	return ok, nil
+}
+
+// violated sends c a close frame with the status code of the violation err
+// is, after which c lingers until it is closed with err.
+func violated(c *Conn, err error) error {
+	code := ws.StatusProtocolError
+	if v, ok := ViolationOf(err); ok {
+		code = v.Code()
+	}
+	return c.fail(ws.MustCompileFrame(ws.NewCloseFrame(ws.NewCloseFrameBody(code, err.Error()))), err)
+}
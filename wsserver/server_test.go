@@ -0,0 +1,253 @@
+package wsserver
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+// echoHandler sends every message back to its connection.
+type echoHandler struct{}
+
+func (echoHandler) OnOpen(c *Conn) {}
+
+func (echoHandler) OnMessage(c *Conn, op ws.OpCode, payload []byte) {
+	c.WriteMessage(op, payload)
+}
+
+func (echoHandler) OnClose(c *Conn, err error) {}
+
+// startServer serves an echo server with opts on a loopback listener, and
+// returns it with the address of the listener.
+func startServer(t *testing.T, opts Options) (*Server, string) {
+	t.Helper()
+	return serve(t, echoHandler{}, opts)
+}
+
+// serve serves h with opts on a loopback listener, and returns the server
+// with the address of the listener.
+func serve(t *testing.T, h Handler, opts Options) (*Server, string) {
+	t.Helper()
+	s, err := NewServer(h, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	go s.Serve(ln)
+	return s, ln.Addr().String()
+}
+
+// testClient is a client connection. Its writes can be batched, so that
+// several TLS records reach the server in a single segment.
+type testClient struct {
+	net.Conn
+	rw io.ReadWriter
+
+	mu    sync.Mutex
+	batch *bytes.Buffer
+}
+
+func (c *testClient) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.batch != nil {
+		return c.batch.Write(p)
+	}
+	return c.Conn.Write(p)
+}
+
+// batched runs f, and sends everything it wrote at once.
+func (c *testClient) batched(t *testing.T, f func()) {
+	t.Helper()
+	c.mu.Lock()
+	c.batch = new(bytes.Buffer)
+	c.mu.Unlock()
+	f()
+	c.mu.Lock()
+	p := c.batch.Bytes()
+	c.batch = nil
+	c.mu.Unlock()
+	if _, err := c.Conn.Write(p); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// send writes a masked message.
+func (c *testClient) send(t *testing.T, op ws.OpCode, p []byte) {
+	t.Helper()
+	if err := ws.WriteFrame(c.rw, ws.MaskFrame(ws.NewFrame(op, true, p))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive reads a message from the server.
+func (c *testClient) receive(t *testing.T) []byte {
+	t.Helper()
+	c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	p, _, err := wsutil.ReadServerData(c.rw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// dial connects to addr, over TLS if config is not nil, and performs the
+// handshake.
+func dial(t *testing.T, addr string, config *tls.Config) *testClient {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &testClient{Conn: conn}
+	var rw io.ReadWriter = c
+	u := &url.URL{Scheme: "ws", Host: addr, Path: "/"}
+	if config != nil {
+		tc := tls.Client(c, config)
+		if err := tc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		rw, u.Scheme = tc, "wss"
+	}
+	br, _, err := ws.Dialer{}.Upgrade(rw, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.rw = rw
+	if br != nil {
+		c.rw = struct {
+			io.Reader
+			io.Writer
+		}{br, rw}
+	}
+	return c
+}
+
+// selfSigned returns a server config with a certificate for 127.0.0.1.
+func selfSigned(t *testing.T) *tls.Config {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+}
+
+// slowOpenHandler greets connections from an OnOpen that takes a while,
+// then echoes them, and records whether an event of a connection was
+// delivered while OnOpen was still running.
+type slowOpenHandler struct {
+	mu      sync.Mutex
+	opening map[*Conn]bool
+	early   bool
+}
+
+func (h *slowOpenHandler) OnOpen(c *Conn) {
+	h.mu.Lock()
+	h.opening[c] = true
+	h.mu.Unlock()
+	c.WriteMessage(ws.OpText, []byte("hello"))
+	time.Sleep(50 * time.Millisecond)
+	h.mu.Lock()
+	delete(h.opening, c)
+	h.mu.Unlock()
+}
+
+func (h *slowOpenHandler) OnMessage(c *Conn, op ws.OpCode, payload []byte) {
+	h.event(c)
+	c.WriteMessage(op, payload)
+}
+
+func (h *slowOpenHandler) OnClose(c *Conn, err error) {
+	h.event(c)
+}
+
+func (h *slowOpenHandler) event(c *Conn) {
+	h.mu.Lock()
+	if h.opening[c] {
+		h.early = true
+	}
+	h.mu.Unlock()
+}
+
+func TestOpenBeforeEvents(t *testing.T) {
+	for _, oneshot := range []bool{false, true} {
+		h := &slowOpenHandler{opening: make(map[*Conn]bool)}
+		s, addr := serve(t, h, Options{Loops: 1, OneShot: oneshot})
+		c := dial(t, addr, nil)
+		c.send(t, ws.OpText, []byte("hi"))
+		if got := string(c.receive(t)); got != "hello" {
+			t.Errorf("oneshot %v: first message %q, want the greeting", oneshot, got)
+		}
+		if got := string(c.receive(t)); got != "hi" {
+			t.Errorf("oneshot %v: second message %q, want the echo", oneshot, got)
+		}
+		// A connection hanging up during OnOpen is closed after it.
+		d := dial(t, addr, nil)
+		d.Close()
+		time.Sleep(100 * time.Millisecond)
+		c.Close()
+		s.Close()
+		h.mu.Lock()
+		if h.early {
+			t.Errorf("oneshot %v: an event was delivered during OnOpen", oneshot)
+		}
+		h.mu.Unlock()
+	}
+}
+
+// TestPeerCloseAnswered closes a connection whose echoes are still queued,
+// which have to reach the peer along with the answer to its close frame.
+func TestPeerCloseAnswered(t *testing.T) {
+	s, addr := startServer(t, Options{Loops: 1})
+	defer s.Close()
+	c := dial(t, addr, nil)
+	defer c.Close()
+	// The echoes outgrow the socket buffers, so most of them are queued
+	// when the close frame is read.
+	msg := bytes.Repeat([]byte("x"), 512<<10)
+	const n = 48
+	for i := 0; i < n; i++ {
+		c.send(t, ws.OpBinary, msg)
+	}
+	c.send(t, ws.OpClose, ws.NewCloseFrameBody(ws.StatusNormalClosure, "bye"))
+	time.Sleep(100 * time.Millisecond)
+	for i := 0; i < n; i++ {
+		if got := c.receive(t); len(got) != len(msg) {
+			t.Fatalf("echo %v of %v bytes, want %v", i, len(got), len(msg))
+		}
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, _, err := wsutil.ReadServerData(c.rw)
+	if ce, ok := err.(wsutil.ClosedError); !ok || ce.Code != ws.StatusNormalClosure {
+		t.Errorf("%v after the echoes, want the close frame", err)
+	}
+}
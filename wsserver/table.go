@@ -0,0 +1,62 @@
+package wsserver
+
+import (
+	"github.com/eranyanay/1m-go-websockets/fdtable"
+)
+
+// connTable maps file descriptors to connections, which carry the
+// generation they were stored with. Lookups take no lock, so the event
+// loops do not contend on it.
+type connTable struct {
+	t fdtable.Table
+}
+
+// put stores c under its fd, assigning it the next generation.
+func (t *connTable) put(c *Conn) {
+	c.gen = t.t.Next()
+	t.t.Put(c.fd, c.gen, c)
+}
+
+// get returns the connection registered as fd with generation gen, or nil
+// if the event it was reported for is stale.
+func (t *connTable) get(fd int, gen uint32) *Conn {
+	c, _ := t.t.Get(fd, gen).(*Conn)
+	return c
+}
+
+// lookup returns the connection registered as fd, whatever its generation.
+func (t *connTable) lookup(fd int) *Conn {
+	v, _ := t.t.Lookup(fd)
+	c, _ := v.(*Conn)
+	return c
+}
+
+// remove clears c's slot unless it was already taken by another
+// connection.
+func (t *connTable) remove(c *Conn) {
+	t.t.Remove(c.fd, c.gen)
+}
+
+// all returns the registered connections.
+func (t *connTable) all() []*Conn {
+	var conns []*Conn
+	t.t.Range(0, func(fd int, gen uint32, v interface{}) bool {
+		conns = append(conns, v.(*Conn))
+		return true
+	})
+	return conns
+}
+
+// after returns up to limit connections, by increasing ID, whose ID is
+// greater than id. Since IDs start with the fd, this only visits the
+// slots from the fd of id on.
+func (t *connTable) after(id uint64, limit int) []*Conn {
+	var conns []*Conn
+	t.t.Range(int(id>>32), func(fd int, gen uint32, v interface{}) bool {
+		if c := v.(*Conn); c.ID() > id {
+			conns = append(conns, c)
+		}
+		return len(conns) < limit
+	})
+	return conns
+}
@@ -0,0 +1,75 @@
+package wsserver
+
+import "testing"
+
+func TestConnTable(t *testing.T) {
+	var tbl connTable
+	old := &Conn{fd: 5}
+	tbl.put(old)
+	if c := tbl.get(5, old.gen); c != old {
+		t.Fatalf("get = %v, want the stored connection", c)
+	}
+
+	// A new connection reusing the fd gets a new generation, and the
+	// events and removals of the old one no longer reach it.
+	tbl.remove(old)
+	c := &Conn{fd: 5}
+	tbl.put(c)
+	if c.gen == old.gen {
+		t.Fatalf("generation %v reused", c.gen)
+	}
+	if got := tbl.get(5, old.gen); got != nil {
+		t.Error("a stale event found the new connection")
+	}
+	tbl.remove(old)
+	if got := tbl.lookup(5); got != c {
+		t.Error("removing the old connection removed the new one")
+	}
+	if c.ID()>>32 != 5 || uint32(c.ID()) != c.gen {
+		t.Errorf("ID %x of fd 5 and generation %v", c.ID(), c.gen)
+	}
+	tbl.remove(c)
+	if got := tbl.lookup(5); got != nil {
+		t.Error("a removed connection is still registered")
+	}
+}
+
+func TestConnTableAfter(t *testing.T) {
+	var tbl connTable
+	var conns []*Conn
+	for _, fd := range []int{3, 9, 4, 100} {
+		c := &Conn{fd: fd}
+		tbl.put(c)
+		conns = append(conns, c)
+	}
+	tests := []struct {
+		after uint64
+		limit int
+		want  []int
+	}{
+		{0, 10, []int{3, 4, 9, 100}},
+		{0, 2, []int{3, 4}},
+		{conns[2].ID(), 2, []int{9, 100}},
+		{conns[2].ID() - 1, 1, []int{4}},
+		{conns[3].ID(), 10, nil},
+	}
+	for _, tt := range tests {
+		var fds []int
+		for _, c := range tbl.after(tt.after, tt.limit) {
+			fds = append(fds, c.fd)
+		}
+		if len(fds) != len(tt.want) {
+			t.Errorf("after(%x, %v) = %v, want %v", tt.after, tt.limit, fds, tt.want)
+			continue
+		}
+		for i := range fds {
+			if fds[i] != tt.want[i] {
+				t.Errorf("after(%x, %v) = %v, want %v", tt.after, tt.limit, fds, tt.want)
+				break
+			}
+		}
+	}
+	if n := len(tbl.all()); n != 4 {
+		t.Errorf("all = %v connections, want 4", n)
+	}
+}
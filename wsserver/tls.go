@@ -0,0 +1,158 @@
+package wsserver
+
+import (
+	"crypto/tls"
+	"golang.org/x/sys/unix"
+	"io"
+	"net"
+	"sync"
+)
+
+// errWouldBlock is returned by a tlsSocket that has no ciphertext left. It
+// is a temporary net.Error, which crypto/tls returns without failing the
+// connection, so that decrypting resumes once the socket is readable.
+var errWouldBlock error = wouldBlockError{}
+
+type wouldBlockError struct{}
+
+func (wouldBlockError) Error() string   { return "wsserver: tls read would block" }
+func (wouldBlockError) Timeout() bool   { return true }
+func (wouldBlockError) Temporary() bool { return true }
+
+// tlsConn is the TLS layer of a connection accepted by Serve with a
+// TLSConfig. Records cannot be read from the non-blocking socket by
+// crypto/tls itself, so the event loops read the ciphertext and hand it to
+// the tls.Conn through its tlsSocket, and queue the ciphertext it writes
+// like any other frame.
+type tlsConn struct {
+	*tls.Conn
+	sock *tlsSocket
+}
+
+func newTLSConn(conn net.Conn, config *tls.Config) *tlsConn {
+	sock := &tlsSocket{Conn: conn}
+	return &tlsConn{Conn: tls.Server(sock, config), sock: sock}
+}
+
+// tlsSocket is the transport under a tlsConn. Until the connection is
+// registered it reads and writes the socket, so that the TLS and WebSocket
+// handshakes are done with blocking I/O by the goroutine that accepted it.
+// Once polled, it reads the ciphertext fed by the event loops and keeps
+// what is written to it for them to queue.
+type tlsSocket struct {
+	net.Conn
+	polled bool
+	// in is ciphertext read from the socket and not consumed yet. It
+	// points into the buffer lent by the event loop while the connection
+	// is served, and into kept once it is not.
+	in   []byte
+	kept []byte
+
+	// mu guards out, which holds records written by crypto/tls and not
+	// queued yet.
+	mu  sync.Mutex
+	out []byte
+}
+
+func (s *tlsSocket) Read(p []byte) (int, error) {
+	if !s.polled {
+		return s.Conn.Read(p)
+	}
+	if len(s.in) == 0 {
+		return 0, errWouldBlock
+	}
+	n := copy(p, s.in)
+	s.in = s.in[n:]
+	return n, nil
+}
+
+func (s *tlsSocket) Write(p []byte) (int, error) {
+	if !s.polled {
+		return s.Conn.Write(p)
+	}
+	s.mu.Lock()
+	s.out = append(s.out, p...)
+	s.mu.Unlock()
+	return len(p), nil
+}
+
+// keep copies the ciphertext not consumed yet out of the buffer lent by
+// the event loop, which the next connection it serves overwrites. It is
+// left there when a connection is delayed by the rate limit before
+// crypto/tls read every record.
+func (s *tlsSocket) keep() {
+	if len(s.in) > 0 {
+		s.kept = append(s.kept[:0], s.in...)
+		s.in = s.kept
+	}
+}
+
+// take returns the records written since the last call.
+func (s *tlsSocket) take() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := s.out
+	s.out = nil
+	return out
+}
+
+// seal encrypts frame into TLS records. c.mu must be held, so that records
+// are queued in the order they were sealed in.
+func (t *tlsConn) seal(frame []byte) ([]byte, error) {
+	if _, err := t.Write(frame); err != nil {
+		return nil, err
+	}
+	return t.sock.take(), nil
+}
+
+// flushTLS queues the records crypto/tls wrote on its own while reading,
+// such as the answer to a key update.
+func (c *Conn) flushTLS() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	records := c.tls.sock.take()
+	if c.closed || len(records) == 0 {
+		return nil
+	}
+	return c.push(records)
+}
+
+// fillTLS is fill for a connection served over TLS: the plaintext t has
+// decrypted is read first, and the socket is only read when t has nothing
+// left, so no decrypted data is left behind once the socket is drained.
+// Ciphertext is read in rb as well.
+func (rb *readBuffer) fillTLS(fd int, t *tlsConn) (bool, error) {
+	rb.grow()
+	for {
+		n, err := t.Read(rb.buf[len(rb.buf):cap(rb.buf)])
+		if n > 0 {
+			rb.buf = rb.buf[:len(rb.buf)+n]
+			return true, nil
+		}
+		if err != errWouldBlock {
+			if err == nil {
+				continue
+			}
+			return false, err
+		}
+		if rb.cipher == nil {
+			rb.cipher = make([]byte, tlsRecordSize)
+		}
+		n, err = unix.Read(fd, rb.cipher)
+		switch {
+		case err == unix.EINTR:
+			continue
+		case err == unix.EAGAIN:
+			return false, nil
+		case err != nil:
+			return false, err
+		case n == 0:
+			return false, io.EOF
+		}
+		t.sock.in = rb.cipher[:n]
+	}
+}
+
+// tlsRecordSize is the size of the largest TLS record, with its header and
+// overhead.
+const tlsRecordSize = 16<<10 + 2048 + 5
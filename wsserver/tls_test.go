@@ -0,0 +1,54 @@
+package wsserver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/eranyanay/1m-go-websockets/ratelimit"
+	"github.com/gobwas/ws"
+	"testing"
+)
+
+// TestTLSDelayKeepsCiphertext delays a connection that still has records
+// it read but did not decrypt, while another connection is read by the
+// same loop in the same buffer.
+func TestTLSDelayKeepsCiphertext(t *testing.T) {
+	s, addr := startServer(t, Options{
+		Loops:     1,
+		TLSConfig: selfSigned(t),
+		RateLimit: ratelimit.Limiter{Messages: 20, MessageBurst: 1, Policy: ratelimit.Delay},
+	})
+	defer s.Close()
+	config := &tls.Config{InsecureSkipVerify: true}
+	slow := dial(t, addr, config)
+	defer slow.Close()
+	other := dial(t, addr, config)
+	defer other.Close()
+
+	var msgs [][]byte
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, bytes.Repeat([]byte{byte('a' + i)}, 3000))
+	}
+	slow.batched(t, func() {
+		for _, m := range msgs {
+			slow.send(t, ws.OpBinary, m)
+		}
+	})
+	// The first message exhausts the rate, so the others stay buffered
+	// until slow is read again.
+	if got := slow.receive(t); !bytes.Equal(got, msgs[0]) {
+		t.Fatalf("message 0: got %.10q..., want %.10q...", got, msgs[0])
+	}
+	other.batched(t, func() {
+		for i := 0; i < 4; i++ {
+			other.send(t, ws.OpBinary, bytes.Repeat([]byte{'z'}, 3000))
+		}
+	})
+	for i, m := range msgs[1:] {
+		if got := slow.receive(t); !bytes.Equal(got, m) {
+			t.Fatalf("message %v: got %.10q..., want %.10q...", i+1, got, m)
+		}
+	}
+	for i := 0; i < 4; i++ {
+		other.receive(t)
+	}
+}
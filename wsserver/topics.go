@@ -0,0 +1,153 @@
+package wsserver
+
+import (
+	"errors"
+	"github.com/gobwas/ws"
+	"sort"
+)
+
+const (
+	// minTopicCap is the capacity below which the member slice of a topic
+	// is not shrunk.
+	minTopicCap = 64
+	// defaultMaxSubscriptions and defaultMaxTopics bound the topics of a
+	// connection and of the server unless Options says otherwise.
+	defaultMaxSubscriptions = 16
+	defaultMaxTopics        = 1 << 16
+)
+
+var (
+	// ErrTooManySubscriptions is returned by Subscribe when the connection
+	// subscribed to Options.MaxSubscriptions topics already.
+	ErrTooManySubscriptions = errors.New("wsserver: too many subscriptions")
+	// ErrTooManyTopics is returned by Subscribe when the topic does not
+	// exist and the server has Options.MaxTopics topics already.
+	ErrTooManyTopics = errors.New("wsserver: too many topics")
+)
+
+// topic is a named set of connections. Members are kept in a slice rather
+// than a map, one word each, and every connection remembers its position
+// in the topics it subscribed to so that it can be removed by swapping the
+// last member into its place.
+type topic struct {
+	name  string
+	conns []*Conn
+}
+
+// Subscribe adds c to the named topic. Subscribing twice has no effect. It
+// fails with ErrTooManySubscriptions or ErrTooManyTopics beyond the limits
+// of Options.
+func (s *Server) Subscribe(c *Conn, name string) error {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	// A connection closed from now on is unsubscribed by closed, which
+	// waits for topicsMu.
+	if c.isClosed() {
+		return ErrClosed
+	}
+	t := s.topics[name]
+	if _, ok := c.subs[t]; ok {
+		return nil
+	}
+	if len(c.subs) >= s.opts.MaxSubscriptions {
+		return ErrTooManySubscriptions
+	}
+	if t == nil {
+		if len(s.topics) >= s.opts.MaxTopics {
+			return ErrTooManyTopics
+		}
+		t = &topic{name: name}
+		s.topics[name] = t
+	}
+	if c.subs == nil {
+		c.subs = make(map[*topic]int)
+	}
+	c.subs[t] = len(t.conns)
+	t.conns = append(t.conns, c)
+	return nil
+}
+
+// Unsubscribe removes c from the named topic.
+func (s *Server) Unsubscribe(c *Conn, name string) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	if t := s.topics[name]; t != nil {
+		if _, ok := c.subs[t]; ok {
+			s.unsubscribe(c, t)
+		}
+	}
+}
+
+// Publish sends a single frame message of type op to the subscribers of
+// the named topic, like Broadcast does to every connection.
+func (s *Server) Publish(name string, op ws.OpCode, payload []byte) (BroadcastStats, error) {
+	frames, err := s.compile(op, payload)
+	if err != nil {
+		return BroadcastStats{}, err
+	}
+	return s.fanOut(s.subscribers(name), frames), nil
+}
+
+// PublishFrame writes an encoded frame to the subscribers of the named
+// topic, like BroadcastFrame does to every connection.
+func (s *Server) PublishFrame(name string, frame []byte) BroadcastStats {
+	return s.fanOut(s.subscribers(name), frames{plain: frame})
+}
+
+// subscribers returns the connections subscribed to the named topic.
+func (s *Server) subscribers(name string) []*Conn {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	var conns []*Conn
+	if t := s.topics[name]; t != nil {
+		conns = append(conns, t.conns...)
+	}
+	return conns
+}
+
+// topicNames returns the names of the topics c subscribed to, sorted.
+func (s *Server) topicNames(c *Conn) []string {
+	s.topicsMu.RLock()
+	defer s.topicsMu.RUnlock()
+	names := make([]string, 0, len(c.subs))
+	for t := range c.subs {
+		names = append(names, t.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// unsubscribeAll removes c from every topic.
+func (s *Server) unsubscribeAll(c *Conn) {
+	s.topicsMu.Lock()
+	defer s.topicsMu.Unlock()
+	for t := range c.subs {
+		s.unsubscribe(c, t)
+	}
+}
+
+// unsubscribe removes c from t, which it subscribed to. Empty topics are
+// deleted and topics that lost most of their members are shrunk.
+// topicsMu must be held.
+func (s *Server) unsubscribe(c *Conn, t *topic) {
+	index := c.subs[t]
+	last := len(t.conns) - 1
+	if index != last {
+		moved := t.conns[last]
+		t.conns[index] = moved
+		moved.subs[t] = index
+	}
+	t.conns[last] = nil
+	t.conns = t.conns[:last]
+	switch {
+	case last == 0:
+		delete(s.topics, t.name)
+	case cap(t.conns) > minTopicCap && last < cap(t.conns)/4:
+		t.conns = append([]*Conn(nil), t.conns...)
+	}
+
+	delete(c.subs, t)
+	if len(c.subs) == 0 {
+		c.subs = nil
+	}
+}
@@ -0,0 +1,66 @@
+package wsserver
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSubscribeLimits(t *testing.T) {
+	s, addr := startServer(t, Options{Loops: 1, MaxSubscriptions: 2, MaxTopics: 3})
+	defer s.Close()
+	dial(t, addr, nil)
+	dial(t, addr, nil)
+	for deadline := time.Now().Add(5 * time.Second); s.Len() < 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("%v connections registered, want 2", s.Len())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conns := s.conns.all()
+
+	steps := []struct {
+		conn        int
+		unsubscribe bool
+		topic       string
+		err         error
+	}{
+		{0, false, "a", nil},
+		{0, false, "a", nil},
+		{1, false, "a", nil},
+		{0, false, "b", nil},
+		{0, false, "c", ErrTooManySubscriptions},
+		{1, false, "c", nil},
+		{1, false, "d", ErrTooManySubscriptions},
+		{0, true, "a", nil},
+		{0, false, "d", ErrTooManyTopics},
+		{1, true, "a", nil},
+		{0, false, "d", nil},
+		{1, false, "b", nil},
+	}
+	for i, st := range steps {
+		c := conns[st.conn]
+		if st.unsubscribe {
+			s.Unsubscribe(c, st.topic)
+			continue
+		}
+		if err := s.Subscribe(c, st.topic); err != st.err {
+			t.Fatalf("step %v: Subscribe(%v, %q) = %v, want %v", i, st.conn, st.topic, err, st.err)
+		}
+	}
+
+	for i, want := range [][]string{{"b", "d"}, {"b", "c"}} {
+		if got := s.topicNames(conns[i]); !reflect.DeepEqual(got, want) {
+			t.Errorf("topics of %v = %v, want %v", i, got, want)
+		}
+	}
+	if got := len(s.subscribers("b")); got != 2 {
+		t.Errorf("b has %v subscribers, want 2", got)
+	}
+	for _, c := range conns {
+		s.unsubscribeAll(c)
+	}
+	if n := s.Stats().Topics; n != 0 {
+		t.Errorf("%v topics left, want 0", n)
+	}
+}
@@ -0,0 +1,67 @@
+package wsserver
+
+import (
+	"github.com/eranyanay/1m-go-websockets/closes"
+	"github.com/gobwas/ws"
+)
+
+// Violation classifies how a connection violated the protocol.
+type Violation = closes.Violation
+
+const (
+	// ViolationUnmasked is a frame sent without a mask.
+	ViolationUnmasked = closes.Unmasked
+	// ViolationReservedBits is a frame setting reserved bits that no
+	// extension negotiated.
+	ViolationReservedBits = closes.ReservedBits
+	// ViolationReservedOpCode is a frame with a reserved opcode.
+	ViolationReservedOpCode = closes.ReservedOpCode
+	// ViolationControlFrame is a fragmented or oversized control frame.
+	ViolationControlFrame = closes.ControlFrame
+	// ViolationUnexpectedFrame is a continuation frame outside of a
+	// fragmented message, or a data frame inside one.
+	ViolationUnexpectedFrame = closes.UnexpectedFrame
+	// ViolationCompression is an invalid compressed message, or a
+	// compressed control or continuation frame.
+	ViolationCompression = closes.Compression
+	// ViolationCloseFrame is a close frame with an invalid status code.
+	ViolationCloseFrame = closes.CloseFrame
+	// ViolationInvalidUTF8 is a text message or a close reason that is not
+	// valid UTF-8.
+	ViolationInvalidUTF8 = closes.InvalidUTF8
+	// ViolationFrameTooBig is a frame larger than Options.MaxFrameSize.
+	ViolationFrameTooBig = closes.FrameTooBig
+	// ViolationMessageTooBig is a message larger than
+	// Options.MaxMessageSize.
+	ViolationMessageTooBig = closes.MessageTooBig
+)
+
+// ViolationOf classifies the error a connection was closed with, as passed
+// to Handler.OnClose. It returns false if the connection did not violate
+// the protocol.
+func ViolationOf(err error) (Violation, bool) {
+	switch err {
+	case errUnmaskedFrame:
+		return ViolationUnmasked, true
+	case errReservedBits:
+		return ViolationReservedBits, true
+	case errReservedOpCode:
+		return ViolationReservedOpCode, true
+	case errControlFrame:
+		return ViolationControlFrame, true
+	case errUnexpectedFrame:
+		return ViolationUnexpectedFrame, true
+	case errInflate, errCompressedCtrl:
+		return ViolationCompression, true
+	case errCloseFrame, ws.ErrProtocolStatusCodeNotInUse, ws.ErrProtocolStatusCodeApplicationLevel,
+		ws.ErrProtocolStatusCodeNoMeaning, ws.ErrProtocolStatusCodeUnknown:
+		return ViolationCloseFrame, true
+	case errInvalidUTF8, ws.ErrProtocolInvalidUTF8:
+		return ViolationInvalidUTF8, true
+	case errFrameTooBig:
+		return ViolationFrameTooBig, true
+	case errMessageTooBig:
+		return ViolationMessageTooBig, true
+	}
+	return 0, false
+}